@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingStore is a MemoryStore whose user lookups fail with err
+type failingStore struct {
+	*MemoryStore
+	err error
+}
+
+func (s failingStore) GetUser(ctx context.Context, username string) (*User, error) {
+	return nil, s.err
+}
+
+// request sends a request to the API and returns the response, with body
+// as the JSON request body and headers as name, value pairs
+func request(t *testing.T, handler http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// problem decodes a problem details response
+func problem(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Content-Type = %q, want application/problem+json; body %s", ct, rec.Body)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding problem: %v", err)
+	}
+	return body
+}
+
+// newTestAPI serves a memory store holding user john with a home address,
+// a pending order of his and a product with 5 in stock. It returns the
+// order's ID.
+func newTestAPI(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	return serveTestAPI(t, NewMemoryStore())
+}
+
+// serveTestAPI is newTestAPI for any store
+func serveTestAPI(t *testing.T, store Store) (http.Handler, string) {
+	t.Helper()
+	handler := setupRoutes(NewAPI(store))
+
+	rec := request(t, handler, "POST", "/users", `{"username": "john", "email": "john@example.com", "addresses": {"home": {"street": "1 Main St", "country": "US"}}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("creating user: %d %s", rec.Code, rec.Body)
+	}
+	rec = request(t, handler, "POST", "/products", `{"sku": "LAPTOP-01", "name": "Laptop", "unit_price": "1299.99", "currency": "USD", "stock": 5}`)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatalf("creating product: %d %s", rec.Code, rec.Body)
+	}
+	rec = request(t, handler, "POST", "/orders", `{"user_id": "john", "address_key": "home"}`)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatalf("creating order: %d %s", rec.Code, rec.Body)
+	}
+
+	var order Order
+	if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil {
+		t.Fatalf("decoding order: %v", err)
+	}
+	return handler, order.ID
+}
+
+func TestNotFound(t *testing.T) {
+	handler, _ := newTestAPI(t)
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{"GET", "/users/nobody", ""},
+		{"PATCH", "/users/nobody", `{"email": "nobody@example.com"}`},
+		{"DELETE", "/users/nobody", ""},
+		{"GET", "/users/john/addresses/cabin", ""},
+		{"GET", "/orders/no-such-order", ""},
+		{"POST", "/orders/no-such-order/items", `{"sku": "LAPTOP-01", "quantity": 1}`},
+		{"GET", "/products/NOPE", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := request(t, handler, tt.method, tt.path, tt.body)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want 404; body %s", rec.Code, rec.Body)
+			}
+			if p := problem(t, rec); p["type"] != "/problems/not-found" {
+				t.Errorf("type = %v, want /problems/not-found", p["type"])
+			}
+		})
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantDetail string
+	}{
+		{"internal", errors.New("connection reset by peer"), http.StatusInternalServerError, "the request could not be completed"},
+		{"throttled", fmt.Errorf("%w: slow down", ErrThrottled), http.StatusServiceUnavailable, "request throttled: slow down"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := setupRoutes(NewAPI(failingStore{MemoryStore: NewMemoryStore(), err: tt.err}))
+
+			rec := request(t, handler, "GET", "/users/john", "")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if p := problem(t, rec); p["detail"] != tt.wantDetail {
+				t.Errorf("detail = %v, want %q", p["detail"], tt.wantDetail)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("throttled response has no Retry-After")
+			}
+		})
+	}
+}
+
+func TestConflict(t *testing.T) {
+	handler, orderID := newTestAPI(t)
+
+	rec := request(t, handler, "POST", "/users", `{"username": "john", "email": "other@example.com"}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("duplicate user: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+
+	rec = request(t, handler, "POST", "/orders/"+orderID+"/items", `{"sku": "LAPTOP-01", "quantity": 6}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("insufficient stock: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+	p := problem(t, rec)
+	if p["sku"] != "LAPTOP-01" || p["requested"] != 6.0 || p["available"] != 5.0 {
+		t.Errorf("insufficient stock problem = %v, want sku LAPTOP-01, requested 6, available 5", p)
+	}
+
+	rec = request(t, handler, "PUT", "/orders/"+orderID+"/status", `{"status": "delivered"}`, "If-Match", "*")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("pending -> delivered: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	handler, orderID := newTestAPI(t)
+	user := `{"email": "john@example.com", "addresses": {"home": {"street": "2 Main St", "country": "US"}}}`
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		wantStatus int
+	}{
+		{"PUT user without If-Match", "PUT", "/users/john", user, nil, http.StatusPreconditionRequired},
+		{"PUT user with an old ETag", "PUT", "/users/john", user, []string{"If-Match", `"7"`}, http.StatusPreconditionFailed},
+		{"PUT user with a bad ETag", "PUT", "/users/john", user, []string{"If-Match", "seven"}, http.StatusPreconditionFailed},
+		{"create an existing user", "PUT", "/users/john", user, []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		{"PATCH user with an old ETag", "PATCH", "/users/john", `{"full_name": "John"}`, []string{"If-Match", `"7"`}, http.StatusPreconditionFailed},
+		{"status without If-Match", "PUT", "/orders/" + orderID + "/status", `{"status": "confirmed"}`, nil, http.StatusPreconditionRequired},
+		{"status with an old ETag", "PUT", "/orders/" + orderID + "/status", `{"status": "confirmed"}`, []string{"If-Match", `"7"`}, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(t, handler, tt.method, tt.path, tt.body, tt.headers...)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			problem(t, rec)
+		})
+	}
+
+	// The ETag from GET is what a write has to send
+	rec := request(t, handler, "GET", "/users/john", "")
+	etag := rec.Header().Get("ETag")
+	rec = request(t, handler, "PUT", "/users/john", user, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT with the current ETag: status = %d, want 200; body %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Errorf("ETag %s did not change on PUT", etag)
+	}
+	rec = request(t, handler, "PUT", "/users/john", user, "If-Match", etag)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with the replaced ETag: status = %d, want 412", rec.Code)
+	}
+
+	rec = request(t, handler, "PUT", "/users/jane", user, "If-Match", "*")
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with If-Match: * for a new user: status = %d, want 412; body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	handler, orderID := newTestAPI(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{
+			name:       "invalid user fields",
+			method:     "POST",
+			path:       "/users",
+			body:       `{"username": "jane", "email": "not an email", "addresses": {"home": {"street": "1 Main St"}}}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"email", "addresses.home.country"},
+		},
+		{
+			name:       "members of the wrong type",
+			method:     "POST",
+			path:       "/products",
+			body:       `{"sku": "DESK-01", "name": "", "unit_price": "12.345", "currency": "USD", "stock": "many"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"stock", "unit_price"},
+		},
+		{
+			name:       "replacing stock",
+			method:     "PUT",
+			path:       "/products/LAPTOP-01",
+			body:       `{"name": "Laptop", "unit_price": "1299.99", "currency": "USD", "stock": 9}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"stock"},
+		},
+		{
+			name:       "malformed JSON",
+			method:     "POST",
+			path:       "/products",
+			body:       `{"sku": `,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown status",
+			method:     "PUT",
+			path:       "/orders/" + orderID + "/status",
+			body:       `{"status": "lost"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(t, handler, tt.method, tt.path, tt.body, "If-Match", "*")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			p := problem(t, rec)
+			if p["type"] != "/problems/validation" {
+				t.Errorf("type = %v, want /problems/validation", p["type"])
+			}
+
+			errs, _ := p["errors"].([]any)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.(map[string]any)["field"].(string))
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestDeleteAddressRace(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	newTestOrder(t, repo, 5)
+	handler := setupRoutes(NewAPI(repo))
+
+	rec := request(t, handler, "PUT", "/users/john/addresses/work", `{"street": "2 Side St", "country": "US"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("adding work address: %d %s", rec.Code, rec.Body)
+	}
+	rec = request(t, handler, "DELETE", "/users/john/addresses/home", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("deleting an address an order ships to: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+
+	// placeOrder places an order shipping to work in the middle of the
+	// delete, at the first op request that follows an after request
+	placeOrder := func(after, op string) (placed *atomic.Bool, placeErr *error) {
+		placed, placeErr, seen := new(atomic.Bool), new(error), new(atomic.Bool)
+		fake.intercept = func(name string) *fakeError {
+			if name == after {
+				seen.Store(true)
+			} else if name == op && seen.Load() && placed.CompareAndSwap(false, true) {
+				order := &Order{ID: "order-work", UserID: "john", Status: OrderStatusPending, AddressKey: "work", Currency: defaultCurrency, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+				*placeErr = repo.CreateOrder(ctx, order)
+			}
+			return nil
+		}
+		return placed, placeErr
+	}
+
+	// An order placed after the address was removed cannot use it
+	placed, placeErr := placeOrder("UpdateItem", "Query")
+	rec = request(t, handler, "DELETE", "/users/john/addresses/work", "")
+	fake.intercept = nil
+	if !placed.Load() || !errors.Is(*placeErr, ErrAddressNotFound) {
+		t.Errorf("placing an order while its address is deleted: %v, want ErrAddressNotFound", *placeErr)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("deleting an unused address: status = %d, want 204; body %s", rec.Code, rec.Body)
+	}
+
+	// An order placed before the address was removed keeps it
+	request(t, handler, "PUT", "/users/john/addresses/work", `{"street": "2 Side St", "country": "US"}`)
+	placed, placeErr = placeOrder("Query", "UpdateItem")
+	rec = request(t, handler, "DELETE", "/users/john/addresses/work", "")
+	fake.intercept = nil
+	if !placed.Load() || *placeErr != nil {
+		t.Fatalf("placing an order before its address is deleted: %v", *placeErr)
+	}
+	if rec.Code != http.StatusConflict {
+		t.Errorf("deleting an address while an order is placed: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+
+	user, err := repo.GetUser(ctx, "john")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if _, ok := user.Addresses["home"]; !ok {
+		t.Error("home address was deleted")
+	}
+	if _, ok := user.Addresses["work"]; !ok {
+		t.Error("work address was deleted")
+	}
+}
+
+func TestDeleteAddressInUse(t *testing.T) {
+	handler, _ := newTestAPI(t)
+
+	etag := request(t, handler, "GET", "/users/john", "").Header().Get("ETag")
+	rec := request(t, handler, "DELETE", "/users/john/addresses/home", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("deleting an address an order ships to: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+	rec = request(t, handler, "GET", "/users/john/addresses/home", "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET after a refused delete: status = %d, want 200", rec.Code)
+	}
+	rec = request(t, handler, "GET", "/users/john", "")
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag after a refused delete = %s, want %s", got, etag)
+	}
+}
+
+func TestDeleteAddressRestore(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	newTestOrder(t, repo, 5)
+	handler := setupRoutes(NewAPI(repo))
+
+	rec := request(t, handler, "PUT", "/users/john/addresses/work", `{"street": "2 Side St", "country": "US"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("adding work address: %d %s", rec.Code, rec.Body)
+	}
+	rec = request(t, handler, "PUT", "/users/john/addresses/home", `{"street": "1 Main St", "country": "US", "default": true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("making home the default: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = request(t, handler, "DELETE", "/users/john/addresses/home", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("deleting an address an order ships to: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+	if user, err := repo.GetUser(ctx, "john"); err != nil || user.DefaultAddress != "home" {
+		t.Errorf("default address after a refused delete = %+v, %v; want home", user, err)
+	}
+
+	// Work is made the default while home is out of the address book, and
+	// putting home back leaves that alone
+	var removed, changed atomic.Bool
+	var changeErr error
+	fake.intercept = func(name string) *fakeError {
+		if name == "UpdateItem" {
+			removed.Store(true)
+		} else if name == "Query" && removed.Load() && changed.CompareAndSwap(false, true) {
+			_, changeErr = repo.UpdateUser(ctx, "john", UserPatch{DefaultAddress: patchValue("work")}, anyVersion)
+		}
+		return nil
+	}
+	rec = request(t, handler, "DELETE", "/users/john/addresses/home", "")
+	fake.intercept = nil
+	if !changed.Load() || changeErr != nil {
+		t.Fatalf("changing the default during the delete: %v", changeErr)
+	}
+	if rec.Code != http.StatusConflict {
+		t.Errorf("deleting an address an order ships to: status = %d, want 409; body %s", rec.Code, rec.Body)
+	}
+
+	user, err := repo.GetUser(ctx, "john")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if _, ok := user.Addresses["home"]; !ok {
+		t.Error("home address was not put back")
+	}
+	if user.DefaultAddress != "work" {
+		t.Errorf("default address = %q, want the work address chosen during the delete", user.DefaultAddress)
+	}
+}
+
+func TestOrderCurrency(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, usdOrder := serveTestAPI(t, store)
+			rec := request(t, handler, "POST", "/products", `{"sku": "BOOK-01", "name": "Book", "unit_price": "24.50", "currency": "EUR", "stock": 5}`)
+			if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+				t.Fatalf("creating product: %d %s", rec.Code, rec.Body)
+			}
+
+			rec = request(t, handler, "POST", "/orders", `{"user_id": "john", "address_key": "home", "currency": "JPY"}`)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("order in JPY: status = %d, want 422; body %s", rec.Code, rec.Body)
+			}
+			rec = request(t, handler, "POST", "/orders/"+usdOrder+"/items", `{"sku": "BOOK-01", "quantity": 1}`)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("EUR item on a USD order: status = %d, want 422; body %s", rec.Code, rec.Body)
+			}
+
+			rec = request(t, handler, "POST", "/orders", `{"user_id": "john", "address_key": "home", "currency": "EUR"}`)
+			var order Order
+			if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || order.Currency != "EUR" {
+				t.Fatalf("creating an order in EUR: %d %s", rec.Code, rec.Body)
+			}
+			rec = request(t, handler, "POST", "/orders/"+order.ID+"/items", `{"sku": "BOOK-01", "quantity": 2}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("adding a EUR item: status = %d, want 200; body %s", rec.Code, rec.Body)
+			}
+			rec = request(t, handler, "POST", "/orders/"+order.ID+"/items", `{"sku": "LAPTOP-01", "quantity": 1}`)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("USD item on a EUR order: status = %d, want 422; body %s", rec.Code, rec.Body)
+			}
+
+			rec = request(t, handler, "GET", "/orders/"+order.ID, "")
+			if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil {
+				t.Fatalf("GET order: %d %s", rec.Code, rec.Body)
+			}
+			if order.Currency != "EUR" || order.Subtotal != 4900 || order.ItemCount != 2 {
+				t.Errorf("order = %s %s, %d items; want EUR 49.00, 2 items", order.Currency, order.Subtotal, order.ItemCount)
+			}
+		})
+	}
+}
+
+func TestUserOrdersByStatus(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, today := serveTestAPI(t, store)
+			for _, day := range []string{"2024-12-31", "2025-01-01", "2025-01-15", "2025-02-01", "2025-02-02"} {
+				created, _ := time.Parse(dateLayout, day)
+				order := &Order{ID: day, UserID: "john", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency, CreatedAt: created, UpdatedAt: created}
+				if err := store.CreateOrder(ctx, order); err != nil {
+					t.Fatalf("CreateOrder: %v", err)
+				}
+			}
+
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"status=pending&from=2025-01-01&to=2025-02-01", []string{"2025-01-01", "2025-01-15", "2025-02-01"}},
+				{"status=pending&from=2025-01-15&to=2025-01-15", []string{"2025-01-15"}},
+				{"status=pending&from=2025-02-01", []string{"2025-02-01", "2025-02-02", today}},
+				{"status=pending&to=2025-01-01", []string{"2024-12-31", "2025-01-01"}},
+				{"status=confirmed&from=2025-01-01", nil},
+			}
+			for _, tt := range tests {
+				rec := request(t, handler, "GET", "/users/john/orders?"+tt.query, "")
+				var page Page[*Order]
+				if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+					t.Fatalf("%s: %d %s", tt.query, rec.Code, rec.Body)
+				}
+				var got []string
+				for _, order := range page.Items {
+					got = append(got, order.ID)
+				}
+				slices.Sort(got)
+				if want := slices.Sorted(slices.Values(tt.want)); !slices.Equal(got, want) {
+					t.Errorf("%s = %v, want %v", tt.query, got, want)
+				}
+			}
+
+			for _, query := range []string{
+				"status=pending&from=2025-13-01",
+				"status=pending&to=01/02/2025",
+				"status=pending&from=2025-02-01&to=2025-01-01",
+				"from=2025-01-01",
+				"to=2025-02-01",
+			} {
+				rec := request(t, handler, "GET", "/users/john/orders?"+query, "")
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("%s: status = %d, want 400; body %s", query, rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderETagAfterItems(t *testing.T) {
+	repo, fake := newFakeRepository(t)
+	order := newTestOrder(t, repo, 5)
+	handler := setupRoutes(NewAPI(repo))
+
+	// The inverted-index has not caught up with the item added below
+	fake.freezeIndexes()
+	rec := request(t, handler, "POST", "/orders/"+order.ID+"/items", `{"sku": "LAPTOP-01", "quantity": 1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("adding item: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = request(t, handler, "GET", "/orders/"+order.ID, "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag != `"2"` {
+		t.Fatalf("GET after adding an item: status = %d, ETag %s; want 200, \"2\"", rec.Code, etag)
+	}
+	rec = request(t, handler, "PUT", "/orders/"+order.ID+"/status", `{"status": "confirmed"}`, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Errorf("PUT status with the ETag from GET: status = %d, want 200; body %s", rec.Code, rec.Body)
+	}
+}
+
+// listAll follows next_cursor from path until the list is exhausted and
+// returns the key field of every item, failing if a page is over limit
+func listAll(t *testing.T, handler http.Handler, path, key string, limit int) []string {
+	t.Helper()
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatalf("%s: still paging after 100 pages", path)
+		}
+		rec := request(t, handler, "GET", fmt.Sprintf("%s?limit=%d&cursor=%s", path, limit, cursor), "")
+		var page Page[map[string]any]
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+		if len(page.Items) > limit {
+			t.Errorf("%s: page of %d, want at most %d", path, len(page.Items), limit)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, fmt.Sprint(item[key]))
+		}
+		if page.NextCursor == "" {
+			return keys
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func TestPagination(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, first := serveTestAPI(t, store)
+			orders := []string{first}
+			for range 6 {
+				rec := request(t, handler, "POST", "/orders", `{"user_id": "john", "address_key": "home"}`)
+				var order Order
+				if err := json.Unmarshal(rec.Body.Bytes(), &order); err != nil || order.ID == "" {
+					t.Fatalf("creating order: %d %s", rec.Code, rec.Body)
+				}
+				orders = append(orders, order.ID)
+			}
+
+			skus := []string{"LAPTOP-01"}
+			for i := range 6 {
+				sku := fmt.Sprintf("BOOK-%02d", i)
+				rec := request(t, handler, "POST", "/products", fmt.Sprintf(`{"sku": %q, "name": "Book", "unit_price": "9.99", "stock": 5}`, sku))
+				if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+					t.Fatalf("creating product: %d %s", rec.Code, rec.Body)
+				}
+				skus = append(skus, sku)
+			}
+			var items []string
+			for _, sku := range skus {
+				rec := request(t, handler, "POST", "/orders/"+first+"/items", fmt.Sprintf(`{"sku": %q, "quantity": 1}`, sku))
+				var item OrderItem
+				if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || item.ItemID == "" {
+					t.Fatalf("adding item: %d %s", rec.Code, rec.Body)
+				}
+				items = append(items, item.ItemID)
+			}
+
+			tests := []struct {
+				path, key string
+				want      []string
+			}{
+				{"/users/john/orders", "id", orders},
+				{"/orders/pending", "id", orders},
+				{"/orders/" + first + "/items", "item_id", items},
+				{"/products", "sku", skus},
+			}
+			for _, tt := range tests {
+				for _, limit := range []int{1, 3, 7, 50} {
+					got := listAll(t, handler, tt.path, tt.key, limit)
+					slices.Sort(got)
+					if want := slices.Sorted(slices.Values(tt.want)); !slices.Equal(got, want) {
+						t.Errorf("%s with limit %d listed %v, want %v", tt.path, limit, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCursorScope(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			handler, _ := serveTestAPI(t, store)
+			rec := request(t, handler, "POST", "/orders", `{"user_id": "john", "address_key": "home"}`)
+			if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+				t.Fatalf("creating order: %d %s", rec.Code, rec.Body)
+			}
+
+			rec = request(t, handler, "GET", "/users/john/orders?status=pending&from=2000-01-01&limit=1", "")
+			var page Page[*Order]
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || page.NextCursor == "" {
+				t.Fatalf("first page: %d %s", rec.Code, rec.Body)
+			}
+
+			// The same orders, but a cursor does not carry over to another range
+			rec = request(t, handler, "GET", "/users/john/orders?status=pending&from=2000-01-01&to=9999-01-01&limit=1&cursor="+page.NextCursor, "")
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("cursor in another range: status = %d, want 400; body %s", rec.Code, rec.Body)
+			}
+			rec = request(t, handler, "GET", "/users/john/orders?status=pending&from=2000-01-01&limit=1&cursor="+page.NextCursor, "")
+			if rec.Code != http.StatusOK {
+				t.Errorf("cursor in its own range: status = %d, want 200; body %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// maxBatchWriteItems is the BatchWriteItem request limit
+	maxBatchWriteItems = 25
+
+	// maxBatchAttempts bounds how often a batch is sent while DynamoDB keeps
+	// returning UnprocessedItems
+	maxBatchAttempts = 8
+)
+
+// batchWrite sends write requests in batches of 25, resending the
+// UnprocessedItems of each batch with backoff until they are all written
+func (r *Repository) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	for start := 0; start < len(requests); start += maxBatchWriteItems {
+		batch := requests[start:min(start+maxBatchWriteItems, len(requests))]
+
+		for attempt := 0; len(batch) > 0; attempt++ {
+			if attempt == maxBatchAttempts {
+				return fmt.Errorf("%d writes still unprocessed after %d attempts", len(batch), attempt)
+			}
+			if err := backoff(ctx, attempt); err != nil {
+				return err
+			}
+
+			output, err := r.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{r.tableName: batch},
+			})
+			if err != nil {
+				return err
+			}
+			batch = output.UnprocessedItems[r.tableName]
+		}
+	}
+	return nil
+}
+
+// deleteRequest deletes the row with the pk and sk of item
+func deleteRequest(item map[string]types.AttributeValue) types.WriteRequest {
+	return types.WriteRequest{
+		DeleteRequest: &types.DeleteRequest{
+			Key: map[string]types.AttributeValue{
+				"pk": item["pk"],
+				"sk": item["sk"],
+			},
+		},
+	}
+}
+
+// backoff waits before a retry, doubling from 50ms up to 5s with jitter. The
+// first attempt does not wait.
+func backoff(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+
+	delay := min(50*time.Millisecond<<(attempt-1), 5*time.Second)
+	delay = delay/2 + rand.N(delay/2+1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// Error kinds. Every error a Store returns on purpose wraps one of these so
+// the API can map it to a status code with errors.Is; anything else is an
+// internal error.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrValidation = errors.New("validation failed")
+	ErrConflict   = errors.New("conflict")
+	ErrThrottled  = errors.New("request throttled")
+
+	// ErrPrecondition is a conditional request, such as If-Match, that did
+	// not hold
+	ErrPrecondition = errors.New("precondition failed")
+)
+
+var (
+	ErrUserNotFound    = newError(ErrNotFound, "user not found")
+	ErrOrderNotFound   = newError(ErrNotFound, "order not found")
+	ErrItemNotFound    = newError(ErrNotFound, "order item not found")
+	ErrProductNotFound = newError(ErrNotFound, "product not found")
+	ErrAddressNotFound = newError(ErrNotFound, "address not found")
+
+	ErrUnknownStatus    = newError(ErrValidation, "unknown order status")
+	ErrInvalidCursor    = newError(ErrValidation, "invalid cursor")
+	ErrCurrencyMismatch = newError(ErrValidation, "product currency does not match order currency")
+
+	ErrUserExists        = newError(ErrConflict, "user already exists")
+	ErrInvalidTransition = newError(ErrConflict, "invalid order status transition")
+	ErrProductExists     = newError(ErrConflict, "product already exists")
+	ErrInsufficientStock = newError(ErrConflict, "insufficient stock")
+	ErrOrderLocked       = newError(ErrConflict, "order can no longer be changed")
+	ErrOrderFull         = newError(ErrConflict, "order has too many items")
+	ErrItemModified      = newError(ErrConflict, "order item was modified concurrently")
+	ErrOrderModified     = newError(ErrConflict, "order was modified concurrently")
+	ErrUserModified      = newError(ErrConflict, "user kept changing during the update")
+	ErrAddressInUse      = newError(ErrConflict, "address is used by an open order")
+	ErrUserHasOpenOrders = newError(ErrConflict, "user has open orders")
+
+	ErrVersionMismatch = newError(ErrPrecondition, "version does not match")
+)
+
+// errIfMatchRequired is returned for a PUT without an If-Match header
+var errIfMatchRequired = newError(ErrPrecondition, "If-Match header with the resource's ETag is required")
+
+// kindError is an error with its own message that still matches its kind.
+// cause keeps the DynamoDB error behind a translated error out of the message
+// clients see while leaving it available to errors.As and the logs.
+type kindError struct {
+	kind  error
+	msg   string
+	cause error
+}
+
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.cause}
+}
+
+// errInvalidJSON is returned for request bodies that do not decode
+var errInvalidJSON = newError(ErrValidation, "invalid JSON")
+
+// validationError reports a problem with a request
+func validationError(format string, args ...any) error {
+	return newError(ErrValidation, fmt.Sprintf(format, args...))
+}
+
+// InsufficientStockError reports the product that could not cover the
+// quantity of an order item
+type InsufficientStockError struct {
+	SKU       string
+	Requested int
+	Available int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for %s: requested %d, available %d", e.SKU, e.Requested, e.Available)
+}
+
+func (e *InsufficientStockError) Unwrap() error {
+	return ErrInsufficientStock
+}
+
+// translateError classifies DynamoDB errors the caller can do something
+// about. The original error stays wrapped so it can still be inspected and
+// logged.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var tce *types.TransactionCanceledException
+	if errors.As(err, &tce) {
+		for _, reason := range tce.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ThrottlingError", "ProvisionedThroughputExceeded", "RequestLimitExceeded":
+				return throttled(err)
+			case "TransactionConflict":
+				return transactionConflict(err)
+			}
+		}
+		return err
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+			return throttled(err)
+		case "TransactionConflictException", "TransactionInProgressException":
+			return transactionConflict(err)
+		}
+	}
+	return err
+}
+
+func throttled(cause error) error {
+	return &kindError{kind: ErrThrottled, msg: "request rate too high, retry later", cause: cause}
+}
+
+func transactionConflict(cause error) error {
+	return &kindError{kind: ErrConflict, msg: "item is being changed by another request, retry", cause: cause}
+}
@@ -34,7 +34,30 @@ echo "2. Getting user profile..."
 curl $BASE_URL/users/john
 echo -e "\n"
 
-echo "3. Creating an order..."
+echo "3. Creating products..."
+curl -X POST $BASE_URL/products \
+  -H "Content-Type: application/json" \
+  -d '{
+    "sku": "LAPTOP-01",
+    "name": "Laptop",
+    "description": "Gaming laptop",
+    "unit_price": 1299.99,
+    "stock": 10
+  }'
+echo -e "\n"
+
+curl -X POST $BASE_URL/products \
+  -H "Content-Type: application/json" \
+  -d '{
+    "sku": "MOUSE-01",
+    "name": "Mouse",
+    "description": "Wireless mouse",
+    "unit_price": 29.99,
+    "stock": 50
+  }'
+echo -e "\n"
+
+echo "4. Creating an order..."
 ORDER_RESPONSE=$(curl -s -X POST $BASE_URL/orders \
   -H "Content-Type: application/json" \
   -d '{
@@ -48,55 +71,54 @@ ORDER_ID=$(echo $ORDER_RESPONSE | grep -o '"id":"[^"]*"' | cut -d'"' -f4)
 echo "Order ID: $ORDER_ID"
 echo
 
-echo "4. Adding items to the order..."
+echo "5. Adding items to the order..."
 curl -X POST $BASE_URL/orders/$ORDER_ID/items \
   -H "Content-Type: application/json" \
-  -d '{
-    "name": "Laptop",
-    "description": "Gaming laptop",
-    "price": 1299.99,
-    "quantity": 1
-  }'
+  -d '{"sku": "LAPTOP-01", "quantity": 1}'
 echo -e "\n"
 
 curl -X POST $BASE_URL/orders/$ORDER_ID/items \
   -H "Content-Type: application/json" \
-  -d '{
-    "name": "Mouse",
-    "description": "Wireless mouse",
-    "price": 29.99,
-    "quantity": 2
-  }'
+  -d '{"sku": "MOUSE-01", "quantity": 2}'
 echo -e "\n"
 
-echo "5. Getting order details..."
+echo "6. Getting order details..."
 curl $BASE_URL/orders/$ORDER_ID
 echo -e "\n"
 
-echo "6. Getting order items..."
+echo "7. Getting order items..."
 curl $BASE_URL/orders/$ORDER_ID/items
 echo -e "\n"
 
-echo "7. Getting user's orders..."
+echo "8. Getting user's orders..."
 curl $BASE_URL/users/john/orders
 echo -e "\n"
 
-echo "8. Updating order status..."
+echo "9. Updating order status..."
+# Status updates need the order's current ETag, which changes on every write
+ORDER_ETAG=$(curl -s -o /dev/null -D - $BASE_URL/orders/$ORDER_ID | grep -i '^etag:' | cut -d' ' -f2 | tr -d '\r')
+echo "Order ETag: $ORDER_ETAG"
 curl -X PUT $BASE_URL/orders/$ORDER_ID/status \
   -H "Content-Type: application/json" \
+  -H "If-Match: $ORDER_ETAG" \
   -d '{"status": "confirmed"}'
 echo -e "\n"
 
-echo "9. Getting all pending orders..."
+echo "10. Getting all pending orders..."
 curl $BASE_URL/orders/pending
 echo -e "\n"
 
+echo "11. Getting confirmed orders by date range..."
+curl "$BASE_URL/users/john/orders?status=confirmed&from=$(date +%Y-%m-01)"
+echo -e "\n"
+
 echo "=== DynamoDB Data Model Explanation ==="
 echo
 echo "This demonstrates DynamoDB single-table design:"
 echo "- Users stored as: pk='#USER#john', sk='PROFILE'"
 echo "- Orders stored as: pk='#USER#john', sk='#ORDER#<uuid>'"
 echo "- Items stored as: pk='#ORDER#<uuid>', sk='#ITEM#<uuid>'"
+echo "- Products stored as: pk='#PRODUCT#<sku>', sk='PRODUCT'"
 echo
 echo "Access patterns supported:"
 echo "- Get user by username (main table)"
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Exports hold one item per line in DynamoDB JSON, the format of the
+// DynamoDB export to S3 and the AWS CLI:
+//
+//	{"Item":{"pk":{"S":"#USER#john"},"sk":{"S":"PROFILE"},"version":{"N":"1"}}}
+
+// maxExportLine bounds a line of an import, DynamoDB items are at most 400KB
+// but their JSON is larger
+const maxExportLine = 4 << 20
+
+type exportLine struct {
+	Item map[string]json.RawMessage `json:"Item"`
+}
+
+// ExportTable writes every row of the table to w. The table is scanned in
+// parallel by the given number of workers, so rows are in no particular
+// order. exported is called with the number of rows in each page written.
+func (r *Repository) ExportTable(ctx context.Context, w io.Writer, workers int, exported func(n int)) error {
+	out := bufio.NewWriter(w)
+	var mu sync.Mutex
+
+	err := r.parallelScan(ctx, workers, dynamodb.ScanInput{}, func(items []map[string]types.AttributeValue) error {
+		var lines []byte
+		for _, item := range items {
+			line, err := marshalItem(item)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, line...)
+			lines = append(lines, '\n')
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := out.Write(lines); err != nil {
+			return err
+		}
+		if exported != nil {
+			exported(len(items))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// ImportTable writes every row read from an export with PutItem semantics,
+// replacing rows with the same keys. Batches are written by the given number
+// of workers and imported is called with the size of each batch written.
+func (r *Repository) ImportTable(ctx context.Context, rd io.Reader, workers int, imported func(n int)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan []types.WriteRequest)
+	errs := make(chan error, max(workers, 1))
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := r.batchWrite(ctx, batch); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				if imported != nil {
+					imported(len(batch))
+				}
+			}
+		}()
+	}
+
+	readErr := readExport(ctx, rd, batches)
+	close(batches)
+	wg.Wait()
+	close(errs)
+
+	// A write error cancels the read, so report the cause rather than the
+	// cancellation
+	if err := <-errs; err != nil {
+		return err
+	}
+	return readErr
+}
+
+// readExport sends the rows of an export to batches as put requests of up to
+// 25 rows
+func readExport(ctx context.Context, rd io.Reader, batches chan<- []types.WriteRequest) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(nil, maxExportLine)
+
+	send := func(batch []types.WriteRequest) error {
+		select {
+		case batches <- batch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var batch []types.WriteRequest
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		item, err := unmarshalItem(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		batch = append(batch, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+		if len(batch) == maxBatchWriteItems {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
+
+// marshalItem encodes a row as a line of an export
+func marshalItem(item map[string]types.AttributeValue) ([]byte, error) {
+	line := exportLine{Item: make(map[string]json.RawMessage, len(item))}
+	for name, av := range item {
+		value, err := marshalAttribute(av)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		line.Item[name] = value
+	}
+	return json.Marshal(line)
+}
+
+// unmarshalItem decodes a line of an export
+func unmarshalItem(data []byte) (map[string]types.AttributeValue, error) {
+	var line exportLine
+	if err := json.Unmarshal(data, &line); err != nil {
+		return nil, err
+	}
+	if len(line.Item) == 0 {
+		return nil, errors.New("no Item")
+	}
+
+	item := make(map[string]types.AttributeValue, len(line.Item))
+	for name, value := range line.Item {
+		av, err := unmarshalAttribute(value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+		item[name] = av
+	}
+	return item, nil
+}
+
+// marshalAttribute encodes an attribute value in DynamoDB JSON, binary values
+// are base64 encoded by encoding/json
+func marshalAttribute(av types.AttributeValue) (json.RawMessage, error) {
+	var value any
+	switch av := av.(type) {
+	case *types.AttributeValueMemberS:
+		value = map[string]string{"S": av.Value}
+	case *types.AttributeValueMemberN:
+		value = map[string]string{"N": av.Value}
+	case *types.AttributeValueMemberB:
+		value = map[string][]byte{"B": av.Value}
+	case *types.AttributeValueMemberBOOL:
+		value = map[string]bool{"BOOL": av.Value}
+	case *types.AttributeValueMemberNULL:
+		value = map[string]bool{"NULL": av.Value}
+	case *types.AttributeValueMemberSS:
+		value = map[string][]string{"SS": av.Value}
+	case *types.AttributeValueMemberNS:
+		value = map[string][]string{"NS": av.Value}
+	case *types.AttributeValueMemberBS:
+		value = map[string][][]byte{"BS": av.Value}
+	case *types.AttributeValueMemberL:
+		list := make([]json.RawMessage, len(av.Value))
+		for i, element := range av.Value {
+			encoded, err := marshalAttribute(element)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = encoded
+		}
+		value = map[string][]json.RawMessage{"L": list}
+	case *types.AttributeValueMemberM:
+		members := make(map[string]json.RawMessage, len(av.Value))
+		for name, member := range av.Value {
+			encoded, err := marshalAttribute(member)
+			if err != nil {
+				return nil, err
+			}
+			members[name] = encoded
+		}
+		value = map[string]map[string]json.RawMessage{"M": members}
+	default:
+		return nil, fmt.Errorf("unsupported attribute type %T", av)
+	}
+	return json.Marshal(value)
+}
+
+// unmarshalAttribute decodes an attribute value from DynamoDB JSON
+func unmarshalAttribute(data json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("want one type in %s", data)
+	}
+
+	var kind string
+	var raw json.RawMessage
+	for kind, raw = range typed {
+	}
+
+	switch kind {
+	case "S":
+		av := &types.AttributeValueMemberS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "N":
+		av := &types.AttributeValueMemberN{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "B":
+		av := &types.AttributeValueMemberB{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "BOOL":
+		av := &types.AttributeValueMemberBOOL{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "NULL":
+		av := &types.AttributeValueMemberNULL{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "SS":
+		av := &types.AttributeValueMemberSS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "NS":
+		av := &types.AttributeValueMemberNS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "BS":
+		av := &types.AttributeValueMemberBS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "L":
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		av := &types.AttributeValueMemberL{Value: make([]types.AttributeValue, len(list))}
+		for i, element := range list {
+			decoded, err := unmarshalAttribute(element)
+			if err != nil {
+				return nil, err
+			}
+			av.Value[i] = decoded
+		}
+		return av, nil
+	case "M":
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &members); err != nil {
+			return nil, err
+		}
+		av := &types.AttributeValueMemberM{Value: make(map[string]types.AttributeValue, len(members))}
+		for name, member := range members {
+			decoded, err := unmarshalAttribute(member)
+			if err != nil {
+				return nil, err
+			}
+			av.Value[name] = decoded
+		}
+		return av, nil
+	default:
+		return nil, fmt.Errorf("unknown attribute type %q", kind)
+	}
+}
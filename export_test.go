@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestMarshalItemRoundTrip(t *testing.T) {
+	item := map[string]types.AttributeValue{
+		"pk":       &types.AttributeValueMemberS{Value: "#USER#john"},
+		"sk":       &types.AttributeValueMemberS{Value: "PROFILE"},
+		"version":  &types.AttributeValueMemberN{Value: "3"},
+		"price":    &types.AttributeValueMemberN{Value: "1299.99"},
+		"avatar":   &types.AttributeValueMemberB{Value: []byte{0, 1, 2, 255}},
+		"active":   &types.AttributeValueMemberBOOL{Value: true},
+		"deleted":  &types.AttributeValueMemberNULL{Value: true},
+		"tags":     &types.AttributeValueMemberSS{Value: []string{"a", "b"}},
+		"scores":   &types.AttributeValueMemberNS{Value: []string{"1", "2.5"}},
+		"blobs":    &types.AttributeValueMemberBS{Value: [][]byte{{1}, {2, 3}}},
+		"empty":    &types.AttributeValueMemberS{Value: ""},
+		"unicode":  &types.AttributeValueMemberS{Value: "Zoë \"quoted\"\n"},
+		"history":  &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: "pending"}, &types.AttributeValueMemberN{Value: "1"}}},
+		"noValues": &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		"addresses": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"home": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+				"street":  &types.AttributeValueMemberS{Value: "1 Main St"},
+				"country": &types.AttributeValueMemberS{Value: "US"},
+			}},
+		}},
+	}
+
+	line, err := marshalItem(item)
+	if err != nil {
+		t.Fatalf("marshalItem: %v", err)
+	}
+	if strings.Contains(string(line), "\n") {
+		t.Errorf("line %s holds a newline", line)
+	}
+
+	decoded, err := unmarshalItem(line)
+	if err != nil {
+		t.Fatalf("unmarshalItem: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, item) {
+		t.Errorf("round trip =\n%#v\nwant\n%#v", decoded, item)
+	}
+}
+
+func TestUnmarshalItemFormat(t *testing.T) {
+	// The format written by the AWS CLI and the DynamoDB export to S3
+	line := `{"Item":{"pk":{"S":"#PRODUCT#A"},"sk":{"S":"PRODUCT"},"stock":{"N":"5"},"image":{"B":"AAEC"}}}`
+	item, err := unmarshalItem([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]types.AttributeValue{
+		"pk":    &types.AttributeValueMemberS{Value: "#PRODUCT#A"},
+		"sk":    &types.AttributeValueMemberS{Value: "PRODUCT"},
+		"stock": &types.AttributeValueMemberN{Value: "5"},
+		"image": &types.AttributeValueMemberB{Value: []byte{0, 1, 2}},
+	}
+	if !reflect.DeepEqual(item, want) {
+		t.Errorf("unmarshalItem = %#v, want %#v", item, want)
+	}
+}
+
+func TestUnmarshalItemInvalid(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{}`,
+		`{"Item":{}}`,
+		`{"Item":{"pk":"#USER#john"}}`,
+		`{"Item":{"pk":{}}}`,
+		`{"Item":{"pk":{"S":"a","N":"1"}}}`,
+		`{"Item":{"pk":{"X":"a"}}}`,
+		`{"Item":{"pk":{"N":1}}}`,
+		`{"Item":{"pk":{"L":[{"Q":"a"}]}}}`,
+	}
+	for _, line := range tests {
+		if item, err := unmarshalItem([]byte(line)); err == nil {
+			t.Errorf("unmarshalItem(%s) = %v, want an error", line, item)
+		}
+	}
+}
+
+func TestReadExport(t *testing.T) {
+	var export strings.Builder
+	for range maxBatchWriteItems + 2 {
+		export.WriteString(`{"Item":{"pk":{"S":"#PRODUCT#A"},"sk":{"S":"PRODUCT"}}}` + "\n")
+	}
+	export.WriteString("\n")
+
+	batches := make(chan []types.WriteRequest, 2)
+	if err := readExport(context.Background(), strings.NewReader(export.String()), batches); err != nil {
+		t.Fatal(err)
+	}
+	close(batches)
+
+	var sizes []int
+	for batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	if want := []int{maxBatchWriteItems, 2}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("batch sizes = %v, want %v", sizes, want)
+	}
+
+	err := readExport(context.Background(), strings.NewReader("{\"Item\":{\"pk\":{\"S\":\"a\"}}}\nbroken\n"), make(chan []types.WriteRequest, 1))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("readExport of a broken line = %v, want an error naming line 2", err)
+	}
+}
+
+func TestRepositoryExportImport(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	newTestOrder(t, repo, 5)
+	for i := range 60 {
+		product := Product{SKU: fmt.Sprintf("SKU-%02d", i), Name: "Thing", UnitPrice: 100, Currency: "USD"}
+		if err := repo.CreateProduct(ctx, product); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+	}
+	rows := len(fake.keys())
+
+	var export bytes.Buffer
+	var exported atomic.Int64
+	if err := repo.ExportTable(ctx, &export, 3, func(n int) { exported.Add(int64(n)) }); err != nil {
+		t.Fatalf("ExportTable: %v", err)
+	}
+	if exported.Load() != int64(rows) {
+		t.Errorf("reported %d exported, want %d", exported.Load(), rows)
+	}
+
+	// Throttled batches are written once DynamoDB takes the rest
+	restored, restoredFake := newFakeRepository(t)
+	restoredFake.throttled = 3
+	var imported atomic.Int64
+	if err := restored.ImportTable(ctx, bytes.NewReader(export.Bytes()), 2, func(n int) { imported.Add(int64(n)) }); err != nil {
+		t.Fatalf("ImportTable: %v", err)
+	}
+	if got, want := restoredFake.keys(), fake.keys(); !slices.Equal(got, want) {
+		t.Errorf("imported rows =\n%v\nwant\n%v", got, want)
+	}
+	if imported.Load() != int64(rows) || restoredFake.throttled != 0 {
+		t.Errorf("reported %d imported with %d throttled batches left, want %d and none", imported.Load(), restoredFake.throttled, rows)
+	}
+	if got, want := restoredFake.item(userPK("john"), profileSK), fake.item(userPK("john"), profileSK); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported profile = %v, want %v", got, want)
+	}
+
+	// A failed batch stops the other workers and the read, and is reported
+	restoredFake.intercept = func(op string) *fakeError {
+		if op == "BatchWriteItem" {
+			return validationException("batch failed")
+		}
+		return nil
+	}
+	err := restored.ImportTable(ctx, bytes.NewReader(export.Bytes()), 2, nil)
+	if err == nil || !strings.Contains(err.Error(), "batch failed") {
+		t.Errorf("ImportTable with failing batches: %v, want the batch error", err)
+	}
+}
+
+func TestExportTableFile(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	newTestOrder(t, repo, 5)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "table.jsonl.gz")
+
+	if err := exportTable(ctx, repo, path, 2, nil); err != nil {
+		t.Fatalf("exportTable: %v", err)
+	}
+	restored, restoredFake := newFakeRepository(t)
+	if err := importTable(ctx, restored, path, 2, nil); err != nil {
+		t.Fatalf("importTable: %v", err)
+	}
+	if got, want := restoredFake.keys(), fake.keys(); !slices.Equal(got, want) {
+		t.Errorf("imported rows =\n%v\nwant\n%v", got, want)
+	}
+
+	// A failed export leaves the earlier one as it was and nothing else
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.intercept = func(op string) *fakeError {
+		if op == "Scan" {
+			return validationException("scan failed")
+		}
+		return nil
+	}
+	if err := exportTable(ctx, repo, path, 2, nil); err == nil {
+		t.Fatal("exportTable succeeded with failing scans")
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("a failed export changed the earlier export: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files after a failed export = %v, want only %s", entries, filepath.Base(path))
+	}
+}
@@ -0,0 +1,2011 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// fakeDynamo serves the DynamoDB operations Repository uses over HTTP, so
+// Repository tests go through the SDK and send the same requests they would
+// send to DynamoDB. Like DynamoDB it evaluates key, filter, condition and
+// update expressions and rejects requests with expression attribute names or
+// values that no expression uses, reserved words used as attribute names, and
+// maps, lists or sets as operands of comparators. GSI queries can be held at
+// an old snapshot with freezeIndexes, the way eventually consistent index
+// reads lag writes.
+type fakeDynamo struct {
+	mu     sync.Mutex
+	table  *fakeTable
+	frozen map[string]map[string]types.AttributeValue
+
+	// pageSize is how many items a Query or Scan without a lower Limit
+	// evaluates before returning LastEvaluatedKey, so paginators are
+	// exercised
+	pageSize int
+
+	// intercept, if set, is called with the operation name before each
+	// request is handled and without the lock held. A non-nil error is
+	// returned to the client instead of handling the request.
+	intercept func(op string) *fakeError
+
+	// throttled is how many more BatchWriteItem calls write only their
+	// first request and return the rest as UnprocessedItems, the way a
+	// throttled table does
+	throttled int
+
+	// busyDescribes is how many more DescribeTable calls report the table
+	// as busyStatus, CREATING or UPDATING, rather than ACTIVE. UpdateTable
+	// is refused until they have been made.
+	busyStatus    string
+	busyDescribes int
+
+	// backfillDescribes is how many DescribeTable calls report a GSI added
+	// by UpdateTable as CREATING. No other GSI can be added meanwhile.
+	backfillDescribes int
+}
+
+type fakeTable struct {
+	definition fakeTableDefinition
+	items      map[string]map[string]types.AttributeValue
+
+	// backfilling counts down the DescribeTable calls left before each
+	// GSI added by UpdateTable is ACTIVE
+	backfilling map[string]int
+}
+
+type fakeKeyElement struct {
+	AttributeName string
+	KeyType       string
+}
+
+type fakeAttributeDefinition struct {
+	AttributeName string
+	AttributeType string
+}
+
+type fakeThroughput struct {
+	ReadCapacityUnits  int64
+	WriteCapacityUnits int64
+}
+
+type fakeProjection struct {
+	ProjectionType   string
+	NonKeyAttributes []string `json:",omitempty"`
+}
+
+type fakeIndex struct {
+	IndexName             string
+	KeySchema             []fakeKeyElement
+	Projection            fakeProjection
+	IndexStatus           string          `json:",omitempty"`
+	ProvisionedThroughput *fakeThroughput `json:",omitempty"`
+}
+
+type fakeTag struct {
+	Key   string
+	Value string
+}
+
+// fakeTableDefinition is a CreateTable request, which is also most of what
+// DescribeTable reports
+type fakeTableDefinition struct {
+	TableName              string
+	KeySchema              []fakeKeyElement
+	AttributeDefinitions   []fakeAttributeDefinition
+	GlobalSecondaryIndexes []fakeIndex `json:",omitempty"`
+	LocalSecondaryIndexes  []fakeIndex `json:",omitempty"`
+	BillingMode            string      `json:",omitempty"`
+	ProvisionedThroughput  *fakeThroughput
+	Tags                   []fakeTag `json:",omitempty"`
+}
+
+// fakeRequest holds the members of every item operation
+type fakeRequest struct {
+	TableName                           string
+	Key                                 map[string]json.RawMessage
+	Item                                map[string]json.RawMessage
+	IndexName                           string
+	KeyConditionExpression              string
+	FilterExpression                    string
+	ProjectionExpression                string
+	ConditionExpression                 string
+	UpdateExpression                    string
+	ExpressionAttributeNames            map[string]string
+	ExpressionAttributeValues           map[string]json.RawMessage
+	ExclusiveStartKey                   map[string]json.RawMessage
+	Limit                               int
+	ConsistentRead                      bool
+	ScanIndexForward                    *bool
+	Segment                             int
+	TotalSegments                       int
+	ReturnValues                        string
+	ReturnValuesOnConditionCheckFailure string
+
+	TransactItems []struct {
+		ConditionCheck *fakeRequest
+		Put            *fakeRequest
+		Update         *fakeRequest
+		Delete         *fakeRequest
+	}
+	RequestItems map[string][]struct {
+		PutRequest    *fakeRequest
+		DeleteRequest *fakeRequest
+	}
+}
+
+// Limits DynamoDB puts on a single request
+const (
+	fakeMaxTransactItems   = 100
+	fakeMaxBatchWriteItems = 25
+)
+
+// fakeError is an error response in the format of the DynamoDB API
+type fakeError struct {
+	status  int
+	typ     string
+	message string
+	extra   map[string]any
+}
+
+func (e *fakeError) Error() string {
+	return e.typ + ": " + e.message
+}
+
+func validationException(format string, args ...any) *fakeError {
+	return &fakeError{status: http.StatusBadRequest, typ: "ValidationException", message: fmt.Sprintf(format, args...)}
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{pageSize: 10}
+}
+
+// testEndpoint points the Repository tests that need none of the fake's
+// hooks at a real DynamoDB, such as DynamoDB Local, instead of a fakeDynamo
+var testEndpoint = flag.String("endpoint", os.Getenv("DYNAMODB_ENDPOINT"), "DynamoDB endpoint URL to run the Repository tests against, e.g. http://localhost:8000 for DynamoDB Local")
+
+// newTestRepository returns a Repository whose table has been created with
+// the default table config, in the DynamoDB at -endpoint under a name of its
+// own if one is given and in a fakeDynamo otherwise
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+	if *testEndpoint == "" {
+		repo, _ := newFakeRepository(t)
+		return repo
+	}
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(*testEndpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider("local", "local", ""),
+	})
+	repo := NewRepository(client, "simple-inventory-test-"+uuid.NewString())
+	if err := repo.CreateTable(context.Background(), DefaultTableConfig()); err != nil {
+		t.Fatalf("creating table: %v", err)
+	}
+	t.Cleanup(func() {
+		var notFound *types.ResourceNotFoundException
+		if err := repo.DeleteTable(context.Background()); err != nil && !errors.As(err, &notFound) {
+			t.Errorf("deleting table %s: %v", repo.tableName, err)
+		}
+	})
+	return repo
+}
+
+// newFakeRepository returns a Repository whose table has been created in a
+// fakeDynamo with the default table config, for tests that use its hooks
+func newFakeRepository(t *testing.T) (*Repository, *fakeDynamo) {
+	t.Helper()
+
+	fake := newFakeDynamo()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(server.URL),
+		Credentials:      credentials.NewStaticCredentialsProvider("test", "test", ""),
+		RetryMaxAttempts: 1,
+	})
+	repo := NewRepository(client, "simple-inventory")
+	if err := repo.CreateTable(context.Background(), DefaultTableConfig()); err != nil {
+		t.Fatalf("creating table: %v", err)
+	}
+	return repo, fake
+}
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.writeError(w, validationException("reading request: %v", err))
+		return
+	}
+
+	if f.intercept != nil {
+		if ferr := f.intercept(op); ferr != nil {
+			f.writeError(w, ferr)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	response, ferr := f.handle(op, body)
+	f.mu.Unlock()
+	if ferr != nil {
+		f.writeError(w, ferr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (f *fakeDynamo) writeError(w http.ResponseWriter, e *fakeError) {
+	body := map[string]any{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + e.typ,
+		"message": e.message,
+	}
+	for name, value := range e.extra {
+		body[name] = value
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeDynamo) handle(op string, body []byte) (any, *fakeError) {
+	switch op {
+	case "CreateTable":
+		return f.createTable(body)
+	case "DescribeTable":
+		return f.describeTable()
+	case "UpdateTable":
+		return f.updateTable(body)
+	case "DeleteTable":
+		if f.table == nil {
+			return nil, f.tableNotFound()
+		}
+		f.table = nil
+		return map[string]any{}, nil
+	}
+
+	var req fakeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validationException("decoding %s request: %v", op, err)
+	}
+	if f.table == nil {
+		return nil, f.tableNotFound()
+	}
+
+	switch op {
+	case "GetItem":
+		return f.getItem(&req)
+	case "PutItem", "UpdateItem", "DeleteItem":
+		return f.writeItem(op, &req)
+	case "Query", "Scan":
+		return f.read(op, &req)
+	case "TransactWriteItems":
+		return f.transactWrite(&req)
+	case "BatchWriteItem":
+		return f.batchWrite(&req)
+	}
+	return nil, &fakeError{status: http.StatusBadRequest, typ: "UnknownOperationException", message: op}
+}
+
+func (f *fakeDynamo) tableNotFound() *fakeError {
+	return &fakeError{status: http.StatusBadRequest, typ: "ResourceNotFoundException", message: "Requested resource not found"}
+}
+
+// Table operations
+
+func (f *fakeDynamo) createTable(body []byte) (any, *fakeError) {
+	if f.table != nil {
+		return nil, &fakeError{status: http.StatusBadRequest, typ: "ResourceInUseException", message: "Table already exists"}
+	}
+
+	var definition fakeTableDefinition
+	if err := json.Unmarshal(body, &definition); err != nil {
+		return nil, validationException("decoding CreateTable request: %v", err)
+	}
+	f.table = &fakeTable{definition: definition, items: make(map[string]map[string]types.AttributeValue)}
+	return map[string]any{"TableDescription": f.tableDescription()}, nil
+}
+
+func (f *fakeDynamo) describeTable() (any, *fakeError) {
+	if f.table == nil {
+		return nil, f.tableNotFound()
+	}
+	description := f.tableDescription()
+	if f.busyDescribes > 0 {
+		f.busyDescribes--
+	}
+	for name, left := range f.table.backfilling {
+		if left > 0 {
+			f.table.backfilling[name]--
+		}
+	}
+	return map[string]any{"Table": description}, nil
+}
+
+func (f *fakeDynamo) tableDescription() map[string]any {
+	definition := f.table.definition
+	gsis := slices.Clone(definition.GlobalSecondaryIndexes)
+	for i := range gsis {
+		gsis[i].IndexStatus = "ACTIVE"
+		if f.table.backfilling[gsis[i].IndexName] > 0 {
+			gsis[i].IndexStatus = "CREATING"
+		}
+	}
+
+	status := "ACTIVE"
+	if f.busyDescribes > 0 {
+		status = f.busyStatus
+	}
+	billing := definition.BillingMode
+	if billing == "" {
+		billing = "PROVISIONED"
+	}
+	description := map[string]any{
+		"TableName":            definition.TableName,
+		"TableStatus":          status,
+		"KeySchema":            definition.KeySchema,
+		"AttributeDefinitions": definition.AttributeDefinitions,
+		"BillingModeSummary":   map[string]string{"BillingMode": billing},
+		"ItemCount":            len(f.table.items),
+	}
+	if len(gsis) > 0 {
+		description["GlobalSecondaryIndexes"] = gsis
+	}
+	if len(definition.LocalSecondaryIndexes) > 0 {
+		description["LocalSecondaryIndexes"] = definition.LocalSecondaryIndexes
+	}
+	return description
+}
+
+func (f *fakeDynamo) updateTable(body []byte) (any, *fakeError) {
+	if f.table == nil {
+		return nil, f.tableNotFound()
+	}
+
+	var req struct {
+		AttributeDefinitions        []fakeAttributeDefinition
+		GlobalSecondaryIndexUpdates []struct{ Create *fakeIndex }
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, validationException("decoding UpdateTable request: %v", err)
+	}
+
+	if f.busyDescribes > 0 {
+		return nil, &fakeError{status: http.StatusBadRequest, typ: "ResourceInUseException", message: "Table is " + f.busyStatus}
+	}
+	for name, left := range f.table.backfilling {
+		if left > 0 {
+			return nil, &fakeError{status: http.StatusBadRequest, typ: "LimitExceededException", message: "Index " + name + " is still being created"}
+		}
+	}
+
+	definition := &f.table.definition
+	for _, attribute := range req.AttributeDefinitions {
+		if !slices.ContainsFunc(definition.AttributeDefinitions, func(a fakeAttributeDefinition) bool { return a.AttributeName == attribute.AttributeName }) {
+			definition.AttributeDefinitions = append(definition.AttributeDefinitions, attribute)
+		}
+	}
+	if len(req.GlobalSecondaryIndexUpdates) > 1 {
+		return nil, validationException("Subscriber limit exceeded: Only 1 online index can be created or deleted simultaneously per table")
+	}
+	for _, update := range req.GlobalSecondaryIndexUpdates {
+		if update.Create != nil {
+			definition.GlobalSecondaryIndexes = append(definition.GlobalSecondaryIndexes, *update.Create)
+			if f.table.backfilling == nil {
+				f.table.backfilling = make(map[string]int)
+			}
+			f.table.backfilling[update.Create.IndexName] = f.backfillDescribes
+		}
+	}
+	return map[string]any{"TableDescription": f.tableDescription()}, nil
+}
+
+// Item operations
+
+// keyNames returns the hash and range key attributes of the table
+func (t *fakeTable) keyNames() []string {
+	var names []string
+	for _, element := range t.definition.KeySchema {
+		names = append(names, element.AttributeName)
+	}
+	return names
+}
+
+// itemKey identifies an item by its primary key
+func (t *fakeTable) itemKey(item map[string]types.AttributeValue) (string, *fakeError) {
+	var parts []string
+	for _, name := range t.keyNames() {
+		value, ok := item[name].(*types.AttributeValueMemberS)
+		if !ok {
+			return "", validationException("The provided key element does not match the schema")
+		}
+		parts = append(parts, value.Value)
+	}
+	return strings.Join(parts, "\x00"), nil
+}
+
+func (f *fakeDynamo) getItem(req *fakeRequest) (any, *fakeError) {
+	key, ferr := decodeFakeItem(req.Key)
+	if ferr != nil {
+		return nil, ferr
+	}
+	ctx, ferr := newExpressionContext(req)
+	if ferr != nil {
+		return nil, ferr
+	}
+	projection, ferr := ctx.parseProjection(req.ProjectionExpression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	if ferr := ctx.checkUnused(); ferr != nil {
+		return nil, ferr
+	}
+
+	id, ferr := f.table.itemKey(key)
+	if ferr != nil {
+		return nil, ferr
+	}
+	item, ok := f.table.items[id]
+	if !ok {
+		return map[string]any{}, nil
+	}
+	return map[string]any{"Item": encodeFakeItem(project(item, projection))}, nil
+}
+
+// fakeWrite is a parsed PutItem, UpdateItem, DeleteItem or ConditionCheck
+type fakeWrite struct {
+	id        string
+	old       map[string]types.AttributeValue
+	new       map[string]types.AttributeValue
+	condition func(map[string]types.AttributeValue) bool
+	returnOld bool
+}
+
+// prepareWrite works out what a write would do without applying it
+func (f *fakeDynamo) prepareWrite(op string, req *fakeRequest) (*fakeWrite, *fakeError) {
+	ctx, ferr := newExpressionContext(req)
+	if ferr != nil {
+		return nil, ferr
+	}
+	condition, ferr := ctx.parseCondition(req.ConditionExpression)
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	var key map[string]types.AttributeValue
+	if op == "PutItem" {
+		key, ferr = decodeFakeItem(req.Item)
+	} else {
+		key, ferr = decodeFakeItem(req.Key)
+	}
+	if ferr != nil {
+		return nil, ferr
+	}
+	id, ferr := f.table.itemKey(key)
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	write := &fakeWrite{
+		id:        id,
+		old:       f.table.items[id],
+		condition: condition,
+		returnOld: req.ReturnValuesOnConditionCheckFailure == "ALL_OLD",
+	}
+
+	switch op {
+	case "PutItem":
+		write.new = key
+	case "UpdateItem":
+		update, ferr := ctx.parseUpdate(req.UpdateExpression, f.table.keyNames())
+		if ferr != nil {
+			return nil, ferr
+		}
+		if ferr := ctx.checkUnused(); ferr != nil {
+			return nil, ferr
+		}
+		item := cloneItem(write.old)
+		if item == nil {
+			item = cloneItem(key)
+		}
+		if ferr := update(item); ferr != nil {
+			return nil, ferr
+		}
+		write.new = item
+	case "DeleteItem":
+		write.new = nil
+	case "ConditionCheck":
+		if req.ConditionExpression == "" {
+			return nil, validationException("ConditionCheck requires a ConditionExpression")
+		}
+		write.new = write.old
+	}
+	if ferr := ctx.checkUnused(); ferr != nil {
+		return nil, ferr
+	}
+	return write, nil
+}
+
+func (f *fakeDynamo) writeItem(op string, req *fakeRequest) (any, *fakeError) {
+	write, ferr := f.prepareWrite(op, req)
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	if write.condition != nil && !write.condition(write.old) {
+		e := &fakeError{status: http.StatusBadRequest, typ: "ConditionalCheckFailedException", message: "The conditional request failed"}
+		if write.returnOld && write.old != nil {
+			e.extra = map[string]any{"Item": encodeFakeItem(write.old)}
+		}
+		return nil, e
+	}
+	f.apply(write)
+
+	response := map[string]any{}
+	switch req.ReturnValues {
+	case "ALL_NEW", "UPDATED_NEW":
+		response["Attributes"] = encodeFakeItem(write.new)
+	case "ALL_OLD", "UPDATED_OLD":
+		if write.old != nil {
+			response["Attributes"] = encodeFakeItem(write.old)
+		}
+	}
+	return response, nil
+}
+
+func (f *fakeDynamo) apply(write *fakeWrite) {
+	if write.new == nil {
+		delete(f.table.items, write.id)
+		return
+	}
+	f.table.items[write.id] = write.new
+}
+
+func (f *fakeDynamo) transactWrite(req *fakeRequest) (any, *fakeError) {
+	if len(req.TransactItems) > fakeMaxTransactItems {
+		return nil, validationException("1 validation error detected: Value at 'transactItems' failed to satisfy constraint: Member must have length less than or equal to %d", fakeMaxTransactItems)
+	}
+
+	var writes []*fakeWrite
+	seen := make(map[string]bool)
+	for _, action := range req.TransactItems {
+		var write *fakeWrite
+		var ferr *fakeError
+		switch {
+		case action.ConditionCheck != nil:
+			write, ferr = f.prepareWrite("ConditionCheck", action.ConditionCheck)
+		case action.Put != nil:
+			write, ferr = f.prepareWrite("PutItem", action.Put)
+		case action.Update != nil:
+			write, ferr = f.prepareWrite("UpdateItem", action.Update)
+		case action.Delete != nil:
+			write, ferr = f.prepareWrite("DeleteItem", action.Delete)
+		default:
+			ferr = validationException("TransactItems member has no action")
+		}
+		if ferr != nil {
+			return nil, ferr
+		}
+		if seen[write.id] {
+			return nil, validationException("Transaction request cannot include multiple operations on one item")
+		}
+		seen[write.id] = true
+		writes = append(writes, write)
+	}
+
+	reasons := make([]map[string]any, len(writes))
+	var codes []string
+	cancelled := false
+	for i, write := range writes {
+		reasons[i] = map[string]any{"Code": "None"}
+		if write.condition != nil && !write.condition(write.old) {
+			cancelled = true
+			reasons[i] = map[string]any{"Code": "ConditionalCheckFailed", "Message": "The conditional request failed"}
+			if write.returnOld && write.old != nil {
+				reasons[i]["Item"] = encodeFakeItem(write.old)
+			}
+		}
+		codes = append(codes, reasons[i]["Code"].(string))
+	}
+	if cancelled {
+		return nil, &fakeError{
+			status:  http.StatusBadRequest,
+			typ:     "TransactionCanceledException",
+			message: "Transaction cancelled, please refer cancellation reasons for specific reasons [" + strings.Join(codes, ", ") + "]",
+			extra:   map[string]any{"CancellationReasons": reasons},
+		}
+	}
+
+	for _, write := range writes {
+		f.apply(write)
+	}
+	return map[string]any{}, nil
+}
+
+func (f *fakeDynamo) batchWrite(req *fakeRequest) (any, *fakeError) {
+	throttled := f.throttled > 0
+	if throttled {
+		f.throttled--
+	}
+
+	var writes []*fakeWrite
+	unprocessed := make(map[string][]map[string]any)
+	seen := make(map[string]bool)
+	for table, requests := range req.RequestItems {
+		if table != f.table.definition.TableName {
+			return nil, f.tableNotFound()
+		}
+		if len(requests) > fakeMaxBatchWriteItems {
+			return nil, validationException("Too many items requested for the BatchWriteItem call")
+		}
+		for i, request := range requests {
+			var write *fakeWrite
+			var ferr *fakeError
+			switch {
+			case request.PutRequest != nil:
+				write, ferr = f.prepareWrite("PutItem", request.PutRequest)
+			case request.DeleteRequest != nil:
+				write, ferr = f.prepareWrite("DeleteItem", request.DeleteRequest)
+			default:
+				ferr = validationException("WriteRequest has no request")
+			}
+			if ferr != nil {
+				return nil, ferr
+			}
+			if seen[write.id] {
+				return nil, validationException("Provided list of item keys contains duplicates")
+			}
+			seen[write.id] = true
+			if throttled && i > 0 {
+				unprocessed[table] = append(unprocessed[table], unprocessedRequest(request.PutRequest, request.DeleteRequest))
+				continue
+			}
+			writes = append(writes, write)
+		}
+	}
+
+	for _, write := range writes {
+		f.apply(write)
+	}
+	return map[string]any{"UnprocessedItems": unprocessed}, nil
+}
+
+// unprocessedRequest returns a write request as it appears in UnprocessedItems
+func unprocessedRequest(put, del *fakeRequest) map[string]any {
+	if put != nil {
+		return map[string]any{"PutRequest": map[string]any{"Item": put.Item}}
+	}
+	return map[string]any{"DeleteRequest": map[string]any{"Key": del.Key}}
+}
+
+// read runs a Query or a Scan
+func (f *fakeDynamo) read(op string, req *fakeRequest) (any, *fakeError) {
+	ctx, ferr := newExpressionContext(req)
+	if ferr != nil {
+		return nil, ferr
+	}
+	var keyCondition func(map[string]types.AttributeValue) bool
+	if op == "Query" {
+		if req.KeyConditionExpression == "" {
+			return nil, validationException("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request")
+		}
+		if keyCondition, ferr = ctx.parseCondition(req.KeyConditionExpression); ferr != nil {
+			return nil, ferr
+		}
+	}
+	filter, ferr := ctx.parseCondition(req.FilterExpression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	projection, ferr := ctx.parseProjection(req.ProjectionExpression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	if ferr := ctx.checkUnused(); ferr != nil {
+		return nil, ferr
+	}
+
+	// The index key comes first in the order of an index, the table key
+	// breaks ties
+	order := f.table.keyNames()
+	items := f.table.items
+	if req.IndexName != "" {
+		index, global := f.index(req.IndexName)
+		if index == nil {
+			return nil, validationException("The table does not have the specified index: %s", req.IndexName)
+		}
+		if global && req.ConsistentRead {
+			return nil, validationException("Consistent reads are not supported on global secondary indexes")
+		}
+		if global && f.frozen != nil {
+			items = f.frozen
+		}
+		var indexKey []string
+		for _, element := range index.KeySchema {
+			indexKey = append(indexKey, element.AttributeName)
+		}
+		order = append(indexKey, order...)
+	}
+
+	var rows []map[string]types.AttributeValue
+	for _, item := range items {
+		// Indexes are sparse, items without the index key are left out
+		if !hasAttributes(item, order) {
+			continue
+		}
+		if keyCondition != nil && !keyCondition(item) {
+			continue
+		}
+		if op == "Scan" && req.TotalSegments > 0 && fakeSegment(item, f.table.keyNames(), req.TotalSegments) != req.Segment {
+			continue
+		}
+		rows = append(rows, item)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		for _, name := range order {
+			if c, _ := compareValues(rows[i][name], rows[j][name]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	if req.ScanIndexForward != nil && !*req.ScanIndexForward {
+		slices.Reverse(rows)
+	}
+
+	if len(req.ExclusiveStartKey) > 0 {
+		start, ferr := decodeFakeItem(req.ExclusiveStartKey)
+		if ferr != nil {
+			return nil, ferr
+		}
+		startID, ferr := f.table.itemKey(start)
+		if ferr != nil {
+			return nil, ferr
+		}
+		for i, row := range rows {
+			if id, _ := f.table.itemKey(row); id == startID {
+				rows = rows[i+1:]
+				break
+			}
+		}
+	}
+
+	limit := f.pageSize
+	if req.Limit > 0 && (limit == 0 || req.Limit < limit) {
+		limit = req.Limit
+	}
+	response := map[string]any{}
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+		lastKey := make(map[string]types.AttributeValue)
+		for _, name := range order {
+			lastKey[name] = rows[limit-1][name]
+		}
+		response["LastEvaluatedKey"] = encodeFakeItem(lastKey)
+	}
+
+	encoded := []map[string]json.RawMessage{}
+	for _, row := range rows {
+		if filter != nil && !filter(row) {
+			continue
+		}
+		encoded = append(encoded, encodeFakeItem(project(row, projection)))
+	}
+	response["Items"] = encoded
+	response["Count"] = len(encoded)
+	response["ScannedCount"] = len(rows)
+	return response, nil
+}
+
+// index finds an index of the table, reporting whether it is a GSI
+func (f *fakeDynamo) index(name string) (*fakeIndex, bool) {
+	for i, gsi := range f.table.definition.GlobalSecondaryIndexes {
+		if gsi.IndexName == name {
+			return &f.table.definition.GlobalSecondaryIndexes[i], true
+		}
+	}
+	for i, lsi := range f.table.definition.LocalSecondaryIndexes {
+		if lsi.IndexName == name {
+			return &f.table.definition.LocalSecondaryIndexes[i], false
+		}
+	}
+	return nil, false
+}
+
+func fakeSegment(item map[string]types.AttributeValue, keyNames []string, segments int) int {
+	h := fnv.New32a()
+	if pk, ok := item[keyNames[0]].(*types.AttributeValueMemberS); ok {
+		h.Write([]byte(pk.Value))
+	}
+	return int(h.Sum32() % uint32(segments))
+}
+
+func hasAttributes(item map[string]types.AttributeValue, names []string) bool {
+	for _, name := range names {
+		if _, ok := item[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func project(item map[string]types.AttributeValue, names []string) map[string]types.AttributeValue {
+	if names == nil {
+		return item
+	}
+	projected := make(map[string]types.AttributeValue)
+	for _, name := range names {
+		if value, ok := item[name]; ok {
+			projected[name] = value
+		}
+	}
+	return projected
+}
+
+// Test helpers
+
+// freezeIndexes makes GSI queries see the table as it is now until
+// thawIndexes is called
+func (f *fakeDynamo) freezeIndexes() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frozen = make(map[string]map[string]types.AttributeValue, len(f.table.items))
+	for id, item := range f.table.items {
+		f.frozen[id] = cloneItem(item)
+	}
+}
+
+func (f *fakeDynamo) thawIndexes() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.frozen = nil
+}
+
+// item returns a copy of the item with the given pk and sk, or nil
+func (f *fakeDynamo) item(pk, sk string) map[string]types.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return cloneItem(f.table.items[pk+"\x00"+sk])
+}
+
+// putItem writes an item directly, bypassing conditions
+func (f *fakeDynamo) putItem(item map[string]types.AttributeValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, ferr := f.table.itemKey(item)
+	if ferr != nil {
+		panic(ferr)
+	}
+	f.table.items[id] = cloneItem(item)
+}
+
+// keys returns the "pk sk" of every item, sorted
+func (f *fakeDynamo) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for id := range f.table.items {
+		keys = append(keys, strings.ReplaceAll(id, "\x00", " "))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Attribute values
+
+// The fake has its own DynamoDB JSON encoding rather than sharing the one
+// -export uses, so a bug there cannot hide behind the fake
+
+func decodeFakeItem(raw map[string]json.RawMessage) (map[string]types.AttributeValue, *fakeError) {
+	if raw == nil {
+		return nil, nil
+	}
+	item := make(map[string]types.AttributeValue, len(raw))
+	for name, value := range raw {
+		av, err := decodeFakeAttribute(value)
+		if err != nil {
+			return nil, validationException("attribute %s: %v", name, err)
+		}
+		item[name] = av
+	}
+	return item, nil
+}
+
+func encodeFakeItem(item map[string]types.AttributeValue) map[string]json.RawMessage {
+	encoded := make(map[string]json.RawMessage, len(item))
+	for name, av := range item {
+		value, err := json.Marshal(encodeFakeAttribute(av))
+		if err != nil {
+			panic(err)
+		}
+		encoded[name] = value
+	}
+	return encoded
+}
+
+func encodeFakeAttribute(av types.AttributeValue) any {
+	switch av := av.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]string{"S": av.Value}
+	case *types.AttributeValueMemberN:
+		return map[string]string{"N": av.Value}
+	case *types.AttributeValueMemberB:
+		return map[string][]byte{"B": av.Value}
+	case *types.AttributeValueMemberBOOL:
+		return map[string]bool{"BOOL": av.Value}
+	case *types.AttributeValueMemberNULL:
+		return map[string]bool{"NULL": av.Value}
+	case *types.AttributeValueMemberSS:
+		return map[string][]string{"SS": av.Value}
+	case *types.AttributeValueMemberNS:
+		return map[string][]string{"NS": av.Value}
+	case *types.AttributeValueMemberBS:
+		return map[string][][]byte{"BS": av.Value}
+	case *types.AttributeValueMemberL:
+		list := make([]any, len(av.Value))
+		for i, element := range av.Value {
+			list[i] = encodeFakeAttribute(element)
+		}
+		return map[string][]any{"L": list}
+	case *types.AttributeValueMemberM:
+		members := make(map[string]any, len(av.Value))
+		for name, member := range av.Value {
+			members[name] = encodeFakeAttribute(member)
+		}
+		return map[string]map[string]any{"M": members}
+	}
+	panic(fmt.Sprintf("unsupported attribute type %T", av))
+}
+
+func decodeFakeAttribute(data json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("want one type in %s", data)
+	}
+
+	var kind string
+	var raw json.RawMessage
+	for kind, raw = range typed {
+	}
+
+	switch kind {
+	case "S":
+		av := &types.AttributeValueMemberS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "N":
+		av := &types.AttributeValueMemberN{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "B":
+		av := &types.AttributeValueMemberB{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "BOOL":
+		av := &types.AttributeValueMemberBOOL{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "NULL":
+		av := &types.AttributeValueMemberNULL{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "SS":
+		av := &types.AttributeValueMemberSS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "NS":
+		av := &types.AttributeValueMemberNS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "BS":
+		av := &types.AttributeValueMemberBS{}
+		return av, json.Unmarshal(raw, &av.Value)
+	case "L":
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		av := &types.AttributeValueMemberL{Value: make([]types.AttributeValue, len(list))}
+		for i, element := range list {
+			decoded, err := decodeFakeAttribute(element)
+			if err != nil {
+				return nil, err
+			}
+			av.Value[i] = decoded
+		}
+		return av, nil
+	case "M":
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &members); err != nil {
+			return nil, err
+		}
+		av := &types.AttributeValueMemberM{Value: make(map[string]types.AttributeValue, len(members))}
+		for name, member := range members {
+			decoded, err := decodeFakeAttribute(member)
+			if err != nil {
+				return nil, err
+			}
+			av.Value[name] = decoded
+		}
+		return av, nil
+	}
+	return nil, fmt.Errorf("unknown attribute type %q", kind)
+}
+
+func cloneItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	cloned := make(map[string]types.AttributeValue, len(item))
+	for name, value := range item {
+		cloned[name] = cloneValue(value)
+	}
+	return cloned
+}
+
+func cloneValue(av types.AttributeValue) types.AttributeValue {
+	switch av := av.(type) {
+	case *types.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: cloneItem(av.Value)}
+	case *types.AttributeValueMemberL:
+		list := make([]types.AttributeValue, len(av.Value))
+		for i, element := range av.Value {
+			list[i] = cloneValue(element)
+		}
+		return &types.AttributeValueMemberL{Value: list}
+	case *types.AttributeValueMemberSS:
+		return &types.AttributeValueMemberSS{Value: slices.Clone(av.Value)}
+	case *types.AttributeValueMemberNS:
+		return &types.AttributeValueMemberNS{Value: slices.Clone(av.Value)}
+	}
+	return av
+}
+
+func parseNumber(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(s)
+}
+
+// formatNumber writes a number the way DynamoDB returns it, without
+// trailing zeros
+func formatNumber(n *big.Rat) string {
+	if n.IsInt() {
+		return n.Num().String()
+	}
+	s := strings.TrimRight(n.FloatString(38), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// compareValues orders two strings or two numbers, reporting false for
+// values that cannot be compared
+func compareValues(a, b types.AttributeValue) (int, bool) {
+	switch a := a.(type) {
+	case *types.AttributeValueMemberS:
+		if b, ok := b.(*types.AttributeValueMemberS); ok {
+			return strings.Compare(a.Value, b.Value), true
+		}
+	case *types.AttributeValueMemberN:
+		if b, ok := b.(*types.AttributeValueMemberN); ok {
+			x, okA := parseNumber(a.Value)
+			y, okB := parseNumber(b.Value)
+			if okA && okB {
+				return x.Cmp(y), true
+			}
+		}
+	case *types.AttributeValueMemberB:
+		if b, ok := b.(*types.AttributeValueMemberB); ok {
+			return bytes.Compare(a.Value, b.Value), true
+		}
+	}
+	return 0, false
+}
+
+// equalValues reports whether two scalar values are equal, reporting false
+// for maps, lists and sets, which DynamoDB does not compare
+func equalValues(a, b types.AttributeValue) (bool, bool) {
+	if !scalarValue(a) || !scalarValue(b) {
+		return false, false
+	}
+	if c, ok := compareValues(a, b); ok {
+		return c == 0, true
+	}
+	switch a := a.(type) {
+	case *types.AttributeValueMemberBOOL:
+		b, ok := b.(*types.AttributeValueMemberBOOL)
+		return ok && a.Value == b.Value, true
+	case *types.AttributeValueMemberNULL:
+		_, ok := b.(*types.AttributeValueMemberNULL)
+		return ok, true
+	}
+	return false, true
+}
+
+func scalarValue(av types.AttributeValue) bool {
+	switch av.(type) {
+	case *types.AttributeValueMemberS, *types.AttributeValueMemberN, *types.AttributeValueMemberB,
+		*types.AttributeValueMemberBOOL, *types.AttributeValueMemberNULL:
+		return true
+	}
+	return false
+}
+
+// Expressions
+
+// expressionContext resolves the placeholders of a request's expressions
+// and tracks which of them were used
+type expressionContext struct {
+	names      map[string]string
+	values     map[string]types.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newExpressionContext(req *fakeRequest) (*expressionContext, *fakeError) {
+	values, ferr := decodeFakeItem(req.ExpressionAttributeValues)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return &expressionContext{
+		names:      req.ExpressionAttributeNames,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}, nil
+}
+
+// checkUnused rejects names and values that no expression referred to, as
+// DynamoDB does
+func (c *expressionContext) checkUnused() *fakeError {
+	var names, values []string
+	for name := range c.names {
+		if !c.usedNames[name] {
+			names = append(names, name)
+		}
+	}
+	for value := range c.values {
+		if !c.usedValues[value] {
+			values = append(values, value)
+		}
+	}
+	slices.Sort(names)
+	slices.Sort(values)
+	if len(names) > 0 {
+		return validationException("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", strings.Join(names, ", "))
+	}
+	if len(values) > 0 {
+		return validationException("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", strings.Join(values, ", "))
+	}
+	return nil
+}
+
+// reservedWords are the words DynamoDB refuses as attribute names in
+// expressions, where they must go through an expression attribute name
+var reservedWords = func() map[string]bool {
+	words := map[string]bool{}
+	for _, word := range []string{
+		"ABORT", "ABSOLUTE", "ACTION", "ADD", "AFTER", "AGENT", "AGGREGATE", "ALL",
+		"ALLOCATE", "ALTER", "ANALYZE", "AND", "ANY", "ARCHIVE", "ARE", "ARRAY",
+		"AS", "ASC", "ASCII", "ASENSITIVE", "ASSERTION", "ASYMMETRIC", "AT",
+		"ATOMIC", "ATTACH", "ATTRIBUTE", "AUTH", "AUTHORIZATION", "AUTHORIZE",
+		"AUTO", "AVG", "BACK", "BACKUP", "BASE", "BATCH", "BEFORE", "BEGIN",
+		"BETWEEN", "BIGINT", "BINARY", "BIT", "BLOB", "BLOCK", "BOOLEAN", "BOTH",
+		"BREADTH", "BUCKET", "BULK", "BY", "BYTE", "CALL", "CALLED", "CALLING",
+		"CAPACITY", "CASCADE", "CASCADED", "CASE", "CAST", "CATALOG", "CHAR",
+		"CHARACTER", "CHECK", "CLASS", "CLOB", "CLOSE", "CLUSTER", "CLUSTERED",
+		"CLUSTERING", "CLUSTERS", "COALESCE", "COLLATE", "COLLATION", "COLLECTION",
+		"COLUMN", "COLUMNS", "COMBINE", "COMMENT", "COMMIT", "COMPACT", "COMPILE",
+		"COMPRESS", "CONDITION", "CONFLICT", "CONNECT", "CONNECTION", "CONSISTENCY",
+		"CONSISTENT", "CONSTRAINT", "CONSTRAINTS", "CONSTRUCTOR", "CONSUMED",
+		"CONTINUE", "CONVERT", "COPY", "CORRESPONDING", "COUNT", "COUNTER",
+		"CREATE", "CROSS", "CUBE", "CURRENT", "CURSOR", "CYCLE", "DATA", "DATABASE",
+		"DATE", "DATETIME", "DAY", "DEALLOCATE", "DEC", "DECIMAL", "DECLARE",
+		"DEFAULT", "DEFERRABLE", "DEFERRED", "DEFINE", "DEFINED", "DEFINITION",
+		"DELETE", "DELIMITED", "DEPTH", "DEREF", "DESC", "DESCRIBE", "DESCRIPTOR",
+		"DETACH", "DETERMINISTIC", "DIAGNOSTICS", "DIRECTORIES", "DISABLE",
+		"DISCONNECT", "DISTINCT", "DISTRIBUTE", "DO", "DOMAIN", "DOUBLE", "DROP",
+		"DUMP", "DURATION", "DYNAMIC", "EACH", "ELEMENT", "ELSE", "ELSEIF", "EMPTY",
+		"ENABLE", "END", "EQUAL", "EQUALS", "ERROR", "ESCAPE", "ESCAPED", "EVAL",
+		"EVALUATE", "EXCEEDED", "EXCEPT", "EXCEPTION", "EXCEPTIONS", "EXCLUSIVE",
+		"EXEC", "EXECUTE", "EXISTS", "EXIT", "EXPLAIN", "EXPLODE", "EXPORT",
+		"EXPRESSION", "EXTENDED", "EXTERNAL", "EXTRACT", "FAIL", "FALSE", "FAMILY",
+		"FETCH", "FIELDS", "FILE", "FILTER", "FILTERING", "FINAL", "FINISH",
+		"FIRST", "FIXED", "FLATTERN", "FLOAT", "FOR", "FORCE", "FOREIGN", "FORMAT",
+		"FORWARD", "FOUND", "FREE", "FROM", "FULL", "FUNCTION", "FUNCTIONS",
+		"GENERAL", "GENERATE", "GET", "GLOB", "GLOBAL", "GO", "GOTO", "GRANT",
+		"GREATER", "GROUP", "GROUPING", "HANDLER", "HASH", "HAVE", "HAVING", "HEAP",
+		"HIDDEN", "HOLD", "HOUR", "IDENTIFIED", "IDENTITY", "IF", "IGNORE",
+		"IMMEDIATE", "IMPORT", "IN", "INCLUDING", "INCLUSIVE", "INCREMENT",
+		"INCREMENTAL", "INDEX", "INDEXED", "INDEXES", "INDICATOR", "INFINITE",
+		"INITIALLY", "INLINE", "INNER", "INNTER", "INOUT", "INPUT", "INSENSITIVE",
+		"INSERT", "INSTEAD", "INT", "INTEGER", "INTERSECT", "INTERVAL", "INTO",
+		"INVALIDATE", "IS", "ISOLATION", "ITEM", "ITEMS", "ITERATE", "JOIN", "KEY",
+		"KEYS", "LAG", "LANGUAGE", "LARGE", "LAST", "LATERAL", "LEAD", "LEADING",
+		"LEAVE", "LEFT", "LENGTH", "LESS", "LEVEL", "LIKE", "LIMIT", "LIMITED",
+		"LINES", "LIST", "LOAD", "LOCAL", "LOCALTIME", "LOCALTIMESTAMP", "LOCATION",
+		"LOCATOR", "LOCK", "LOCKS", "LOG", "LOGED", "LONG", "LOOP", "LOWER", "MAP",
+		"MATCH", "MATERIALIZED", "MAX", "MAXLEN", "MEMBER", "MERGE", "METHOD",
+		"METRICS", "MIN", "MINUS", "MINUTE", "MISSING", "MOD", "MODE", "MODIFIES",
+		"MODIFY", "MODULE", "MONTH", "MULTI", "MULTISET", "NAME", "NAMES",
+		"NATIONAL", "NATURAL", "NCHAR", "NCLOB", "NEW", "NEXT", "NO", "NONE", "NOT",
+		"NULL", "NULLIF", "NUMBER", "NUMERIC", "OBJECT", "OF", "OFFLINE", "OFFSET",
+		"OLD", "ON", "ONLINE", "ONLY", "OPAQUE", "OPEN", "OPERATOR", "OPTION", "OR",
+		"ORDER", "ORDINALITY", "OTHER", "OTHERS", "OUT", "OUTER", "OUTPUT", "OVER",
+		"OVERLAPS", "OVERRIDE", "OWNER", "PAD", "PARALLEL", "PARAMETER",
+		"PARAMETERS", "PARTIAL", "PARTITION", "PARTITIONED", "PARTITIONS", "PATH",
+		"PERCENT", "PERCENTILE", "PERMISSION", "PERMISSIONS", "PIPE", "PIPELINED",
+		"PLAN", "POOL", "POSITION", "PRECISION", "PREPARE", "PRESERVE", "PRIMARY",
+		"PRIOR", "PRIVATE", "PRIVILEGES", "PROCEDURE", "PROCESSED", "PROJECT",
+		"PROJECTION", "PROPERTY", "PROVISIONING", "PUBLIC", "PUT", "QUERY", "QUIT",
+		"QUORUM", "RAISE", "RANDOM", "RANGE", "RANK", "RAW", "READ", "READS",
+		"REAL", "REBUILD", "RECORD", "RECURSIVE", "REDUCE", "REF", "REFERENCE",
+		"REFERENCES", "REFERENCING", "REGEXP", "REGION", "REINDEX", "RELATIVE",
+		"RELEASE", "REMAINDER", "RENAME", "REPEAT", "REPLACE", "REQUEST", "RESET",
+		"RESIGNAL", "RESOURCE", "RESPONSE", "RESTORE", "RESTRICT", "RESULT",
+		"RETURN", "RETURNING", "RETURNS", "REVERSE", "REVOKE", "RIGHT", "ROLE",
+		"ROLES", "ROLLBACK", "ROLLUP", "ROUTINE", "ROW", "ROWS", "RULE", "RULES",
+		"SAMPLE", "SATISFIES", "SAVE", "SAVEPOINT", "SCAN", "SCHEMA", "SCOPE",
+		"SCROLL", "SEARCH", "SECOND", "SECTION", "SEGMENT", "SEGMENTS", "SELECT",
+		"SELF", "SEMI", "SENSITIVE", "SEPARATE", "SEQUENCE", "SERIALIZABLE",
+		"SESSION", "SET", "SETS", "SHARD", "SHARE", "SHARED", "SHORT", "SHOW",
+		"SIGNAL", "SIMILAR", "SIZE", "SKEWED", "SMALLINT", "SNAPSHOT", "SOME",
+		"SOURCE", "SPACE", "SPACES", "SPARSE", "SPECIFIC", "SPECIFICTYPE", "SPLIT",
+		"SQL", "SQLCODE", "SQLERROR", "SQLEXCEPTION", "SQLSTATE", "SQLWARNING",
+		"START", "STATE", "STATIC", "STATUS", "STORAGE", "STORE", "STORED",
+		"STREAM", "STRING", "STRUCT", "STYLE", "SUB", "SUBMULTISET", "SUBPARTITION",
+		"SUBSTRING", "SUBTYPE", "SUM", "SUPER", "SYMMETRIC", "SYNONYM", "SYSTEM",
+		"TABLE", "TABLESAMPLE", "TEMP", "TEMPORARY", "TERMINATED", "TEXT", "THAN",
+		"THEN", "THROUGHPUT", "TIME", "TIMESTAMP", "TIMEZONE", "TINYINT", "TO",
+		"TOKEN", "TOTAL", "TOUCH", "TRAILING", "TRANSACTION", "TRANSFORM",
+		"TRANSLATE", "TRANSLATION", "TREAT", "TRIGGER", "TRIM", "TRUE", "TRUNCATE",
+		"TTL", "TUPLE", "TYPE", "UNDER", "UNDO", "UNION", "UNIQUE", "UNIT",
+		"UNKNOWN", "UNLOGGED", "UNNEST", "UNPROCESSED", "UNSIGNED", "UNTIL",
+		"UPDATE", "UPPER", "URL", "USAGE", "USE", "USER", "USERS", "USING", "UUID",
+		"VACUUM", "VALUE", "VALUED", "VALUES", "VARCHAR", "VARIABLE", "VARIANCE",
+		"VARINT", "VARYING", "VIEW", "VIEWS", "VIRTUAL", "VOID", "WAIT", "WHEN",
+		"WHENEVER", "WHERE", "WHILE", "WINDOW", "WITH", "WITHIN", "WITHOUT", "WORK",
+		"WRAPPED", "WRITE", "YEAR", "ZONE",
+	} {
+		words[word] = true
+	}
+	return words
+}()
+
+type token struct {
+	kind string // "name", "placeholder", "value", "number", "op" or "end"
+	text string
+}
+
+func tokenize(expression string) ([]token, *fakeError) {
+	var tokens []token
+	for i := 0; i < len(expression); {
+		c := rune(expression[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || c == ':' || unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(expression) && (unicode.IsLetter(rune(expression[j])) || unicode.IsDigit(rune(expression[j])) || expression[j] == '_') {
+				j++
+			}
+			kind := "name"
+			switch c {
+			case '#':
+				kind = "placeholder"
+			case ':':
+				kind = "value"
+			}
+			tokens = append(tokens, token{kind, expression[i:j]})
+			i = j
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(expression) && unicode.IsDigit(rune(expression[j])) {
+				j++
+			}
+			tokens = append(tokens, token{"number", expression[i:j]})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(expression) && slices.Contains([]string{"<>", "<=", ">="}, expression[i:i+2]) {
+				op = expression[i : i+2]
+			}
+			if !strings.Contains("()[],.=<>+-", string(c)) {
+				return nil, validationException("Invalid expression: unexpected %q in %q", c, expression)
+			}
+			tokens = append(tokens, token{"op", op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: "end"}), nil
+}
+
+// parser is a recursive descent parser over the tokens of one expression
+type parser struct {
+	ctx        *expressionContext
+	expression string
+	tokens     []token
+	pos        int
+}
+
+func (c *expressionContext) newParser(expression string) (*parser, *fakeError) {
+	tokens, ferr := tokenize(expression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	return &parser{ctx: c, expression: expression, tokens: tokens}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the given keyword
+func (p *parser) keyword(word string) bool {
+	if t := p.peek(); t.kind == "name" && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op consumes the next token if it is the given operator
+func (p *parser) op(op string) bool {
+	if t := p.peek(); t.kind == "op" && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) fail(format string, args ...any) *fakeError {
+	return validationException("Invalid expression %q: %s", p.expression, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(op string) *fakeError {
+	if !p.op(op) {
+		return p.fail("expected %q, found %q", op, p.peek().text)
+	}
+	return nil
+}
+
+// path is a document path such as addresses.home.street
+type path []string
+
+func (p *parser) parsePath() (path, *fakeError) {
+	var parts path
+	for {
+		t := p.next()
+		switch t.kind {
+		case "name":
+			if reservedWords[strings.ToUpper(t.text)] {
+				return nil, validationException("Invalid expression %q: Attribute name is a reserved keyword; reserved keyword: %s", p.expression, t.text)
+			}
+			parts = append(parts, t.text)
+		case "placeholder":
+			name, ok := p.ctx.names[t.text]
+			if !ok {
+				return nil, validationException("An expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+			}
+			p.ctx.usedNames[t.text] = true
+			parts = append(parts, name)
+		default:
+			return nil, p.fail("expected an attribute name, found %q", t.text)
+		}
+		for p.op("[") {
+			index := p.next()
+			if index.kind != "number" {
+				return nil, p.fail("expected a list index")
+			}
+			parts = append(parts, "["+index.text+"]")
+			if ferr := p.expect("]"); ferr != nil {
+				return nil, ferr
+			}
+		}
+		if !p.op(".") {
+			return parts, nil
+		}
+	}
+}
+
+func (p path) get(item map[string]types.AttributeValue) (types.AttributeValue, bool) {
+	var current types.AttributeValue = &types.AttributeValueMemberM{Value: item}
+	for _, part := range p {
+		switch av := current.(type) {
+		case *types.AttributeValueMemberM:
+			next, ok := av.Value[part]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case *types.AttributeValueMemberL:
+			index, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if err != nil || index >= len(av.Value) {
+				return nil, false
+			}
+			current = av.Value[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// parent returns the map holding the last part of the path
+func (p path) parent(item map[string]types.AttributeValue) (map[string]types.AttributeValue, bool) {
+	if len(p) == 1 {
+		return item, true
+	}
+	parent, ok := p[:len(p)-1].get(item)
+	if !ok {
+		return nil, false
+	}
+	m, ok := parent.(*types.AttributeValueMemberM)
+	if !ok {
+		return nil, false
+	}
+	return m.Value, true
+}
+
+func (p path) String() string {
+	return strings.Join(p, ".")
+}
+
+// overlaps reports whether one path is the other or inside it
+func (p path) overlaps(other path) bool {
+	n := min(len(p), len(other))
+	return slices.Equal(p[:n], other[:n])
+}
+
+// operand evaluates to an attribute value of the item, or to false if it
+// names an attribute the item does not have
+type operand func(item map[string]types.AttributeValue) (types.AttributeValue, bool)
+
+func (p *parser) parseOperand() (operand, *fakeError) {
+	t := p.peek()
+	if t.kind == "value" {
+		p.pos++
+		value, ok := p.ctx.values[t.text]
+		if !ok {
+			return nil, validationException("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+		}
+		p.ctx.usedValues[t.text] = true
+		return func(map[string]types.AttributeValue) (types.AttributeValue, bool) { return value, true }, nil
+	}
+
+	path, ferr := p.parsePath()
+	if ferr != nil {
+		return nil, ferr
+	}
+	return func(item map[string]types.AttributeValue) (types.AttributeValue, bool) { return path.get(item) }, nil
+}
+
+type condition = func(item map[string]types.AttributeValue) bool
+
+// parseCondition parses a condition, key condition or filter expression. An
+// empty expression gives a nil condition.
+func (c *expressionContext) parseCondition(expression string) (condition, *fakeError) {
+	if expression == "" {
+		return nil, nil
+	}
+	p, ferr := c.newParser(expression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	cond, ferr := p.parseOr()
+	if ferr != nil {
+		return nil, ferr
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, p.fail("unexpected %q", t.text)
+	}
+	return func(item map[string]types.AttributeValue) bool {
+		if item == nil {
+			item = map[string]types.AttributeValue{}
+		}
+		return cond(item)
+	}, nil
+}
+
+func (p *parser) parseOr() (condition, *fakeError) {
+	left, ferr := p.parseAnd()
+	if ferr != nil {
+		return nil, ferr
+	}
+	for p.keyword("OR") {
+		right, ferr := p.parseAnd()
+		if ferr != nil {
+			return nil, ferr
+		}
+		l := left
+		left = func(item map[string]types.AttributeValue) bool { return l(item) || right(item) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, *fakeError) {
+	left, ferr := p.parseNot()
+	if ferr != nil {
+		return nil, ferr
+	}
+	for p.keyword("AND") {
+		right, ferr := p.parseNot()
+		if ferr != nil {
+			return nil, ferr
+		}
+		l := left
+		left = func(item map[string]types.AttributeValue) bool { return l(item) && right(item) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, *fakeError) {
+	if p.keyword("NOT") {
+		cond, ferr := p.parseNot()
+		if ferr != nil {
+			return nil, ferr
+		}
+		return func(item map[string]types.AttributeValue) bool { return !cond(item) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, *fakeError) {
+	if p.op("(") {
+		cond, ferr := p.parseOr()
+		if ferr != nil {
+			return nil, ferr
+		}
+		return cond, p.expect(")")
+	}
+
+	if t := p.peek(); t.kind == "name" && p.tokens[p.pos+1].text == "(" {
+		return p.parseFunction()
+	}
+
+	first := p.peek()
+	left, ferr := p.parseOperand()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	if p.keyword("BETWEEN") {
+		low, ferr := p.parseOperand()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if !p.keyword("AND") {
+			return nil, p.fail("expected AND in BETWEEN")
+		}
+		high, ferr := p.parseOperand()
+		if ferr != nil {
+			return nil, ferr
+		}
+		return func(item map[string]types.AttributeValue) bool {
+			value, ok := left(item)
+			lowValue, _ := low(item)
+			highValue, _ := high(item)
+			c1, ok1 := compareValues(value, lowValue)
+			c2, ok2 := compareValues(value, highValue)
+			return ok && ok1 && ok2 && c1 >= 0 && c2 <= 0
+		}, nil
+	}
+
+	if p.keyword("IN") {
+		if ferr := p.expect("("); ferr != nil {
+			return nil, ferr
+		}
+		var options []operand
+		if ferr := p.checkScalar(first, "IN"); ferr != nil {
+			return nil, ferr
+		}
+		for {
+			if ferr := p.checkScalar(p.peek(), "IN"); ferr != nil {
+				return nil, ferr
+			}
+			option, ferr := p.parseOperand()
+			if ferr != nil {
+				return nil, ferr
+			}
+			options = append(options, option)
+			if !p.op(",") {
+				break
+			}
+		}
+		if ferr := p.expect(")"); ferr != nil {
+			return nil, ferr
+		}
+		return func(item map[string]types.AttributeValue) bool {
+			value, ok := left(item)
+			if !ok {
+				return false
+			}
+			for _, option := range options {
+				if candidate, ok := option(item); ok {
+					if equal, ok := equalValues(value, candidate); ok && equal {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	}
+
+	comparator := p.next()
+	if comparator.kind != "op" || !slices.Contains([]string{"=", "<>", "<", "<=", ">", ">="}, comparator.text) {
+		return nil, p.fail("expected a comparator, found %q", comparator.text)
+	}
+	for _, t := range []token{first, p.peek()} {
+		if ferr := p.checkScalar(t, comparator.text); ferr != nil {
+			return nil, ferr
+		}
+	}
+	right, ferr := p.parseOperand()
+	if ferr != nil {
+		return nil, ferr
+	}
+	return func(item map[string]types.AttributeValue) bool {
+		a, okA := left(item)
+		b, okB := right(item)
+		if !okA || !okB {
+			return false
+		}
+		switch comparator.text {
+		case "=", "<>":
+			equal, ok := equalValues(a, b)
+			return ok && equal == (comparator.text == "=")
+		}
+		c, ok := compareValues(a, b)
+		if !ok {
+			return false
+		}
+		switch comparator.text {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+// checkScalar refuses an expression attribute value that is a map, list or
+// set as an operand of a comparator, as DynamoDB does
+func (p *parser) checkScalar(t token, operator string) *fakeError {
+	if t.kind != "value" {
+		return nil
+	}
+	if value, ok := p.ctx.values[t.text]; ok && !scalarValue(value) {
+		return p.fail("Incorrect operand type for operator or function; operator or function: %s, operand type: %T", operator, value)
+	}
+	return nil
+}
+
+func (p *parser) parseFunction() (condition, *fakeError) {
+	name := strings.ToLower(p.next().text)
+	p.next() // (
+	target, ferr := p.parsePath()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	var cond condition
+	switch name {
+	case "attribute_exists":
+		cond = func(item map[string]types.AttributeValue) bool {
+			_, ok := target.get(item)
+			return ok
+		}
+	case "attribute_not_exists":
+		cond = func(item map[string]types.AttributeValue) bool {
+			_, ok := target.get(item)
+			return !ok
+		}
+	case "begins_with":
+		if ferr := p.expect(","); ferr != nil {
+			return nil, ferr
+		}
+		prefix, ferr := p.parseOperand()
+		if ferr != nil {
+			return nil, ferr
+		}
+		cond = func(item map[string]types.AttributeValue) bool {
+			value, ok := target.get(item)
+			s, isString := value.(*types.AttributeValueMemberS)
+			want, _ := prefix(item)
+			wantString, wantIsString := want.(*types.AttributeValueMemberS)
+			return ok && isString && wantIsString && strings.HasPrefix(s.Value, wantString.Value)
+		}
+	default:
+		return nil, p.fail("unsupported function %s", name)
+	}
+	return cond, p.expect(")")
+}
+
+// parseProjection parses a projection expression into the top level
+// attributes it selects, nil for all of them
+func (c *expressionContext) parseProjection(expression string) ([]string, *fakeError) {
+	if expression == "" {
+		return nil, nil
+	}
+	p, ferr := c.newParser(expression)
+	if ferr != nil {
+		return nil, ferr
+	}
+	var names []string
+	for {
+		path, ferr := p.parsePath()
+		if ferr != nil {
+			return nil, ferr
+		}
+		names = append(names, path[0])
+		if !p.op(",") {
+			break
+		}
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, p.fail("unexpected %q", t.text)
+	}
+	return names, nil
+}
+
+// parseUpdate parses an update expression into a function that applies it
+// to an item in place
+func (c *expressionContext) parseUpdate(expression string, keyNames []string) (func(item map[string]types.AttributeValue) *fakeError, *fakeError) {
+	if expression == "" {
+		return nil, validationException("UpdateExpression is required")
+	}
+	p, ferr := c.newParser(expression)
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	type action struct {
+		path  path
+		apply func(item map[string]types.AttributeValue) *fakeError
+	}
+	var actions []action
+	clauses := make(map[string]bool)
+
+	for p.peek().kind != "end" {
+		clause := strings.ToUpper(p.next().text)
+		if clauses[clause] {
+			return nil, p.fail("the %s section can only be used once", clause)
+		}
+		clauses[clause] = true
+
+		for {
+			target, ferr := p.parsePath()
+			if ferr != nil {
+				return nil, ferr
+			}
+			if len(target) == 1 && slices.Contains(keyNames, target[0]) {
+				return nil, validationException("Cannot update attribute %s. This attribute is part of the key", target[0])
+			}
+
+			var apply func(item map[string]types.AttributeValue) *fakeError
+			switch clause {
+			case "SET":
+				if ferr := p.expect("="); ferr != nil {
+					return nil, ferr
+				}
+				value, ferr := p.parseSetValue()
+				if ferr != nil {
+					return nil, ferr
+				}
+				apply = func(item map[string]types.AttributeValue) *fakeError {
+					v, ferr := value(item)
+					if ferr != nil {
+						return ferr
+					}
+					parent, ok := target.parent(item)
+					if !ok {
+						return validationException("The document path provided in the update expression is invalid for update")
+					}
+					parent[target[len(target)-1]] = v
+					return nil
+				}
+			case "REMOVE":
+				apply = func(item map[string]types.AttributeValue) *fakeError {
+					if parent, ok := target.parent(item); ok {
+						delete(parent, target[len(target)-1])
+					}
+					return nil
+				}
+			case "ADD":
+				value, ferr := p.parseOperand()
+				if ferr != nil {
+					return nil, ferr
+				}
+				apply = func(item map[string]types.AttributeValue) *fakeError {
+					v, _ := value(item)
+					parent, ok := target.parent(item)
+					if !ok {
+						return validationException("The document path provided in the update expression is invalid for update")
+					}
+					sum, ferr := addValues(parent[target[len(target)-1]], v)
+					if ferr != nil {
+						return ferr
+					}
+					parent[target[len(target)-1]] = sum
+					return nil
+				}
+			default:
+				return nil, p.fail("unsupported clause %s", clause)
+			}
+
+			for _, other := range actions {
+				if other.path.overlaps(target) {
+					return nil, validationException("Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [%s], path two: [%s]", other.path, target)
+				}
+			}
+			actions = append(actions, action{target, apply})
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+
+	return func(item map[string]types.AttributeValue) *fakeError {
+		// Every action reads the item as it was before the update
+		before := cloneItem(item)
+		for _, action := range actions {
+			scratch := cloneItem(before)
+			if ferr := action.apply(scratch); ferr != nil {
+				return ferr
+			}
+			if value, ok := action.path.get(scratch); ok {
+				parent, _ := action.path.parent(item)
+				parent[action.path[len(action.path)-1]] = value
+			} else if parent, ok := action.path.parent(item); ok {
+				delete(parent, action.path[len(action.path)-1])
+			}
+		}
+		return nil
+	}, nil
+}
+
+type setValue func(item map[string]types.AttributeValue) (types.AttributeValue, *fakeError)
+
+// parseSetValue parses the right hand side of a SET action
+func (p *parser) parseSetValue() (setValue, *fakeError) {
+	left, ferr := p.parseSetOperand()
+	if ferr != nil {
+		return nil, ferr
+	}
+	t := p.peek()
+	if t.kind != "op" || (t.text != "+" && t.text != "-") {
+		return left, nil
+	}
+	p.pos++
+	right, ferr := p.parseSetOperand()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	return func(item map[string]types.AttributeValue) (types.AttributeValue, *fakeError) {
+		a, ferr := left(item)
+		if ferr != nil {
+			return nil, ferr
+		}
+		b, ferr := right(item)
+		if ferr != nil {
+			return nil, ferr
+		}
+		x, okA := a.(*types.AttributeValueMemberN)
+		y, okB := b.(*types.AttributeValueMemberN)
+		if !okA || !okB {
+			return nil, validationException("An operand in the update expression has an incorrect data type")
+		}
+		m, _ := parseNumber(x.Value)
+		n, _ := parseNumber(y.Value)
+		if t.text == "-" {
+			n.Neg(n)
+		}
+		return &types.AttributeValueMemberN{Value: formatNumber(m.Add(m, n))}, nil
+	}, nil
+}
+
+func (p *parser) parseSetOperand() (setValue, *fakeError) {
+	if t := p.peek(); t.kind == "name" && strings.EqualFold(t.text, "if_not_exists") && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		target, ferr := p.parsePath()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if ferr := p.expect(","); ferr != nil {
+			return nil, ferr
+		}
+		fallback, ferr := p.parseSetOperand()
+		if ferr != nil {
+			return nil, ferr
+		}
+		if ferr := p.expect(")"); ferr != nil {
+			return nil, ferr
+		}
+		return func(item map[string]types.AttributeValue) (types.AttributeValue, *fakeError) {
+			if value, ok := target.get(item); ok {
+				return value, nil
+			}
+			return fallback(item)
+		}, nil
+	}
+
+	value, ferr := p.parseOperand()
+	if ferr != nil {
+		return nil, ferr
+	}
+	return func(item map[string]types.AttributeValue) (types.AttributeValue, *fakeError) {
+		v, ok := value(item)
+		if !ok {
+			return nil, validationException("The provided expression refers to an attribute that does not exist in the item")
+		}
+		return v, nil
+	}, nil
+}
+
+// addValues applies ADD to a number or a set, current is nil if the
+// attribute does not exist yet
+func addValues(current, value types.AttributeValue) (types.AttributeValue, *fakeError) {
+	switch value := value.(type) {
+	case *types.AttributeValueMemberN:
+		if current == nil {
+			return value, nil
+		}
+		n, ok := current.(*types.AttributeValueMemberN)
+		if !ok {
+			break
+		}
+		x, _ := parseNumber(n.Value)
+		y, _ := parseNumber(value.Value)
+		return &types.AttributeValueMemberN{Value: formatNumber(x.Add(x, y))}, nil
+	case *types.AttributeValueMemberSS:
+		if current == nil {
+			return value, nil
+		}
+		set, ok := current.(*types.AttributeValueMemberSS)
+		if !ok {
+			break
+		}
+		union := slices.Clone(set.Value)
+		for _, s := range value.Value {
+			if !slices.Contains(union, s) {
+				union = append(union, s)
+			}
+		}
+		return &types.AttributeValueMemberSS{Value: union}, nil
+	}
+	return nil, validationException("An operand in the update expression has an incorrect data type")
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -10,32 +15,32 @@ import (
 )
 
 type API struct {
-	repo *Repository
+	store Store
 }
 
-func NewAPI(repo *Repository) *API {
-	return &API{repo: repo}
+func NewAPI(store Store) *API {
+	return &API{store: store}
 }
 
 // User handlers
 
 func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &user) {
 		return
 	}
 
-	if user.Username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
+	if err := validate(user); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if err := api.repo.CreateUser(r.Context(), user); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := api.store.CreateUser(r.Context(), &user); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	setETag(w, user.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -43,50 +48,227 @@ func (api *API) CreateUser(w http.ResponseWriter, r *http.Request) {
 func (api *API) GetUser(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
 	
-	user, err := api.repo.GetUser(r.Context(), username)
+	user, err := api.store.GetUser(r.Context(), username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
+	setETag(w, user.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
-func (api *API) UpdateUser(w http.ResponseWriter, r *http.Request) {
+// PutUser replaces the whole profile, including addresses, of the user named
+// in the URL. It needs If-Match with the ETag from GET, If-Match: * to replace
+// the user whatever its version, or If-None-Match: * to create a user that
+// does not exist yet. If-Match never matches a missing user (RFC 7232).
+func (api *API) PutUser(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
-	
+
+	create := r.Header.Get("If-None-Match") == "*"
+	var version int64
+	if !create {
+		var ok bool
+		if version, ok = ifMatchVersion(w, r); !ok {
+			return
+		}
+	}
+
 	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &user) {
 		return
 	}
+	user.Username = username
 
-	if err := api.repo.UpdateUser(r.Context(), username, user); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validate(user); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	user.Username = username
+	var err error
+	if create {
+		err = api.store.CreateUser(r.Context(), &user)
+	} else {
+		err = api.store.ReplaceUser(r.Context(), &user, version)
+	}
+	if err != nil {
+		// The precondition decides whether the user should exist
+		if errors.Is(err, ErrUserExists) || errors.Is(err, ErrUserNotFound) {
+			err = fmt.Errorf("%w: %w", ErrPrecondition, err)
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	setETag(w, user.Version)
 	w.Header().Set("Content-Type", "application/json")
+	if create {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(user)
 }
 
-// Order handlers
+// PatchUser applies a JSON merge patch to the user named in the URL, where
+// null removes a field or address. If-Match is optional.
+func (api *API) PatchUser(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+
+	version, ok := optionalIfMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	var patch UserPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+
+	user, err := api.store.UpdateUser(r.Context(), username, patch, version)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setETag(w, user.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// DeleteUser removes the user with all of their orders and order items. It
+// refuses with 409 while orders are open unless ?force=true.
+func (api *API) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+
+	force := false
+	if param := r.URL.Query().Get("force"); param != "" {
+		var err error
+		if force, err = strconv.ParseBool(param); err != nil {
+			writeError(w, r, validationError("force must be true or false"))
+			return
+		}
+	}
+
+	if err := api.store.DeleteUser(r.Context(), username, force); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Address handlers
+
+func (api *API) GetAddress(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	key := chi.URLParam(r, "key")
+
+	user, err := api.store.GetUser(r.Context(), username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	address, ok := user.Addresses[key]
+	if !ok {
+		writeError(w, r, fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, username, key))
+		return
+	}
+
+	setETag(w, user.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AddressEntry{Key: key, Address: address, Default: user.DefaultAddress == key})
+}
+
+// PutAddress adds or replaces one address, setting just that key of the
+// addresses map. "default": true makes it the user's default address.
+// If-Match with the user's ETag is optional.
+func (api *API) PutAddress(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	key := chi.URLParam(r, "key")
+
+	version, ok := optionalIfMatchVersion(w, r)
+	if !ok {
+		return
+	}
 
-func (api *API) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		UserID     string `json:"user_id"`
-		AddressKey string `json:"address_key"`
+		Address
+		Default bool `json:"default"`
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if req.UserID == "" {
-		http.Error(w, "user_id is required", http.StatusBadRequest)
+	if err := validate(req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	patch := UserPatch{
+		Addresses: Patch[map[string]*AddressPatch]{
+			Set:   true,
+			Value: &map[string]*AddressPatch{key: replaceAddress(req.Address)},
+		},
+	}
+	if req.Default {
+		patch.DefaultAddress = patchValue(key)
+	}
+
+	user, err := api.store.UpdateUser(r.Context(), username, patch, version)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setETag(w, user.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AddressEntry{Key: key, Address: user.Addresses[key], Default: user.DefaultAddress == key})
+}
+
+// DeleteAddress removes one address unless an order that has not been
+// delivered or cancelled ships to it
+func (api *API) DeleteAddress(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	key := chi.URLParam(r, "key")
+
+	version, ok := optionalIfMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	if err := api.store.DeleteAddress(r.Context(), username, key, version); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Order handlers
+
+type createOrderRequest struct {
+	UserID     string `json:"user_id"`
+	AddressKey string `json:"address_key"`
+	Currency   string `json:"currency"`
+}
+
+func (req createOrderRequest) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("user_id", required(req.UserID))
+	errs.check("address_key", required(req.AddressKey))
+	errs.check("currency", currency(req.Currency))
+	return errs
+}
+
+func (api *API) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req createOrderRequest
+
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := validate(req); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -95,95 +277,342 @@ func (api *API) CreateOrder(w http.ResponseWriter, r *http.Request) {
 		UserID:     req.UserID,
 		Status:     OrderStatusPending,
 		AddressKey: req.AddressKey,
+		Currency:   currencyOrDefault(req.Currency),
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 	}
 
-	if err := api.repo.CreateOrder(r.Context(), order); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := api.store.CreateOrder(r.Context(), order); err != nil {
+		writeError(w, r, addressKeyError(err))
+		return
+	}
+
+	setETag(w, order.Version)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+type orderAddressRequest struct {
+	AddressKey string `json:"address_key"`
+}
+
+func (req orderAddressRequest) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("address_key", required(req.AddressKey))
+	return errs
+}
+
+// UpdateOrderAddress ships an order to another of the user's addresses. It
+// fails with 409 once the order has shipped.
+func (api *API) UpdateOrderAddress(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderid")
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	var req orderAddressRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := validate(req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	order, err := api.store.UpdateOrderAddress(r.Context(), orderID, req.AddressKey, version)
+	if err != nil {
+		writeError(w, r, addressKeyError(err))
 		return
 	}
 
+	setETag(w, order.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
 
+// addressKeyError reports an address_key naming an address the user does not
+// have as a problem with the request body rather than a missing resource
+func addressKeyError(err error) error {
+	if !errors.Is(err, ErrAddressNotFound) {
+		return err
+	}
+	return &ValidationError{Fields: []FieldError{
+		{Field: "address_key", Message: "is not one of the user's addresses"},
+	}}
+}
+
 func (api *API) GetOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderid")
 	
-	order, err := api.repo.GetOrderByID(r.Context(), orderID)
+	order, err := api.store.GetOrderByID(r.Context(), orderID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
+	setETag(w, order.Version)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
 
 func (api *API) GetUserOrders(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
-	
-	orders, err := api.repo.GetOrdersByUserID(r.Context(), username)
+	query := r.URL.Query()
+
+	page, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var (
+		orders Page[*Order]
+		err    error
+	)
+	if status := query.Get("status"); status != "" {
+		from, to, ok := parseDateRange(w, r, query.Get("from"), query.Get("to"))
+		if !ok {
+			return
+		}
+		orders, err = api.store.GetUserOrdersByStatus(r.Context(), username, OrderStatus(status), from, to, page)
+	} else if query.Has("from") || query.Has("to") {
+		writeError(w, r, validationError("from and to need a status"))
+		return
+	} else {
+		orders, err = api.store.GetOrdersByUserID(r.Context(), username, page)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	writePage(w, orders)
+}
+
+// parseDateRange reads optional YYYY-MM-DD from/to query parameters, writing
+// a 400 response if either is malformed
+func parseDateRange(w http.ResponseWriter, r *http.Request, fromParam, toParam string) (from, to time.Time, ok bool) {
+	var err error
+	if fromParam != "" {
+		if from, err = time.Parse(dateLayout, fromParam); err != nil {
+			writeError(w, r, validationError("from must be a YYYY-MM-DD date"))
+			return from, to, false
+		}
+	}
+	if toParam != "" {
+		if to, err = time.Parse(dateLayout, toParam); err != nil {
+			writeError(w, r, validationError("to must be a YYYY-MM-DD date"))
+			return from, to, false
+		}
+		if to.Before(from) {
+			writeError(w, r, validationError("from must not be after to"))
+			return from, to, false
+		}
+	}
+	return from, to, true
+}
+
+type orderStatusRequest struct {
+	Status OrderStatus `json:"status"`
+}
+
+// Validate only requires a status, an unknown one is the store's
+// ErrUnknownStatus
+func (req orderStatusRequest) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("status", required(string(req.Status)))
+	return errs
 }
 
 func (api *API) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderid")
-	
-	var req struct {
-		Status OrderStatus `json:"status"`
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
 	}
 	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	var req orderStatusRequest
+
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if err := api.repo.UpdateOrderStatus(r.Context(), orderID, req.Status); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := validate(req); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	order, err := api.store.UpdateOrderStatus(r.Context(), orderID, req.Status, version)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	setETag(w, order.Version)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
 }
 
 func (api *API) GetPendingOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := api.repo.GetPendingOrders(r.Context())
+	page, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	orders, err := api.store.GetPendingOrders(r.Context(), page)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	writePage(w, orders)
+}
+
+// Product handlers
+
+func (api *API) CreateProduct(w http.ResponseWriter, r *http.Request) {
+	var product Product
+	if !decodeJSON(w, r, &product) {
+		return
+	}
+	product.Currency = currencyOrDefault(product.Currency)
+
+	if err := validate(product); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := api.store.CreateProduct(r.Context(), product); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(product)
+}
+
+func (api *API) GetProduct(w http.ResponseWriter, r *http.Request) {
+	sku := chi.URLParam(r, "sku")
+
+	product, err := api.store.GetProduct(r.Context(), sku)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+func (api *API) ListProducts(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	products, err := api.store.ListProducts(r.Context(), page)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writePage(w, products)
+}
+
+// UpdateProduct replaces a product's catalog entry. Stock is changed with
+// stock_adjustment rather than replaced, so reservations made since the
+// client read the product are not lost.
+func (api *API) UpdateProduct(w http.ResponseWriter, r *http.Request) {
+	sku := chi.URLParam(r, "sku")
+
+	var update ProductUpdate
+	if !decodeJSON(w, r, &update) {
+		return
+	}
+	update.Currency = currencyOrDefault(update.Currency)
+
+	if update.Stock != nil {
+		writeError(w, r, &ValidationError{Fields: []FieldError{
+			{Field: "stock", Message: "cannot be replaced, send stock_adjustment instead"},
+		}})
+		return
+	}
+	if err := validate(update); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	product, err := api.store.UpdateProduct(r.Context(), sku, update)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+func (api *API) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	sku := chi.URLParam(r, "sku")
+
+	if err := api.store.DeleteProduct(r.Context(), sku); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Order Item handlers
 
+type orderItemRequest struct {
+	SKU         string `json:"sku"`
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+}
+
+func (req orderItemRequest) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("sku", required(req.SKU), maxLength(req.SKU, 64))
+	errs.check("description", maxLength(req.Description, 500))
+	errs.check("quantity", atLeast(req.Quantity, 1))
+	return errs
+}
+
 func (api *API) CreateOrderItem(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderid")
-	
-	var item OrderItem
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+
+	var req orderItemRequest
+
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	if item.ItemID == "" {
-		item.ItemID = uuid.New().String()
+	if err := validate(req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	item := OrderItem{
+		OrderID:     orderID,
+		ItemID:      uuid.New().String(),
+		SKU:         req.SKU,
+		Description: req.Description,
+		Quantity:    req.Quantity,
 	}
-	item.OrderID = orderID
 
-	if err := api.repo.CreateOrderItem(r.Context(), orderID, &item); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := api.store.CreateOrderItem(r.Context(), orderID, &item); err != nil {
+		// The order is the resource here, a missing or mismatched product is
+		// a problem with the request body
+		if errors.Is(err, ErrProductNotFound) || errors.Is(err, ErrCurrencyMismatch) {
+			writeErrorStatus(w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeError(w, r, err)
 		return
 	}
 
@@ -193,13 +622,136 @@ func (api *API) CreateOrderItem(w http.ResponseWriter, r *http.Request) {
 
 func (api *API) GetOrderItems(w http.ResponseWriter, r *http.Request) {
 	orderID := chi.URLParam(r, "orderid")
-	
-	items, err := api.repo.GetOrderItems(r.Context(), orderID)
+
+	page, ok := parsePageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := api.store.GetOrderItems(r.Context(), orderID, page)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	writePage(w, items)
+}
+
+func (api *API) UpdateOrderItem(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderid")
+	itemID := chi.URLParam(r, "itemid")
+
+	var update OrderItemUpdate
+	if !decodeJSON(w, r, &update) {
+		return
+	}
+
+	if err := validate(update); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	item, err := api.store.UpdateOrderItem(r.Context(), orderID, itemID, update)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+func (api *API) DeleteOrderItem(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderid")
+	itemID := chi.URLParam(r, "itemid")
+
+	if err := api.store.DeleteOrderItem(r.Context(), orderID, itemID); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeJSON decodes the request body into v, writing a 400 response if it is
+// not valid JSON. Members of the wrong type, such as an amount with three
+// decimal places, are reported in a 422 response.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, errInvalidJSON)
+		return false
+	}
+	if err := json.Unmarshal(body, v); err == nil {
+		return true
+	}
+
+	if fields := typeErrors(body, v); len(fields) > 0 {
+		writeError(w, r, &ValidationError{Fields: fields})
+		return false
+	}
+	writeError(w, r, errInvalidJSON)
+	return false
+}
+
+// setETag exposes a row's version as a strong ETag such as "3"
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// ifMatchVersion reads the version a PUT expects to replace from If-Match,
+// where * matches any version. It writes a 428 response if the header is
+// missing and a 412 response if it is not an ETag from setETag.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		writeError(w, r, errIfMatchRequired)
+		return 0, false
+	}
+	if header == "*" {
+		return anyVersion, true
+	}
+
+	tag, err := strconv.Unquote(header)
+	version, parseErr := strconv.ParseInt(tag, 10, 64)
+	if err != nil || parseErr != nil || version < 0 {
+		writeError(w, r, fmt.Errorf("%w: If-Match %s is not a current ETag", ErrVersionMismatch, header))
+		return 0, false
+	}
+	return version, true
+}
+
+// optionalIfMatchVersion is ifMatchVersion for writes that also work without
+// If-Match, returning anyVersion when it is missing
+func optionalIfMatchVersion(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if r.Header.Get("If-Match") == "" {
+		return anyVersion, true
+	}
+	return ifMatchVersion(w, r)
+}
+
+// parsePageRequest reads the limit and cursor query parameters, writing a 400
+// response if limit is not a positive number
+func parsePageRequest(w http.ResponseWriter, r *http.Request) (PageRequest, bool) {
+	query := r.URL.Query()
+	page := PageRequest{Cursor: query.Get("cursor")}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 32)
+		if err != nil || n <= 0 {
+			writeError(w, r, validationError("limit must be a positive number"))
+			return page, false
+		}
+		page.Limit = int32(n)
+	}
+	return page, true
+}
+
+func writePage[T any](w http.ResponseWriter, page Page[T]) {
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(items)
+	json.NewEncoder(w).Encode(page)
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Key prefixes used by the single table design
+const (
+	userPrefix    = "#USER#"
+	orderPrefix   = "#ORDER#"
+	itemPrefix    = "#ITEM#"
+	productPrefix = "#PRODUCT#"
+	profileSK     = "PROFILE"
+	productSK     = "PRODUCT"
+
+	// metaPK holds rows about the table itself, such as the schema version
+	metaPK   = "#META#"
+	schemaSK = "SCHEMA"
+)
+
+func userPK(username string) string {
+	return userPrefix + username
+}
+
+func orderSK(orderID string) string {
+	return orderPrefix + orderID
+}
+
+func orderPK(orderID string) string {
+	return orderPrefix + orderID
+}
+
+func itemSK(itemID string) string {
+	return itemPrefix + itemID
+}
+
+func productPK(sku string) string {
+	return productPrefix + sku
+}
+
+// dateLayout is the day precision used in status_date
+const dateLayout = "2006-01-02"
+
+// maxStatusDate is the upper bound used for open ended status date ranges
+var maxStatusDate = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// statusDate builds the sort key of the status-date-index LSI
+func statusDate(status OrderStatus, t time.Time) string {
+	return fmt.Sprintf("%s#%s", status, t.Format(dateLayout))
+}
+
+// isPlaced reports whether an order in this status belongs in the sparse
+// placed-index GSI
+func isPlaced(status OrderStatus) bool {
+	return status == OrderStatusPending || status == OrderStatusConfirmed
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,13 +23,52 @@ import (
 
 func main() {
 	var (
-		createTable = flag.Bool("create-table", false, "Create DynamoDB table")
-		deleteTable = flag.Bool("delete-table", false, "Delete DynamoDB table")
-		emptyTable  = flag.Bool("empty-table", false, "Empty DynamoDB table")
-		port        = flag.String("port", "8080", "Server port")
+		createTable   = flag.Bool("create-table", false, "Create DynamoDB table")
+		ensureTable   = flag.Bool("ensure-table", false, "Create the table or add its missing GSIs, reporting differences that cannot be fixed")
+		deleteTable   = flag.Bool("delete-table", false, "Delete DynamoDB table")
+		emptyTable    = flag.Bool("empty-table", false, "Empty DynamoDB table")
+		tableConfig   = flag.String("table-config", "", "JSON file with the billing mode and capacity for -create-table and -ensure-table")
+		billing       = flag.String("billing", billingProvisioned, "Billing mode for -create-table and -ensure-table: on-demand or provisioned")
+		rcu           = flag.Int64("rcu", 5, "Read capacity units of the table for -create-table and -ensure-table")
+		wcu           = flag.Int64("wcu", 5, "Write capacity units of the table for -create-table and -ensure-table")
+		indexCapacity = flag.String("index-capacity", "", "GSI capacity for -create-table and -ensure-table as name=read/write, comma separated; defaults to the table's")
+		scaleTarget   = flag.Float64("autoscale-target", 0, "Auto scaling target utilization percent, recorded in the table tags")
+		scaleMin      = flag.Int64("autoscale-min", 0, "Auto scaling minimum capacity, recorded in the table tags")
+		scaleMax      = flag.Int64("autoscale-max", 0, "Auto scaling maximum capacity, recorded in the table tags")
+		migrate       = flag.Bool("migrate", false, "Apply pending schema migrations")
+		migrateStatus = flag.Bool("migrate-status", false, "Show applied and pending schema migrations")
+		exportFile    = flag.String("export", "", "Export every item to a newline-delimited DynamoDB JSON file, gzipped if it ends in .gz")
+		importFile    = flag.String("import", "", "Import items from a file written by -export")
+		workers       = flag.Int("workers", 4, "Parallel scan segments or writers used by -empty-table, -export, -import and -migrate")
+		useMemory     = flag.Bool("memory", false, "Serve the API from an in-memory store instead of DynamoDB")
+		port          = flag.String("port", "8080", "Server port")
+		endpoint      = flag.String("endpoint", os.Getenv("DYNAMODB_ENDPOINT"), "DynamoDB endpoint URL, e.g. http://localhost:8000 for DynamoDB Local")
 	)
 	flag.Parse()
 
+	// The table flags only override the config file when they are given
+	tableSettings := tableFlags{
+		billing:       *billing,
+		rcu:           *rcu,
+		wcu:           *wcu,
+		indexCapacity: *indexCapacity,
+		scaleTarget:   *scaleTarget,
+		scaleMin:      *scaleMin,
+		scaleMax:      *scaleMax,
+		set:           make(map[string]bool),
+	}
+	flag.Visit(func(f *flag.Flag) { tableSettings.set[f.Name] = true })
+
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		SetCursorSecret(secret)
+	}
+
+	if *useMemory {
+		fmt.Println("Using in-memory store, data is lost on exit")
+		serve(NewAPI(NewMemoryStore()), *port)
+		return
+	}
+
 	// Get configuration from environment
 	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
 	if tableName == "" {
@@ -35,29 +81,61 @@ func main() {
 	}
 
 	// Initialize AWS config
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
+	opts := []func(*config.LoadOptions) error{
 		config.WithRegion(region),
-	)
+	}
+	if *endpoint != "" {
+		// DynamoDB Local and LocalStack accept any credentials
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider("local", "local", ""),
+		))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
 
 	// Create DynamoDB client
-	client := dynamodb.NewFromConfig(cfg)
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if *endpoint != "" {
+			o.BaseEndpoint = aws.String(*endpoint)
+		}
+	})
 	repo := NewRepository(client, tableName)
 
 	ctx := context.Background()
 
 	// Handle CLI commands
 	if *createTable {
-		fmt.Printf("Creating table '%s'...\n", tableName)
-		if err := repo.CreateTable(ctx); err != nil {
+		fmt.Printf("Creating table '%s' and waiting for it to become ACTIVE...\n", tableName)
+		config, err := createTableConfig(*tableConfig, tableSettings)
+		if err != nil {
+			log.Fatalf("Invalid table settings: %v", err)
+		}
+		if err := repo.CreateTable(ctx, config); err != nil {
 			log.Fatalf("Failed to create table: %v", err)
 		}
 		fmt.Println("Table created successfully!")
 		return
 	}
 
+	if *ensureTable {
+		fmt.Printf("Checking table '%s'...\n", tableName)
+		config, err := createTableConfig(*tableConfig, tableSettings)
+		if err != nil {
+			log.Fatalf("Invalid table settings: %v", err)
+		}
+		report, err := repo.EnsureTable(ctx, config)
+		if err != nil {
+			log.Fatalf("Failed to ensure table: %v", err)
+		}
+		if !printTableReport(report) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *deleteTable {
 		fmt.Printf("Deleting table '%s'...\n", tableName)
 		if err := repo.DeleteTable(ctx); err != nil {
@@ -69,33 +147,261 @@ func main() {
 
 	if *emptyTable {
 		fmt.Printf("Emptying table '%s'...\n", tableName)
-		if err := repo.EmptyTable(ctx); err != nil {
+		progress := startProgress("deleted")
+		err := repo.EmptyTable(ctx, *workers, progress.add)
+		progress.stop()
+		if err != nil {
 			log.Fatalf("Failed to empty table: %v", err)
 		}
 		fmt.Println("Table emptied successfully!")
 		return
 	}
 
-	// Start API server
-	api := NewAPI(repo)
-	r := setupRoutes(api)
+	if *exportFile != "" {
+		fmt.Printf("Exporting table '%s' to %s...\n", tableName, *exportFile)
+		progress := startProgress("exported")
+		err := exportTable(ctx, repo, *exportFile, *workers, progress.add)
+		progress.stop()
+		if err != nil {
+			log.Fatalf("Failed to export table: %v", err)
+		}
+		fmt.Println("Table exported successfully!")
+		return
+	}
 
-	fmt.Printf("Starting server on port %s...\n", *port)
+	if *importFile != "" {
+		fmt.Printf("Importing %s into table '%s'...\n", *importFile, tableName)
+		progress := startProgress("imported")
+		err := importTable(ctx, repo, *importFile, *workers, progress.add)
+		progress.stop()
+		if err != nil {
+			log.Fatalf("Failed to import table: %v", err)
+		}
+		fmt.Println("Table imported successfully!")
+		return
+	}
+
+	if *migrateStatus {
+		version, err := repo.SchemaVersion(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		fmt.Printf("Table '%s' is at schema version %d of %d\n", tableName, version, latestSchemaVersion())
+		for _, m := range migrations {
+			state := "pending"
+			if m.version <= version {
+				state = "applied"
+			}
+			fmt.Printf("  %3d  %-8s %s\n", m.version, state, m.description)
+		}
+		return
+	}
+
+	if *migrate {
+		version, err := repo.SchemaVersion(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		pending := pendingMigrations(version)
+		if len(pending) == 0 {
+			fmt.Printf("Table '%s' is up to date at schema version %d\n", tableName, version)
+			return
+		}
+		for _, m := range pending {
+			fmt.Printf("Applying migration %d: %s...\n", m.version, m.description)
+			progress := startProgress("rewrote")
+			err := repo.ApplyMigration(ctx, m, *workers, progress.add)
+			progress.stop()
+			if err != nil {
+				log.Fatalf("Failed to apply migration %d, run -migrate again to resume: %v", m.version, err)
+			}
+		}
+		fmt.Printf("Migration complete, table '%s' is at schema version %d\n", tableName, latestSchemaVersion())
+		return
+	}
+
+	// Start API server
 	fmt.Printf("Table: %s\n", tableName)
 	fmt.Printf("Region: %s\n", region)
+	if *endpoint != "" {
+		fmt.Printf("Endpoint: %s\n", *endpoint)
+	}
+	serve(NewAPI(repo), *port)
+}
+
+// tableFlags are the billing and capacity flags with the names of the flags
+// set on the command line
+type tableFlags struct {
+	billing       string
+	rcu, wcu      int64
+	indexCapacity string
+	scaleTarget   float64
+	scaleMin      int64
+	scaleMax      int64
+	set           map[string]bool
+}
+
+// createTableConfig reads the table config file, if any, and overrides it
+// with the billing and capacity flags given on the command line
+func createTableConfig(path string, flags tableFlags) (TableConfig, error) {
+	config := DefaultTableConfig()
+	if path != "" {
+		var err error
+		if config, err = LoadTableConfig(path); err != nil {
+			return config, err
+		}
+	}
+
+	if flags.set["billing"] {
+		config.Billing = flags.billing
+	}
+	if flags.set["rcu"] {
+		config.Table.Read = flags.rcu
+	}
+	if flags.set["wcu"] {
+		config.Table.Write = flags.wcu
+	}
+	if flags.set["index-capacity"] {
+		indexes, err := ParseIndexCapacity(flags.indexCapacity)
+		if err != nil {
+			return config, err
+		}
+		if config.Indexes == nil {
+			config.Indexes = make(map[string]Capacity)
+		}
+		maps.Copy(config.Indexes, indexes)
+	}
+
+	if flags.set["autoscale-target"] || flags.set["autoscale-min"] || flags.set["autoscale-max"] {
+		if config.AutoScaling == nil {
+			config.AutoScaling = &AutoScaling{}
+		}
+		if flags.set["autoscale-target"] {
+			config.AutoScaling.TargetUtilization = flags.scaleTarget
+		}
+		if flags.set["autoscale-min"] {
+			config.AutoScaling.MinCapacity = flags.scaleMin
+		}
+		if flags.set["autoscale-max"] {
+			config.AutoScaling.MaxCapacity = flags.scaleMax
+		}
+	}
+	return config, nil
+}
+
+// printTableReport prints what -ensure-table did and found, reporting
+// whether the table now matches its definition
+func printTableReport(report TableReport) bool {
+	if report.Created {
+		fmt.Println("Table created")
+	}
+	for _, name := range report.AddedIndexes {
+		fmt.Printf("Added GSI %s\n", name)
+	}
+	for _, note := range report.Notes {
+		fmt.Printf("Note: %s\n", note)
+	}
+	for _, problem := range report.Unfixable {
+		fmt.Printf("Cannot fix: %s\n", problem)
+	}
+
+	if len(report.Unfixable) > 0 {
+		return false
+	}
+	if !report.Created && len(report.AddedIndexes) == 0 {
+		fmt.Println("Table matches its definition")
+	}
+	return true
+}
+
+// exportTable writes the table to path, gzipped if it ends in .gz. The export
+// is written to a temporary file next to path and renamed over it once
+// complete, so a failed export leaves no partial file behind.
+func exportTable(ctx context.Context, repo *Repository, path string, workers int, exported func(n int)) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	var w io.Writer = file
+	var zw *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		zw = gzip.NewWriter(file)
+		w = zw
+	}
+
+	if err := repo.ExportTable(ctx, w, workers, exported); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// importTable reads an export from path, gunzipping it if it ends in .gz
+func importTable(ctx context.Context, repo *Repository, path string, workers int, imported func(n int)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	return repo.ImportTable(ctx, r, workers, imported)
+}
+
+func serve(api *API, port string) {
+	r := setupRoutes(api)
+
+	fmt.Printf("Starting server on port %s...\n", port)
 	fmt.Println("\nAPI Endpoints:")
 	fmt.Println("POST   /users              - Create user")
 	fmt.Println("GET    /users/{username}   - Get user profile")
-	fmt.Println("PUT    /users/{username}   - Update user profile")
+	fmt.Println("PUT    /users/{username}   - Create or replace user profile")
+	fmt.Println("PATCH  /users/{username}   - Merge patch user profile")
+	fmt.Println("DELETE /users/{username}   - Delete user, orders and items (?force=true for open orders)")
+	fmt.Println("GET    /users/{username}/addresses/{key} - Get address")
+	fmt.Println("PUT    /users/{username}/addresses/{key} - Add or replace address")
+	fmt.Println("DELETE /users/{username}/addresses/{key} - Remove address")
 	fmt.Println("POST   /orders             - Create order")
 	fmt.Println("GET    /orders/{orderid}   - Get order by ID")
 	fmt.Println("GET    /users/{username}/orders - Get user's orders")
+	fmt.Println("GET    /users/{username}/orders?status=&from=&to= - Get user's orders by status and date")
 	fmt.Println("PUT    /orders/{orderid}/status - Update order status")
+	fmt.Println("PUT    /orders/{orderid}/address - Change shipping address")
 	fmt.Println("POST   /orders/{orderid}/items - Add item to order")
 	fmt.Println("GET    /orders/{orderid}/items - Get order items")
+	fmt.Println("PUT    /orders/{orderid}/items/{itemid} - Update order item")
+	fmt.Println("DELETE /orders/{orderid}/items/{itemid} - Remove order item")
 	fmt.Println("GET    /orders/pending     - Get all pending orders")
+	fmt.Println("POST   /products           - Create product")
+	fmt.Println("GET    /products           - List products")
+	fmt.Println("GET    /products/{sku}     - Get product")
+	fmt.Println("PUT    /products/{sku}     - Update product")
+	fmt.Println("DELETE /products/{sku}     - Delete product")
 
-	log.Fatal(http.ListenAndServe(":"+*port, r))
+	log.Fatal(http.ListenAndServe(":"+port, r))
 }
 
 func setupRoutes(api *API) *chi.Mux {
@@ -109,18 +415,33 @@ func setupRoutes(api *API) *chi.Mux {
 	// User routes
 	r.Post("/users", api.CreateUser)
 	r.Get("/users/{username}", api.GetUser)
-	r.Put("/users/{username}", api.UpdateUser)
+	r.Put("/users/{username}", api.PutUser)
+	r.Patch("/users/{username}", api.PatchUser)
+	r.Delete("/users/{username}", api.DeleteUser)
 	r.Get("/users/{username}/orders", api.GetUserOrders)
+	r.Get("/users/{username}/addresses/{key}", api.GetAddress)
+	r.Put("/users/{username}/addresses/{key}", api.PutAddress)
+	r.Delete("/users/{username}/addresses/{key}", api.DeleteAddress)
 
 	// Order routes
 	r.Post("/orders", api.CreateOrder)
 	r.Get("/orders/{orderid}", api.GetOrder)
 	r.Put("/orders/{orderid}/status", api.UpdateOrderStatus)
+	r.Put("/orders/{orderid}/address", api.UpdateOrderAddress)
 	r.Get("/orders/pending", api.GetPendingOrders)
 
+	// Product routes
+	r.Post("/products", api.CreateProduct)
+	r.Get("/products", api.ListProducts)
+	r.Get("/products/{sku}", api.GetProduct)
+	r.Put("/products/{sku}", api.UpdateProduct)
+	r.Delete("/products/{sku}", api.DeleteProduct)
+
 	// Order item routes
 	r.Post("/orders/{orderid}/items", api.CreateOrderItem)
 	r.Get("/orders/{orderid}/items", api.GetOrderItems)
+	r.Put("/orders/{orderid}/items/{itemid}", api.UpdateOrderItem)
+	r.Delete("/orders/{orderid}/items/{itemid}", api.DeleteOrderItem)
 
 	return r
 }
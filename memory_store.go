@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MemoryStore is an in-process Store used for local development and tests.
+// It mirrors the access patterns of the DynamoDB table: orders are listed
+// newest sort key first like the main table query, lookups by order ID
+// behave like the inverted-index and only pending orders show up in the
+// placed-index query.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	users    map[string]User
+	orders   map[string]memoryOrder
+	items    map[string]map[string]OrderItem
+	products map[string]Product
+}
+
+// memoryOrder keeps the attributes the table stores alongside an order
+type memoryOrder struct {
+	Order
+	statusDate string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:    make(map[string]User),
+		orders:   make(map[string]memoryOrder),
+		items:    make(map[string]map[string]OrderItem),
+		products: make(map[string]Product),
+	}
+}
+
+func copyUser(user User) User {
+	user.Addresses = maps.Clone(user.Addresses)
+	return user
+}
+
+// User Operations
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user.Username]; ok {
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Username)
+	}
+	user.Version = 1
+	m.users[user.Username] = copyUser(*user)
+	return nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	user = copyUser(user)
+	return &user, nil
+}
+
+func (m *MemoryStore) ReplaceUser(ctx context.Context, user *User, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.users[user.Username]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, user.Username)
+	}
+	if version != anyVersion && current.Version != version {
+		return fmt.Errorf("%w: user %s", ErrVersionMismatch, user.Username)
+	}
+
+	user.Version = current.Version + 1
+	m.users[user.Username] = copyUser(*user)
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, username string, patch UserPatch, version int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.users[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if version != anyVersion && current.Version != version {
+		return nil, fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+	}
+
+	updated, err := patch.apply(copyUser(current))
+	if err != nil {
+		return nil, err
+	}
+	updated.Version++
+	m.users[username] = copyUser(updated)
+	return &updated, nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, username string, force bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[username]; !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	var orders []memoryOrder
+	var open int
+	for _, order := range m.orders {
+		if order.UserID != username {
+			continue
+		}
+		orders = append(orders, order)
+		if !order.Status.Terminal() {
+			open++
+		}
+	}
+	if open > 0 && !force {
+		return fmt.Errorf("%w: %s has %d not delivered or cancelled", ErrUserHasOpenOrders, username, open)
+	}
+
+	for _, order := range orders {
+		// Orders that have not shipped give their stock back, skipping
+		// products removed from the catalog
+		if order.Status.ItemsEditable() {
+			for _, item := range m.items[order.ID] {
+				if product, ok := m.products[item.SKU]; ok {
+					product.Stock += item.Quantity
+					m.products[item.SKU] = product
+				}
+			}
+		}
+		delete(m.items, order.ID)
+		delete(m.orders, order.ID)
+	}
+	delete(m.users, username)
+	return nil
+}
+
+func (m *MemoryStore) DeleteAddress(ctx context.Context, username, addressKey string, version int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.users[username]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if version != anyVersion && current.Version != version {
+		return fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+	}
+	if _, ok := current.Addresses[addressKey]; !ok {
+		return fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, username, addressKey)
+	}
+	for _, order := range m.orders {
+		if order.UserID == username && order.AddressKey == addressKey && !order.Status.Terminal() {
+			return fmt.Errorf("%w: %s", ErrAddressInUse, addressKey)
+		}
+	}
+
+	updated, err := removeAddress(addressKey).apply(copyUser(current))
+	if err != nil {
+		return err
+	}
+	updated.Version++
+	m.users[username] = updated
+	return nil
+}
+
+// Order Operations
+
+func (m *MemoryStore) CreateOrder(ctx context.Context, order *Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	address, err := m.useAddress(order.UserID, order.AddressKey)
+	if err != nil {
+		return err
+	}
+
+	order.ShippingAddress = address
+
+	order.Version = 1
+	m.orders[order.ID] = memoryOrder{
+		Order:      *order,
+		statusDate: statusDate(order.Status, order.CreatedAt),
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetOrderByID(ctx context.Context, orderID string) (*Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	order, ok := m.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	return &order.Order, nil
+}
+
+func (m *MemoryStore) GetOrdersByUserID(ctx context.Context, userID string, page PageRequest) (Page[*Order], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []memoryOrder
+	for _, order := range m.orders {
+		if order.UserID == userID {
+			orders = append(orders, order)
+		}
+	}
+
+	// The table query runs with ScanIndexForward=false
+	result, err := memoryQuery(orders, memoryOrder.tableKey, []string{"sk"}, true, "user-orders:"+userID, page)
+	return orderPage(result), err
+}
+
+func (m *MemoryStore) GetUserOrdersByStatus(ctx context.Context, userID string, status OrderStatus, from, to time.Time, page PageRequest) (Page[*Order], error) {
+	if !status.Valid() {
+		return Page[*Order]{}, fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+	}
+	if to.IsZero() {
+		to = maxStatusDate
+	}
+	lower, upper := statusDate(status, from), statusDate(status, to)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []memoryOrder
+	for _, order := range m.orders {
+		if order.UserID == userID && order.statusDate >= lower && order.statusDate <= upper {
+			orders = append(orders, order)
+		}
+	}
+
+	// LSI order: status_date, then the table sort key
+	keyOf := func(order memoryOrder) map[string]string {
+		key := order.tableKey()
+		key["status_date"] = order.statusDate
+		return key
+	}
+	scope := fmt.Sprintf("user-orders:%s:%s:%s", userID, lower, upper)
+	result, err := memoryQuery(orders, keyOf, []string{"status_date", "sk"}, false, scope, page)
+	return orderPage(result), err
+}
+
+func (m *MemoryStore) UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus, version int64) (*Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !status.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+	}
+
+	order, ok := m.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	if version != anyVersion && order.Version != version {
+		return nil, fmt.Errorf("%w: order %s is at version %d", ErrVersionMismatch, orderID, order.Version)
+	}
+	if !order.Status.CanTransitionTo(status) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, order.Status, status)
+	}
+	if status == OrderStatusCancelled {
+		// Return the reserved stock, skipping products removed from the catalog
+		for _, item := range m.items[orderID] {
+			if product, ok := m.products[item.SKU]; ok {
+				product.Stock += item.Quantity
+				m.products[item.SKU] = product
+			}
+		}
+	}
+
+	order.Status = status
+	order.Version++
+	order.UpdatedAt = time.Now()
+	order.statusDate = statusDate(status, order.UpdatedAt)
+	m.orders[orderID] = order
+
+	updated := order.Order
+	return &updated, nil
+}
+
+func (m *MemoryStore) UpdateOrderAddress(ctx context.Context, orderID, addressKey string, version int64) (*Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	if version != anyVersion && order.Version != version {
+		return nil, fmt.Errorf("%w: order %s is at version %d", ErrVersionMismatch, orderID, order.Version)
+	}
+	if !order.Status.ItemsEditable() {
+		return nil, fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+
+	address, err := m.useAddress(order.UserID, addressKey)
+	if err != nil {
+		return nil, err
+	}
+
+	order.AddressKey = addressKey
+	order.ShippingAddress = address
+	order.Version++
+	order.UpdatedAt = time.Now()
+	m.orders[orderID] = order
+
+	updated := order.Order
+	return &updated, nil
+}
+
+// useAddress returns a copy of one of a user's addresses for an order. It
+// must be called with the lock held.
+func (m *MemoryStore) useAddress(username, addressKey string) (*Address, error) {
+	user, ok := m.users[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	address, ok := user.Addresses[addressKey]
+	if !ok {
+		return nil, fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, username, addressKey)
+	}
+	return &address, nil
+}
+
+func (m *MemoryStore) GetPendingOrders(ctx context.Context, page PageRequest) (Page[*Order], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []memoryOrder
+	for _, order := range m.orders {
+		// placed_id = "pending"
+		if order.Status == OrderStatusPending {
+			orders = append(orders, order)
+		}
+	}
+
+	keyOf := func(order memoryOrder) map[string]string {
+		key := order.tableKey()
+		key["placed_id"] = string(order.Status)
+		return key
+	}
+	result, err := memoryQuery(orders, keyOf, []string{"pk", "sk"}, false, "pending-orders", page)
+	return orderPage(result), err
+}
+
+// Product Operations
+
+func (m *MemoryStore) CreateProduct(ctx context.Context, product Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.products[product.SKU]; ok {
+		return fmt.Errorf("%w: %s", ErrProductExists, product.SKU)
+	}
+	m.products[product.SKU] = product
+	return nil
+}
+
+func (m *MemoryStore) GetProduct(ctx context.Context, sku string) (*Product, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	product, ok := m.products[sku]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+	return &product, nil
+}
+
+func (m *MemoryStore) ListProducts(ctx context.Context, page PageRequest) (Page[Product], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	products := slices.Collect(maps.Values(m.products))
+	keyOf := func(product Product) map[string]string {
+		return map[string]string{"pk": productPK(product.SKU), "sk": productSK}
+	}
+	return memoryQuery(products, keyOf, []string{"pk"}, false, "products", page)
+}
+
+func (m *MemoryStore) UpdateProduct(ctx context.Context, sku string, update ProductUpdate) (*Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	product, ok := m.products[sku]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+	if product.Stock+update.StockAdjustment < 0 {
+		return nil, &InsufficientStockError{SKU: sku, Requested: -update.StockAdjustment, Available: product.Stock}
+	}
+
+	product.Name = update.Name
+	product.Description = update.Description
+	product.UnitPrice = update.UnitPrice
+	product.Currency = update.Currency
+	product.Stock += update.StockAdjustment
+	m.products[sku] = product
+	return &product, nil
+}
+
+func (m *MemoryStore) DeleteProduct(ctx context.Context, sku string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.products[sku]; !ok {
+		return fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+	delete(m.products, sku)
+	return nil
+}
+
+// Order Item Operations
+
+func (m *MemoryStore) CreateOrderItem(ctx context.Context, orderID string, item *OrderItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[orderID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	if !order.Status.ItemsEditable() {
+		return fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+	if len(m.items[orderID]) >= maxOrderLines {
+		return fmt.Errorf("%w: order %s already has %d items", ErrOrderFull, orderID, maxOrderLines)
+	}
+
+	product, ok := m.products[item.SKU]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrProductNotFound, item.SKU)
+	}
+	if err := checkCurrency(&order.Order, &product); err != nil {
+		return err
+	}
+	if product.Stock < item.Quantity {
+		return &InsufficientStockError{SKU: item.SKU, Requested: item.Quantity, Available: product.Stock}
+	}
+	product.Stock -= item.Quantity
+	m.products[item.SKU] = product
+
+	item.Name = product.Name
+	item.Price = product.UnitPrice
+	item.Currency = currencyOrDefault(product.Currency)
+	if item.Description == "" {
+		item.Description = product.Description
+	}
+
+	if m.items[orderID] == nil {
+		m.items[orderID] = make(map[string]OrderItem)
+	}
+	m.items[orderID][item.ItemID] = *item
+	m.addToTotals(orderID, item.Quantity, item.Price.Mul(item.Quantity))
+	return nil
+}
+
+func (m *MemoryStore) GetOrderItems(ctx context.Context, orderID string, page PageRequest) (Page[OrderItem], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var items []OrderItem
+	for _, item := range m.items[orderID] {
+		items = append(items, item)
+	}
+
+	keyOf := func(item OrderItem) map[string]string {
+		return map[string]string{"pk": orderPK(orderID), "sk": itemSK(item.ItemID)}
+	}
+	return memoryQuery(items, keyOf, []string{"sk"}, false, "order-items:"+orderID, page)
+}
+
+func (m *MemoryStore) UpdateOrderItem(ctx context.Context, orderID, itemID string, update OrderItemUpdate) (*OrderItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.editableOrderItem(orderID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Quantity != nil {
+		delta := *update.Quantity - item.Quantity
+		if product, ok := m.products[item.SKU]; ok {
+			if product.Stock < delta {
+				return nil, &InsufficientStockError{SKU: item.SKU, Requested: delta, Available: product.Stock}
+			}
+			product.Stock -= delta
+			m.products[item.SKU] = product
+		} else if delta > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrProductNotFound, item.SKU)
+		}
+		m.addToTotals(orderID, delta, item.Price.Mul(delta))
+		item.Quantity = *update.Quantity
+	}
+	if update.Description != nil {
+		item.Description = *update.Description
+	}
+
+	m.items[orderID][itemID] = item
+	return &item, nil
+}
+
+func (m *MemoryStore) DeleteOrderItem(ctx context.Context, orderID, itemID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.editableOrderItem(orderID, itemID)
+	if err != nil {
+		return err
+	}
+
+	if product, ok := m.products[item.SKU]; ok {
+		product.Stock += item.Quantity
+		m.products[item.SKU] = product
+	}
+	delete(m.items[orderID], itemID)
+	m.addToTotals(orderID, -item.Quantity, -item.Price.Mul(item.Quantity))
+	return nil
+}
+
+// addToTotals must be called with the lock held
+func (m *MemoryStore) addToTotals(orderID string, quantity int, amount Amount) {
+	order := m.orders[orderID]
+	order.ItemCount += quantity
+	order.Subtotal += amount
+	order.Version++
+	order.UpdatedAt = time.Now()
+	m.orders[orderID] = order
+}
+
+// editableOrderItem must be called with the lock held
+func (m *MemoryStore) editableOrderItem(orderID, itemID string) (OrderItem, error) {
+	order, ok := m.orders[orderID]
+	if !ok {
+		return OrderItem{}, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	if !order.Status.ItemsEditable() {
+		return OrderItem{}, fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+
+	item, ok := m.items[orderID][itemID]
+	if !ok {
+		return OrderItem{}, fmt.Errorf("%w: %s", ErrItemNotFound, itemID)
+	}
+	return item, nil
+}
+
+func (o memoryOrder) tableKey() map[string]string {
+	return map[string]string{"pk": userPK(o.UserID), "sk": orderSK(o.ID)}
+}
+
+func orderPage(page Page[memoryOrder]) Page[*Order] {
+	orders := Page[*Order]{NextCursor: page.NextCursor}
+	for _, order := range page.Items {
+		orders.Items = append(orders.Items, &order.Order)
+	}
+	return orders
+}
+
+// memoryQuery sorts rows on the given key attributes the way the matching
+// DynamoDB query would and returns the page after the cursor. keyOf returns
+// the attributes DynamoDB would put in LastEvaluatedKey.
+func memoryQuery[T any](rows []T, keyOf func(T) map[string]string, orderBy []string, descending bool, scope string, page PageRequest) (Page[T], error) {
+	startKey, err := decodeCursor(scope, page.Cursor)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	compare := func(a, b map[string]string) int {
+		for _, attr := range orderBy {
+			if c := strings.Compare(a[attr], b[attr]); c != 0 {
+				if descending {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compare(keyOf(rows[i]), keyOf(rows[j])) < 0
+	})
+
+	start := 0
+	if startKey != nil {
+		after := make(map[string]string, len(startKey))
+		for name, value := range startKey {
+			if s, ok := value.(*types.AttributeValueMemberS); ok {
+				after[name] = s.Value
+			}
+		}
+		start = sort.Search(len(rows), func(i int) bool {
+			return compare(keyOf(rows[i]), after) > 0
+		})
+	}
+	end := min(start+int(page.limit()), len(rows))
+
+	var result Page[T]
+	if start < end {
+		result.Items = rows[start:end]
+	}
+	if end < len(rows) {
+		lastKey := make(map[string]types.AttributeValue)
+		for name, value := range keyOf(rows[end-1]) {
+			lastKey[name] = &types.AttributeValueMemberS{Value: value}
+		}
+		if result.NextCursor, err = encodeCursor(scope, lastKey); err != nil {
+			return Page[T]{}, err
+		}
+	}
+	return result, nil
+}
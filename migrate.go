@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// migration is one numbered step of the table layout. Steps scan the whole
+// table and rewrite the rows that need it.
+type migration struct {
+	version     int
+	description string
+
+	// rewrite is called for every row and reports whether it changed the
+	// row. It must leave rows that already have the change alone, so an
+	// interrupted step can simply run again.
+	rewrite func(r *Repository, ctx context.Context, item map[string]types.AttributeValue) (bool, error)
+}
+
+// migrations are applied in order. Append new steps, never change or reorder
+// steps that have been released.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Store prices as exact amounts with a currency",
+		rewrite:     (*Repository).migrateMoney,
+	},
+}
+
+// latestSchemaVersion is the version of a table with every migration applied
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// pendingMigrations returns the steps after version
+func pendingMigrations(version int) []migration {
+	for i, m := range migrations {
+		if m.version > version {
+			return migrations[i:]
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the last migration applied to the table, 0 for a
+// table that has never been migrated
+func (r *Repository) SchemaVersion(ctx context.Context) (int, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.tableName),
+		Key:            schemaKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	version, ok := result.Item["version"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(version.Value)
+}
+
+// ApplyMigration runs one step over every row, scanning with the given
+// number of workers, and then records it as applied. rewritten is called for
+// each row the step changed. The version is only recorded once the whole
+// table has been rewritten, so after an interruption the step runs again.
+func (r *Repository) ApplyMigration(ctx context.Context, m migration, workers int, rewritten func(n int)) error {
+	err := r.parallelScan(ctx, workers, dynamodb.ScanInput{}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			if pk, _ := item["pk"].(*types.AttributeValueMemberS); pk != nil && pk.Value == metaPK {
+				continue
+			}
+
+			changed, err := m.rewrite(r, ctx, item)
+			if err != nil {
+				return fmt.Errorf("migration %d: %w", m.version, err)
+			}
+			if changed && rewritten != nil {
+				rewritten(1)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only move on from the previous step, so two runs at once cannot skip
+	// or repeat a version
+	condition := "attribute_not_exists(pk)"
+	values := map[string]types.AttributeValue{
+		":version":    &types.AttributeValueMemberN{Value: strconv.Itoa(m.version)},
+		":updated_at": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+	}
+	if m.version > 1 {
+		condition = "#version = :previous"
+		values[":previous"] = &types.AttributeValueMemberN{Value: strconv.Itoa(m.version - 1)}
+	}
+
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       schemaKey(),
+		UpdateExpression:          aws.String("SET #version = :version, updated_at = :updated_at"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]string{"#version": "version"},
+		ExpressionAttributeValues: values,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("migration %d: table is no longer at version %d, was another migration running?", m.version, m.version-1)
+	}
+	return err
+}
+
+// markSchemaCurrent records a newly created table as having every migration
+// applied, since it has never held rows in an older layout
+func (r *Repository) markSchemaCurrent(ctx context.Context) error {
+	item := schemaKey()
+	item["version"] = &types.AttributeValueMemberN{Value: strconv.Itoa(latestSchemaVersion())}
+	item["updated_at"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+	return err
+}
+
+func schemaKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: metaPK},
+		"sk": &types.AttributeValueMemberS{Value: schemaSK},
+	}
+}
+
+// migrateMoney rewrites prices stored while money was a float64, such as
+// 3899.9700000000003, as exact two decimal amounts and fills in the currency
+// of rows that have none
+func (r *Repository) migrateMoney(ctx context.Context, item map[string]types.AttributeValue) (bool, error) {
+	sk, _ := item["sk"].(*types.AttributeValueMemberS)
+	if sk == nil {
+		return false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(sk.Value, itemPrefix):
+		return r.migrateAmount(ctx, item, "price")
+	case sk.Value == productSK:
+		return r.migrateAmount(ctx, item, "unit_price")
+	case strings.HasPrefix(sk.Value, orderPrefix):
+		return r.migrateAmount(ctx, item, "subtotal")
+	}
+	return false, nil
+}
+
+func (r *Repository) migrateAmount(ctx context.Context, item map[string]types.AttributeValue, attribute string) (bool, error) {
+	current, _ := item[attribute].(*types.AttributeValueMemberN)
+	_, hasCurrency := item["currency"]
+
+	var exact bool
+	if current != nil {
+		_, err := ParseAmount(current.Value)
+		exact = err == nil
+	}
+	if (current == nil || exact) && hasCurrency {
+		return false, nil
+	}
+
+	updateExpression := "SET currency = if_not_exists(currency, :currency)"
+	conditionExpression := "attribute_not_exists(#amount)"
+	values := map[string]types.AttributeValue{
+		":currency": &types.AttributeValueMemberS{Value: defaultCurrency},
+	}
+	if current != nil {
+		amount, err := roundAmount(current.Value)
+		if err != nil {
+			return false, err
+		}
+		updateExpression += ", #amount = :amount"
+		// Leave rows alone that changed since the scan read them
+		conditionExpression = "#amount = :previous"
+		values[":amount"] = &types.AttributeValueMemberN{Value: amount.String()}
+		values[":previous"] = current
+	}
+
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": item["pk"],
+			"sk": item["sk"],
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String(conditionExpression),
+		ExpressionAttributeNames:  map[string]string{"#amount": attribute},
+		ExpressionAttributeValues: values,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestNewTableIsAtLatestVersion(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	if version, err := repo.SchemaVersion(ctx); err != nil || version != latestSchemaVersion() {
+		t.Errorf("SchemaVersion after CreateTable = %d, %v; want %d", version, err, latestSchemaVersion())
+	}
+
+	if err := repo.DeleteTable(ctx); err != nil {
+		t.Fatalf("DeleteTable: %v", err)
+	}
+	report, err := repo.EnsureTable(ctx, DefaultTableConfig())
+	if err != nil || !report.Created {
+		t.Fatalf("EnsureTable = %+v, %v; want the table created", report, err)
+	}
+	if version, err := repo.SchemaVersion(ctx); err != nil || version != latestSchemaVersion() {
+		t.Errorf("SchemaVersion after EnsureTable = %d, %v; want %d", version, err, latestSchemaVersion())
+	}
+}
+
+func TestMigrateMoney(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	// A table from before migrations has float prices and no schema row
+	if _, err := repo.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(repo.tableName),
+		Key:       schemaKey(),
+	}); err != nil {
+		t.Fatalf("removing the schema row: %v", err)
+	}
+	for _, item := range []map[string]types.AttributeValue{
+		{
+			"pk":         &types.AttributeValueMemberS{Value: productPK("LAPTOP-01")},
+			"sk":         &types.AttributeValueMemberS{Value: productSK},
+			"sku":        &types.AttributeValueMemberS{Value: "LAPTOP-01"},
+			"name":       &types.AttributeValueMemberS{Value: "Laptop"},
+			"unit_price": &types.AttributeValueMemberN{Value: "1299.9900000000002"},
+			"stock":      &types.AttributeValueMemberN{Value: "5"},
+		},
+		{
+			"pk":         &types.AttributeValueMemberS{Value: productPK("MOUSE-01")},
+			"sk":         &types.AttributeValueMemberS{Value: productSK},
+			"sku":        &types.AttributeValueMemberS{Value: "MOUSE-01"},
+			"name":       &types.AttributeValueMemberS{Value: "Mouse"},
+			"unit_price": &types.AttributeValueMemberN{Value: "19.99"},
+			"currency":   &types.AttributeValueMemberS{Value: "EUR"},
+			"stock":      &types.AttributeValueMemberN{Value: "5"},
+		},
+	} {
+		if _, err := repo.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(repo.tableName),
+			Item:      item,
+		}); err != nil {
+			t.Fatalf("writing an old product: %v", err)
+		}
+	}
+	if version, err := repo.SchemaVersion(ctx); err != nil || version != 0 {
+		t.Fatalf("SchemaVersion of an old table = %d, %v; want 0", version, err)
+	}
+
+	var rewritten atomic.Int64
+	count := func(n int) { rewritten.Add(int64(n)) }
+	for _, m := range pendingMigrations(0) {
+		if err := repo.ApplyMigration(ctx, m, 2, count); err != nil {
+			t.Fatalf("ApplyMigration(%d): %v", m.version, err)
+		}
+	}
+	if rewritten.Load() != 1 {
+		t.Errorf("rewrote %d rows, want 1", rewritten.Load())
+	}
+	if version, err := repo.SchemaVersion(ctx); err != nil || version != latestSchemaVersion() {
+		t.Errorf("SchemaVersion after migrating = %d, %v; want %d", version, err, latestSchemaVersion())
+	}
+
+	laptop, err := repo.GetProduct(ctx, "LAPTOP-01")
+	if err != nil {
+		t.Fatalf("GetProduct: %v", err)
+	}
+	if laptop.UnitPrice != 129999 || laptop.Currency != defaultCurrency {
+		t.Errorf("migrated laptop costs %s %s, want 1299.99 %s", laptop.UnitPrice, laptop.Currency, defaultCurrency)
+	}
+	mouse, err := repo.GetProduct(ctx, "MOUSE-01")
+	if err != nil {
+		t.Fatalf("GetProduct: %v", err)
+	}
+	if mouse.UnitPrice != 1999 || mouse.Currency != "EUR" {
+		t.Errorf("untouched mouse costs %s %s, want 19.99 EUR", mouse.UnitPrice, mouse.Currency)
+	}
+
+	// Running a step again changes nothing, and the version stays put
+	rewritten.Store(0)
+	if err := repo.ApplyMigration(ctx, migrations[0], 2, count); err == nil {
+		t.Error("applying migration 1 twice was recorded")
+	}
+	if rewritten.Load() != 0 {
+		t.Errorf("the second run rewrote %d rows, want 0", rewritten.Load())
+	}
+}
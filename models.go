@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
 
 type OrderStatus string
 
@@ -12,33 +17,197 @@ const (
 	OrderStatusCancelled OrderStatus = "cancelled"
 )
 
+// orderTransitions is the order lifecycle: pending -> confirmed -> shipped ->
+// delivered, with cancellation allowed until the order has shipped
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:   {OrderStatusConfirmed, OrderStatusCancelled},
+	OrderStatusConfirmed: {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:   {OrderStatusDelivered},
+}
+
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusPending, OrderStatusConfirmed, OrderStatusShipped,
+		OrderStatusDelivered, OrderStatusCancelled:
+		return true
+	}
+	return false
+}
+
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	return slices.Contains(orderTransitions[s], next)
+}
+
+// Terminal reports whether the order is finished, after which nothing about
+// it changes any more
+func (s OrderStatus) Terminal() bool {
+	return s == OrderStatusDelivered || s == OrderStatusCancelled
+}
+
+// ItemsEditable reports whether items may still be changed or removed, which
+// stops once an order has shipped or been cancelled
+func (s OrderStatus) ItemsEditable() bool {
+	return s == OrderStatusPending || s == OrderStatusConfirmed
+}
+
 type Address struct {
 	Street  string `json:"street" dynamodbav:"street"`
 	State   string `json:"state,omitempty" dynamodbav:"state,omitempty"`
 	Country string `json:"country" dynamodbav:"country"`
 }
 
+func (a Address) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("street", required(a.Street), maxLength(a.Street, 200))
+	errs.check("state", maxLength(a.State, 100))
+	errs.check("country", required(a.Country), maxLength(a.Country, 100))
+	return errs
+}
+
+// User is a profile row. DefaultAddress is the key of one of Addresses.
+// Version goes up with every write, rows written before versions existed read
+// as version 0.
 type User struct {
-	Username  string             `json:"username" dynamodbav:"-"`
-	FullName  string             `json:"full_name,omitempty" dynamodbav:"full_name,omitempty"`
-	Email     string             `json:"email,omitempty" dynamodbav:"email,omitempty"`
-	Addresses map[string]Address `json:"addresses,omitempty" dynamodbav:"addresses,omitempty"`
+	Username       string             `json:"username" dynamodbav:"-"`
+	FullName       string             `json:"full_name,omitempty" dynamodbav:"full_name,omitempty"`
+	Email          string             `json:"email,omitempty" dynamodbav:"email,omitempty"`
+	Addresses      map[string]Address `json:"addresses,omitempty" dynamodbav:"addresses,omitempty"`
+	DefaultAddress string             `json:"default_address,omitempty" dynamodbav:"default_address,omitempty"`
+	Version        int64              `json:"version" dynamodbav:"version"`
+}
+
+func (u User) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("username", required(u.Username), maxLength(u.Username, 64))
+	errs.check("full_name", maxLength(u.FullName, 200))
+	errs.check("email", email(u.Email))
+	for _, key := range slices.Sorted(maps.Keys(u.Addresses)) {
+		errs.nested("addresses."+key, u.Addresses[key])
+	}
+	if _, ok := u.Addresses[u.DefaultAddress]; u.DefaultAddress != "" && !ok {
+		errs.check("default_address", "is not one of the user's addresses")
+	}
+	return errs
+}
+
+// AddressEntry is one address of a user's address book as served by the
+// address endpoints
+type AddressEntry struct {
+	Key string `json:"key"`
+	Address
+	Default bool `json:"default"`
 }
 
+// defaultCurrency is used for orders and products created without one
+const defaultCurrency = "USD"
+
+func currencyOrDefault(currency string) string {
+	if currency == "" {
+		return defaultCurrency
+	}
+	return currency
+}
+
+// checkCurrency makes sure a product can be added to an order. Rows written
+// before currencies existed are in the default currency.
+func checkCurrency(order *Order, product *Product) error {
+	orderCurrency, productCurrency := currencyOrDefault(order.Currency), currencyOrDefault(product.Currency)
+	if orderCurrency != productCurrency {
+		return fmt.Errorf("%w: %s is priced in %s, order is in %s", ErrCurrencyMismatch, product.SKU, productCurrency, orderCurrency)
+	}
+	return nil
+}
+
+// Order is an order header. ItemCount (total units) and Subtotal are kept up
+// to date as items are added, changed and removed. Version goes up with every
+// write, including the total updates.
+//
+// ShippingAddress is a copy of the user's address taken when the order was
+// placed, so later edits to the address book do not change where it ships.
+// Orders placed before addresses were copied only have AddressKey.
 type Order struct {
-	ID         string      `json:"id" dynamodbav:"order_id"`
-	UserID     string      `json:"user_id" dynamodbav:"user_id"`
-	Status     OrderStatus `json:"status" dynamodbav:"status"`
-	AddressKey string      `json:"address_key" dynamodbav:"address_key"`
-	CreatedAt  time.Time   `json:"created_at" dynamodbav:"created_at"`
-	UpdatedAt  time.Time   `json:"updated_at" dynamodbav:"updated_at"`
+	ID              string      `json:"id" dynamodbav:"order_id"`
+	UserID          string      `json:"user_id" dynamodbav:"user_id"`
+	Status          OrderStatus `json:"status" dynamodbav:"status"`
+	AddressKey      string      `json:"address_key" dynamodbav:"address_key"`
+	ShippingAddress *Address    `json:"shipping_address,omitempty" dynamodbav:"shipping_address,omitempty"`
+	ItemCount       int         `json:"item_count" dynamodbav:"item_count"`
+	Subtotal        Amount      `json:"subtotal" dynamodbav:"subtotal"`
+	Currency        string      `json:"currency" dynamodbav:"currency"`
+	Version         int64       `json:"version" dynamodbav:"version"`
+	CreatedAt       time.Time   `json:"created_at" dynamodbav:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at" dynamodbav:"updated_at"`
+}
+
+type Product struct {
+	SKU         string `json:"sku" dynamodbav:"sku"`
+	Name        string `json:"name" dynamodbav:"name"`
+	Description string `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	UnitPrice   Amount `json:"unit_price" dynamodbav:"unit_price"`
+	Currency    string `json:"currency" dynamodbav:"currency"`
+	Stock       int    `json:"stock" dynamodbav:"stock"`
+}
+
+func (p Product) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("sku", required(p.SKU), maxLength(p.SKU, 64))
+	errs.check("name", required(p.Name), maxLength(p.Name, 200))
+	errs.check("description", maxLength(p.Description, 2000))
+	errs.check("unit_price", notNegative(p.UnitPrice))
+	errs.check("currency", currency(p.Currency))
+	errs.check("stock", atLeast(p.Stock, 0))
+	return errs
 }
 
+// ProductUpdate replaces the catalog entry of a product. Stock is not
+// replaced, since orders reserve it concurrently; StockAdjustment is added to
+// it instead, taking stock away when negative. Stock is only there to reject
+// requests that try to set it.
+type ProductUpdate struct {
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	UnitPrice       Amount `json:"unit_price"`
+	Currency        string `json:"currency"`
+	StockAdjustment int    `json:"stock_adjustment"`
+	Stock           *int   `json:"stock"`
+}
+
+func (u ProductUpdate) Validate() []FieldError {
+	var errs fieldErrors
+	errs.check("name", required(u.Name), maxLength(u.Name, 200))
+	errs.check("description", maxLength(u.Description, 2000))
+	errs.check("unit_price", notNegative(u.UnitPrice))
+	errs.check("currency", currency(u.Currency))
+	return errs
+}
+
+// OrderItem is a line on an order. Name, Price and Currency are copied from
+// the product catalog when the item is added.
 type OrderItem struct {
-	OrderID     string  `json:"order_id" dynamodbav:"order_id"`
-	ItemID      string  `json:"item_id" dynamodbav:"item_id"`
-	Name        string  `json:"name" dynamodbav:"name"`
-	Description string  `json:"description" dynamodbav:"description"`
-	Price       float64 `json:"price" dynamodbav:"price"`
-	Quantity    int     `json:"quantity" dynamodbav:"quantity"`
+	OrderID     string `json:"order_id" dynamodbav:"order_id"`
+	ItemID      string `json:"item_id" dynamodbav:"item_id"`
+	SKU         string `json:"sku" dynamodbav:"sku,omitempty"`
+	Name        string `json:"name" dynamodbav:"name"`
+	Description string `json:"description" dynamodbav:"description"`
+	Price       Amount `json:"price" dynamodbav:"price"`
+	Currency    string `json:"currency" dynamodbav:"currency"`
+	Quantity    int    `json:"quantity" dynamodbav:"quantity"`
+}
+
+// OrderItemUpdate holds the fields of an order item that may change after it
+// was added. Nil fields are left as they are.
+type OrderItemUpdate struct {
+	Quantity    *int    `json:"quantity"`
+	Description *string `json:"description"`
+}
+
+func (u OrderItemUpdate) Validate() []FieldError {
+	var errs fieldErrors
+	if u.Quantity != nil {
+		errs.check("quantity", atLeast(*u.Quantity, 1))
+	}
+	if u.Description != nil {
+		errs.check("description", maxLength(*u.Description, 500))
+	}
+	return errs
 }
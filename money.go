@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Amount is an exact money amount in minor units (cents). It is stored in
+// DynamoDB as a number such as 1299.99, written to JSON as the string
+// "1299.99" and read from JSON as either a string or a number.
+type Amount int64
+
+const minorUnits = 100
+
+// currencies are the ISO 4217 codes whose minor unit is a hundredth, the
+// only ones Amount can hold exactly. Currencies without minor units such as
+// JPY, or with three such as KWD, are not accepted.
+var currencies = map[string]bool{
+	"AED": true, "ARS": true, "AUD": true, "BGN": true, "BRL": true,
+	"CAD": true, "CHF": true, "CNY": true, "COP": true, "CZK": true,
+	"DKK": true, "EGP": true, "EUR": true, "GBP": true, "HKD": true,
+	"HUF": true, "IDR": true, "ILS": true, "INR": true, "MAD": true,
+	"MXN": true, "MYR": true, "NGN": true, "NOK": true, "NZD": true,
+	"PHP": true, "PKR": true, "PLN": true, "QAR": true, "RON": true,
+	"RUB": true, "SAR": true, "SEK": true, "SGD": true, "THB": true,
+	"TRY": true, "TWD": true, "UAH": true, "USD": true, "ZAR": true,
+}
+
+func validCurrency(code string) bool {
+	return currencies[code]
+}
+
+// ParseAmount parses a decimal amount with at most two fraction digits
+func ParseAmount(s string) (Amount, error) {
+	digits := strings.TrimPrefix(strings.TrimSpace(s), "-")
+	negative := len(digits) < len(strings.TrimSpace(s))
+
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if !isDigits(whole) || (fraction != "" && !isDigits(fraction)) || len(fraction) > 2 {
+		return 0, fmt.Errorf("invalid amount %q: want a decimal with at most 2 fraction digits", s)
+	}
+
+	// Pad to exactly two fraction digits, "12.5" is 1250 cents
+	cents, err := strconv.ParseInt(whole+(fraction + "00")[:2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+
+	if negative {
+		cents = -cents
+	}
+	return Amount(cents), nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// roundAmount converts a number written by the float64 era of the API, such
+// as 3899.9700000000003, to the nearest cent
+func roundAmount(s string) (Amount, error) {
+	if amount, err := ParseAmount(s); err == nil {
+		return amount, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return Amount(math.Round(f * minorUnits)), nil
+}
+
+func (a Amount) String() string {
+	sign := ""
+	if a < 0 {
+		sign = "-"
+		a = -a
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, a/minorUnits, a%minorUnits)
+}
+
+// Mul returns the amount for quantity units
+func (a Amount) Mul(quantity int) Amount {
+	return a * Amount(quantity)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(data)
+	}
+
+	amount, err := ParseAmount(s)
+	if err != nil {
+		// A type error lets decodeJSON report the member as a field
+		return &json.UnmarshalTypeError{Value: string(data), Type: reflect.TypeFor[Amount]()}
+	}
+	*a = amount
+	return nil
+}
+
+func (a Amount) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberN{Value: a.String()}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue rounds numbers with more than two fraction
+// digits so rows written before migration 1 (-migrate) stay readable
+func (a *Amount) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	n, ok := av.(*types.AttributeValueMemberN)
+	if !ok {
+		return fmt.Errorf("amount must be a number, got %T", av)
+	}
+
+	amount, err := roundAmount(n.Value)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "12", want: 1200},
+		{in: "12.5", want: 1250},
+		{in: "12.05", want: 1205},
+		{in: "1299.99", want: 129999},
+		{in: " 7.10 ", want: 710},
+		{in: "-3.25", want: -325},
+		{in: "12.345", wantErr: true},
+		{in: "12.", want: 1200},
+		{in: ".5", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "12,50", wantErr: true},
+		{in: "--1", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseAmount(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAmount(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRoundAmount(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{in: "1299.99", want: 129999},
+		{in: "3899.9700000000003", want: 389997},
+		{in: "0.1", want: 10},
+		{in: "2.675", want: 268},
+		{in: "19.989999999999998", want: 1999},
+		{in: "-0.005", want: -1},
+		{in: "1e2", want: 10000},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := roundAmount(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("roundAmount(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("roundAmount(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{1250, "12.50"},
+		{-325, "-3.25"},
+		{-5, "-0.05"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var v struct {
+		Price Amount `json:"price"`
+	}
+	for _, in := range []string{`{"price": "12.50"}`, `{"price": 12.5}`} {
+		if err := json.Unmarshal([]byte(in), &v); err != nil || v.Price != 1250 {
+			t.Errorf("decoding %s = %v, %v; want 12.50", in, v.Price, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"price": 12.345}`), &v); err == nil {
+		t.Error("decoding 12.345 succeeded, want an error")
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil || string(out) != `{"price":"12.50"}` {
+		t.Errorf("encoding = %s, %v; want the amount as a string", out, err)
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	tests := map[string]bool{
+		"USD": true,
+		"EUR": true,
+		"GBP": true,
+		"JPY": false,
+		"KWD": false,
+		"usd": false,
+		"XYZ": false,
+		"":    false,
+	}
+	for code, want := range tests {
+		if got := validCurrency(code); got != want {
+			t.Errorf("validCurrency(%q) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	key := map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: "#USER#john"},
+		"sk": &types.AttributeValueMemberS{Value: "#ORDER#42"},
+	}
+
+	cursor, err := encodeCursor("user-orders:john", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeCursor("user-orders:john", cursor)
+	if err != nil {
+		t.Fatalf("decodeCursor: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, key) {
+		t.Errorf("decoded key = %v, want %v", decoded, key)
+	}
+}
+
+func TestCursorEmpty(t *testing.T) {
+	cursor, err := encodeCursor("products", nil)
+	if err != nil || cursor != "" {
+		t.Errorf("encodeCursor(nil) = %q, %v; want no cursor for the last page", cursor, err)
+	}
+	key, err := decodeCursor("products", "")
+	if err != nil || key != nil {
+		t.Errorf("decodeCursor(\"\") = %v, %v; want the first page", key, err)
+	}
+}
+
+func TestCursorNonStringKey(t *testing.T) {
+	_, err := encodeCursor("products", map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberN{Value: "1"},
+	})
+	if err == nil {
+		t.Error("encodeCursor accepted a number key attribute")
+	}
+}
+
+func TestCursorTampering(t *testing.T) {
+	key := map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: "#USER#john"},
+		"sk": &types.AttributeValueMemberS{Value: "#ORDER#42"},
+	}
+	cursor, err := encodeCursor("user-orders:john", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, mac, _ := strings.Cut(cursor, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"pk":"#USER#jane","sk":"#ORDER#42"}`))
+
+	tests := []struct {
+		name   string
+		scope  string
+		cursor string
+	}{
+		{"other scope", "user-orders:jane", cursor},
+		{"edited payload", "user-orders:john", forged + "." + mac},
+		{"edited signature", "user-orders:john", payload + "." + strings.Repeat("A", len(mac))},
+		{"no signature", "user-orders:john", payload},
+		{"not base64", "user-orders:john", "!!!." + mac},
+		{"garbage", "user-orders:john", "not-a-cursor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.scope, tt.cursor); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("decodeCursor = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestCursorSecret(t *testing.T) {
+	saved := cursorSecret
+	t.Cleanup(func() { cursorSecret = saved })
+
+	key := map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: "#PRODUCT#A"}}
+	SetCursorSecret("first secret")
+	cursor, err := encodeCursor("products", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance with the same secret accepts the cursor
+	SetCursorSecret("first secret")
+	if _, err := decodeCursor("products", cursor); err != nil {
+		t.Errorf("decodeCursor with the same secret: %v", err)
+	}
+
+	SetCursorSecret("second secret")
+	if _, err := decodeCursor("products", cursor); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("decodeCursor with another secret = %v, want ErrInvalidCursor", err)
+	}
+}
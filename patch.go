@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+)
+
+// Patch is one member of a JSON merge patch (RFC 7396). Set reports whether
+// the member was present at all, a nil Value means it was null and removes
+// the field.
+type Patch[T any] struct {
+	Set   bool
+	Value *T
+}
+
+// UnmarshalJSON is only called for members present in the document, which
+// is what tells an absent member apart from null
+func (p *Patch[T]) UnmarshalJSON(data []byte) error {
+	p.Set = true
+	if string(data) == "null" {
+		p.Value = nil
+		return nil
+	}
+
+	p.Value = new(T)
+	return json.Unmarshal(data, p.Value)
+}
+
+// applyTo writes the patched value to field, using the zero value for null
+// so omitempty attributes are dropped
+func (p Patch[T]) applyTo(field *T) {
+	if !p.Set {
+		return
+	}
+	var zero T
+	if p.Value == nil {
+		*field = zero
+		return
+	}
+	*field = *p.Value
+}
+
+// removes reports whether the patch clears the field
+func (p Patch[T]) removes() bool {
+	return p.Set && p.Value == nil
+}
+
+// UserPatch is a merge patch of a user profile. Addresses are merged by key,
+// a null address removes it.
+type UserPatch struct {
+	FullName       Patch[string]                   `json:"full_name"`
+	Email          Patch[string]                   `json:"email"`
+	Addresses      Patch[map[string]*AddressPatch] `json:"addresses"`
+	DefaultAddress Patch[string]                   `json:"default_address"`
+}
+
+type AddressPatch struct {
+	Street  Patch[string] `json:"street"`
+	State   Patch[string] `json:"state"`
+	Country Patch[string] `json:"country"`
+}
+
+// replaceAddress is a patch that sets every field of an address
+func replaceAddress(address Address) *AddressPatch {
+	return &AddressPatch{
+		Street:  patchValue(address.Street),
+		State:   patchValue(address.State),
+		Country: patchValue(address.Country),
+	}
+}
+
+// removeAddress is a patch that deletes one address
+func removeAddress(key string) UserPatch {
+	return UserPatch{
+		Addresses: Patch[map[string]*AddressPatch]{
+			Set:   true,
+			Value: &map[string]*AddressPatch{key: nil},
+		},
+	}
+}
+
+// patchValue sets a field to value, removing it if value is empty
+func patchValue(value string) Patch[string] {
+	if value == "" {
+		return Patch[string]{Set: true}
+	}
+	return Patch[string]{Set: true, Value: &value}
+}
+
+// apply returns user with the patch merged in, or a *ValidationError if the
+// result is not a valid profile
+func (p UserPatch) apply(user User) (User, error) {
+	p.FullName.applyTo(&user.FullName)
+	p.Email.applyTo(&user.Email)
+	p.DefaultAddress.applyTo(&user.DefaultAddress)
+
+	if p.Addresses.removes() {
+		user.Addresses = nil
+	} else if p.Addresses.Set {
+		addresses := maps.Clone(user.Addresses)
+		if addresses == nil {
+			addresses = make(map[string]Address)
+		}
+		for key, patch := range *p.Addresses.Value {
+			if patch == nil {
+				delete(addresses, key)
+				continue
+			}
+			address := addresses[key]
+			patch.Street.applyTo(&address.Street)
+			patch.State.applyTo(&address.State)
+			patch.Country.applyTo(&address.Country)
+			addresses[key] = address
+		}
+		if len(addresses) == 0 {
+			addresses = nil
+		}
+		user.Addresses = addresses
+	}
+
+	// Removing the default address leaves the user without one
+	if _, ok := user.Addresses[user.DefaultAddress]; !ok && !p.DefaultAddress.Set {
+		user.DefaultAddress = ""
+	}
+
+	return user, validate(user)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPatchUnmarshal(t *testing.T) {
+	email, empty := "john@example.com", ""
+	tests := []struct {
+		in        string
+		wantSet   bool
+		wantValue *string
+	}{
+		{in: `{}`},
+		{in: `{"email": null}`, wantSet: true},
+		{in: `{"email": "john@example.com"}`, wantSet: true, wantValue: &email},
+		{in: `{"email": ""}`, wantSet: true, wantValue: &empty},
+	}
+	for _, tt := range tests {
+		var patch UserPatch
+		if err := json.Unmarshal([]byte(tt.in), &patch); err != nil {
+			t.Fatalf("decoding %s: %v", tt.in, err)
+		}
+		if patch.Email.Set != tt.wantSet || !reflect.DeepEqual(patch.Email.Value, tt.wantValue) {
+			t.Errorf("decoding %s: email = %+v, want set %v, value %v", tt.in, patch.Email, tt.wantSet, tt.wantValue)
+		}
+		if patch.FullName.Set {
+			t.Errorf("decoding %s: full_name is set", tt.in)
+		}
+	}
+}
+
+func TestUserPatchApply(t *testing.T) {
+	user := User{
+		Username: "john",
+		FullName: "John Smith",
+		Email:    "john@example.com",
+		Addresses: map[string]Address{
+			"home": {Street: "1 Main St", State: "WA", Country: "US"},
+			"work": {Street: "2 Office Rd", State: "OR", Country: "US"},
+		},
+		DefaultAddress: "home",
+		Version:        3,
+	}
+
+	tests := []struct {
+		name  string
+		patch string
+		want  func(u *User)
+	}{
+		{
+			name:  "empty patch",
+			patch: `{}`,
+			want:  func(u *User) {},
+		},
+		{
+			name:  "set and remove fields",
+			patch: `{"full_name": "John A. Smith", "email": null}`,
+			want: func(u *User) {
+				u.FullName = "John A. Smith"
+				u.Email = ""
+			},
+		},
+		{
+			name:  "merge an address field",
+			patch: `{"addresses": {"work": {"state": null, "street": "3 Office Rd"}}}`,
+			want: func(u *User) {
+				u.Addresses["work"] = Address{Street: "3 Office Rd", Country: "US"}
+			},
+		},
+		{
+			name:  "add an address",
+			patch: `{"addresses": {"cabin": {"street": "4 Lake Rd", "country": "CA"}}}`,
+			want: func(u *User) {
+				u.Addresses["cabin"] = Address{Street: "4 Lake Rd", Country: "CA"}
+			},
+		},
+		{
+			name:  "remove the default address",
+			patch: `{"addresses": {"home": null}}`,
+			want: func(u *User) {
+				delete(u.Addresses, "home")
+				u.DefaultAddress = ""
+			},
+		},
+		{
+			name:  "remove every address",
+			patch: `{"addresses": null}`,
+			want: func(u *User) {
+				u.Addresses = nil
+				u.DefaultAddress = ""
+			},
+		},
+		{
+			name:  "move the default",
+			patch: `{"default_address": "work"}`,
+			want: func(u *User) {
+				u.DefaultAddress = "work"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch UserPatch
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+
+			want := copyUser(user)
+			tt.want(&want)
+			got, err := patch.apply(copyUser(user))
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("apply =\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+
+	// The addresses of the user passed in are left alone
+	var patch UserPatch
+	if err := json.Unmarshal([]byte(`{"addresses": {"home": null}}`), &patch); err != nil {
+		t.Fatal(err)
+	}
+	original := copyUser(user)
+	if _, err := patch.apply(original); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := original.Addresses["home"]; !ok {
+		t.Error("apply removed the address from the user passed in")
+	}
+}
+
+func TestUserPatchApplyInvalid(t *testing.T) {
+	user := User{
+		Username:  "john",
+		Addresses: map[string]Address{"home": {Street: "1 Main St", Country: "US"}},
+	}
+
+	tests := []struct {
+		name      string
+		patch     string
+		wantField string
+	}{
+		{"new address without a country", `{"addresses": {"cabin": {"street": "4 Lake Rd"}}}`, "addresses.cabin.country"},
+		{"remove a required address field", `{"addresses": {"home": {"street": null}}}`, "addresses.home.street"},
+		{"invalid email", `{"email": "john"}`, "email"},
+		{"unknown default address", `{"default_address": "cabin"}`, "default_address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch UserPatch
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := patch.apply(copyUser(user))
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("apply = %v, want a *ValidationError", err)
+			}
+			if len(invalid.Fields) != 1 || invalid.Fields[0].Field != tt.wantField {
+				t.Errorf("fields = %v, want just %s", invalid.Fields, tt.wantField)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+)
+
+// retryAfterSeconds is sent with 503 responses for throttled requests
+const retryAfterSeconds = "1"
+
+// Problem is an RFC 7807 problem details body. Extensions are written as
+// top-level members next to the standard ones.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]any
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	body := make(map[string]any, len(p.Extensions)+5)
+	maps.Copy(body, p.Extensions)
+	body["type"] = p.Type
+	body["title"] = p.Title
+	body["status"] = p.Status
+	if p.Detail != "" {
+		body["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		body["instance"] = p.Instance
+	}
+	return json.Marshal(body)
+}
+
+// problemFor maps an error to its problem type and status by kind. Errors
+// without a kind are internal and their message is not shown to clients.
+func problemFor(r *http.Request, err error) Problem {
+	p := Problem{Detail: err.Error(), Instance: r.URL.Path}
+
+	switch {
+	case errors.Is(err, ErrThrottled):
+		p.Type, p.Title, p.Status = "/problems/throttled", "Service busy", http.StatusServiceUnavailable
+	case errors.Is(err, errIfMatchRequired):
+		p.Type, p.Title, p.Status = "/problems/precondition-required", "Precondition required", http.StatusPreconditionRequired
+	case errors.Is(err, ErrPrecondition):
+		p.Type, p.Title, p.Status = "/problems/precondition-failed", "Precondition failed", http.StatusPreconditionFailed
+	case errors.Is(err, ErrNotFound):
+		p.Type, p.Title, p.Status = "/problems/not-found", "Not found", http.StatusNotFound
+	case errors.Is(err, ErrValidation):
+		p.Type, p.Title, p.Status = "/problems/validation", "Invalid request", http.StatusBadRequest
+	case errors.Is(err, ErrConflict):
+		p.Type, p.Title, p.Status = "/problems/conflict", "Conflict", http.StatusConflict
+	default:
+		p.Type, p.Title, p.Status = "/problems/internal", "Internal error", http.StatusInternalServerError
+		p.Detail = "the request could not be completed"
+	}
+
+	var fieldsErr *ValidationError
+	if errors.As(err, &fieldsErr) {
+		p.Status = http.StatusUnprocessableEntity
+		p.Extensions = map[string]any{"errors": fieldsErr.Fields}
+	}
+
+	var stockErr *InsufficientStockError
+	if errors.As(err, &stockErr) {
+		p.Extensions = map[string]any{
+			"sku":       stockErr.SKU,
+			"requested": stockErr.Requested,
+			"available": stockErr.Available,
+		}
+	}
+	return p
+}
+
+// writeError writes err as problem+json with the status for its kind
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, problemFor(r, err), err)
+}
+
+// writeErrorStatus writes err like writeError but with a status chosen by the
+// handler, e.g. 422 when a request refers to a product that does not exist
+func writeErrorStatus(w http.ResponseWriter, r *http.Request, status int, err error) {
+	p := problemFor(r, err)
+	p.Status = status
+	writeProblem(w, r, p, err)
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem, err error) {
+	if p.Status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+	if p.Status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often long running table commands report progress
+const progressInterval = 2 * time.Second
+
+// progress counts the items processed by a table command and prints the
+// count and rate while it runs. add may be called from several goroutines.
+type progress struct {
+	verb  string
+	count atomic.Int64
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// startProgress starts reporting, e.g. "deleted 1200 items (600 items/s)"
+// for the verb "deleted"
+func startProgress(verb string) *progress {
+	p := &progress{
+		verb:  verb,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.report()
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) add(n int) {
+	p.count.Add(int64(n))
+}
+
+// stop ends the periodic reports and prints the final count
+func (p *progress) stop() {
+	close(p.done)
+	p.wg.Wait()
+	p.report()
+}
+
+func (p *progress) report() {
+	count := p.count.Load()
+	elapsed := time.Since(p.start)
+	rate := float64(count) / max(elapsed.Seconds(), 0.001)
+	fmt.Printf("  %s %d items (%.0f items/s, %s)\n", p.verb, count, rate, elapsed.Round(time.Second))
+}
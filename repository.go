@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -11,77 +15,91 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// maxTransactItems is the TransactWriteItems action limit
+const maxTransactItems = 100
+
+// maxOrderLines caps the items on an order so that cancelling it, which
+// updates the order and every product on it in one transaction, stays within
+// maxTransactItems
+const maxOrderLines = maxTransactItems - 1
+
 type Repository struct {
-	client    *dynamodb.Client
+	client    dynamoClient
 	tableName string
 }
 
 func NewRepository(client *dynamodb.Client, tableName string) *Repository {
 	return &Repository{
-		client:    client,
+		client:    dynamoClient{client},
 		tableName: tableName,
 	}
 }
 
+// dynamoClient runs the item operations through translateError so throttling
+// and transaction conflicts reach the API as ErrThrottled and ErrConflict.
+// It still satisfies the paginator interfaces.
+type dynamoClient struct {
+	*dynamodb.Client
+}
+
+func (c dynamoClient) GetItem(ctx context.Context, input *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	output, err := c.Client.GetItem(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) PutItem(ctx context.Context, input *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	output, err := c.Client.PutItem(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	output, err := c.Client.UpdateItem(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) DeleteItem(ctx context.Context, input *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	output, err := c.Client.DeleteItem(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) Query(ctx context.Context, input *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	output, err := c.Client.Query(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) Scan(ctx context.Context, input *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	output, err := c.Client.Scan(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) TransactWriteItems(ctx context.Context, input *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	output, err := c.Client.TransactWriteItems(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
+func (c dynamoClient) BatchWriteItem(ctx context.Context, input *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	output, err := c.Client.BatchWriteItem(ctx, input, optFns...)
+	return output, translateError(err)
+}
+
 // Table Management Operations
 
-func (r *Repository) CreateTable(ctx context.Context) error {
-	input := &dynamodb.CreateTableInput{
-		TableName: aws.String(r.tableName),
-		KeySchema: []types.KeySchemaElement{
-			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
-			{AttributeName: aws.String("sk"), KeyType: types.KeyTypeRange},
-		},
-		AttributeDefinitions: []types.AttributeDefinition{
-			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
-			{AttributeName: aws.String("sk"), AttributeType: types.ScalarAttributeTypeS},
-			{AttributeName: aws.String("status_date"), AttributeType: types.ScalarAttributeTypeS},
-			{AttributeName: aws.String("placed_id"), AttributeType: types.ScalarAttributeTypeS},
-		},
-		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
-			{
-				IndexName: aws.String("inverted-index"),
-				KeySchema: []types.KeySchemaElement{
-					{AttributeName: aws.String("sk"), KeyType: types.KeyTypeHash},
-					{AttributeName: aws.String("pk"), KeyType: types.KeyTypeRange},
-				},
-				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
-				ProvisionedThroughput: &types.ProvisionedThroughput{
-					ReadCapacityUnits:  aws.Int64(5),
-					WriteCapacityUnits: aws.Int64(5),
-				},
-			},
-			{
-				IndexName: aws.String("placed-index"),
-				KeySchema: []types.KeySchemaElement{
-					{AttributeName: aws.String("placed_id"), KeyType: types.KeyTypeHash},
-				},
-				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
-				ProvisionedThroughput: &types.ProvisionedThroughput{
-					ReadCapacityUnits:  aws.Int64(5),
-					WriteCapacityUnits: aws.Int64(5),
-				},
-			},
-		},
-		LocalSecondaryIndexes: []types.LocalSecondaryIndex{
-			{
-				IndexName: aws.String("status-date-index"),
-				KeySchema: []types.KeySchemaElement{
-					{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
-					{AttributeName: aws.String("status_date"), KeyType: types.KeyTypeRange},
-				},
-				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
-			},
-		},
-		BillingMode: types.BillingModeProvisioned,
-		ProvisionedThroughput: &types.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(5),
-			WriteCapacityUnits: aws.Int64(5),
-		},
+// CreateTable creates the table and its indexes with the billing mode and
+// capacity of config, waits until the table is ACTIVE and records it as
+// being at the latest schema version
+func (r *Repository) CreateTable(ctx context.Context, config TableConfig) error {
+	input := tableDefinition(r.tableName)
+	if err := config.apply(input); err != nil {
+		return err
 	}
 
-	_, err := r.client.CreateTable(ctx, input)
-	return err
+	if _, err := r.client.CreateTable(ctx, input); err != nil {
+		return err
+	}
+	if err := r.waitForTable(ctx); err != nil {
+		return err
+	}
+	return r.markSchemaCurrent(ctx)
 }
 
 func (r *Repository) DeleteTable(ctx context.Context) error {
@@ -91,67 +109,83 @@ func (r *Repository) DeleteTable(ctx context.Context) error {
 	return err
 }
 
-func (r *Repository) EmptyTable(ctx context.Context) error {
-	// Scan all items and delete them
-	paginator := dynamodb.NewScanPaginator(r.client, &dynamodb.ScanInput{
-		TableName: aws.String(r.tableName),
-	})
+// EmptyTable deletes every row while keeping the table, its indexes and the
+// schema version, since the layout of an empty table is still current. The
+// table is scanned in parallel by the given number of workers, and deleted is
+// called with the size of each batch once it has been written.
+func (r *Repository) EmptyTable(ctx context.Context, workers int, deleted func(n int)) error {
+	// Only the keys are needed to delete a row
+	input := dynamodb.ScanInput{
+		ProjectionExpression: aws.String("pk, sk"),
+		FilterExpression:     aws.String("pk <> :meta"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":meta": &types.AttributeValueMemberS{Value: metaPK},
+		},
+	}
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return err
-		}
+	return r.parallelScan(ctx, workers, input, func(items []map[string]types.AttributeValue) error {
+		for start := 0; start < len(items); start += maxBatchWriteItems {
+			batch := items[start:min(start+maxBatchWriteItems, len(items))]
 
-		// Delete items in batches
-		for i := 0; i < len(page.Items); i += 25 {
-			end := i + 25
-			if end > len(page.Items) {
-				end = len(page.Items)
+			writeRequests := make([]types.WriteRequest, 0, len(batch))
+			for _, item := range batch {
+				writeRequests = append(writeRequests, deleteRequest(item))
 			}
-
-			var writeRequests []types.WriteRequest
-			for _, item := range page.Items[i:end] {
-				writeRequests = append(writeRequests, types.WriteRequest{
-					DeleteRequest: &types.DeleteRequest{
-						Key: map[string]types.AttributeValue{
-							"pk": item["pk"],
-							"sk": item["sk"],
-						},
-					},
-				})
+			if err := r.batchWrite(ctx, writeRequests); err != nil {
+				return err
 			}
-
-			if len(writeRequests) > 0 {
-				_, err := r.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
-					RequestItems: map[string][]types.WriteRequest{
-						r.tableName: writeRequests,
-					},
-				})
-				if err != nil {
-					return err
-				}
+			if deleted != nil {
+				deleted(len(batch))
 			}
 		}
+		return nil
+	})
+}
+
+// queryPage runs a single page of a query, resuming after the cursor in page
+// and returning the cursor of the following page
+func (r *Repository) queryPage(ctx context.Context, scope string, page PageRequest, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, string, error) {
+	startKey, err := decodeCursor(scope, page.Cursor)
+	if err != nil {
+		return nil, "", err
 	}
-	return nil
+	input.ExclusiveStartKey = startKey
+	input.Limit = aws.Int32(page.limit())
+
+	result, err := r.client.Query(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := encodeCursor(scope, result.LastEvaluatedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return result.Items, next, nil
 }
 
 // User Operations
 
-func (r *Repository) CreateUser(ctx context.Context, user User) error {
+func (r *Repository) CreateUser(ctx context.Context, user *User) error {
+	user.Version = 1
 	userMap, err := attributevalue.MarshalMap(user)
 	if err != nil {
 		return err
 	}
 
-	userMap["pk"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", user.Username)}
-	userMap["sk"] = &types.AttributeValueMemberS{Value: "PROFILE"}
+	userMap["pk"] = &types.AttributeValueMemberS{Value: userPK(user.Username)}
+	userMap["sk"] = &types.AttributeValueMemberS{Value: profileSK}
 
 	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(r.tableName),
-		Item:      userMap,
+		TableName:           aws.String(r.tableName),
+		Item:                userMap,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
 	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Username)
+	}
 	return err
 }
 
@@ -160,17 +194,19 @@ func (r *Repository) GetUser(ctx context.Context, username string) (*User, error
 		TableName:              aws.String(r.tableName),
 		KeyConditionExpression: aws.String("pk = :pk AND sk = :sk"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", username)},
-			":sk": &types.AttributeValueMemberS{Value: "PROFILE"},
+			":pk": &types.AttributeValueMemberS{Value: userPK(username)},
+			":sk": &types.AttributeValueMemberS{Value: profileSK},
 		},
 		Limit: aws.Int32(1),
+		// Writes condition on the version read here, so it must be current
+		ConsistentRead: aws.Bool(true),
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("user not found")
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
 	}
 
 	var user User
@@ -181,225 +217,1548 @@ func (r *Repository) GetUser(ctx context.Context, username string) (*User, error
 	return &user, nil
 }
 
-func (r *Repository) UpdateUser(ctx context.Context, username string, user User) error {
-	userMap, err := attributevalue.MarshalMap(user)
+// ReplaceUser replaces the whole profile of an existing user
+func (r *Repository) ReplaceUser(ctx context.Context, user *User, version int64) error {
+	if version == anyVersion {
+		return r.replaceAnyVersion(ctx, user)
+	}
+
+	replacement := *user
+	replacement.Version = version + 1
+	userMap, err := attributevalue.MarshalMap(replacement)
 	if err != nil {
 		return err
 	}
 
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", username)},
-			"sk": &types.AttributeValueMemberS{Value: "PROFILE"},
-		},
-		AttributeUpdates: make(map[string]types.AttributeValueUpdate),
-	}
+	userMap["pk"] = &types.AttributeValueMemberS{Value: userPK(user.Username)}
+	userMap["sk"] = &types.AttributeValueMemberS{Value: profileSK}
 
-	for key, value := range userMap {
-		if key != "pk" && key != "sk" {
-			input.AttributeUpdates[key] = types.AttributeValueUpdate{
-				Value:  value,
-				Action: types.AttributeActionPut,
-			}
+	condition, names, values := versionCondition(version)
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                           aws.String(r.tableName),
+		Item:                                userMap,
+		ConditionExpression:                 aws.String("attribute_exists(pk) AND " + condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		if len(ccf.Item) == 0 {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, user.Username)
 		}
+		return fmt.Errorf("%w: user %s", ErrVersionMismatch, user.Username)
+	}
+	if err != nil {
+		return err
 	}
 
-	_, err = r.client.UpdateItem(ctx, input)
-	return err
+	user.Version = replacement.Version
+	return nil
 }
 
-// Order Operations
+// profileAttributes are the attributes of a profile row other than its key
+// and version
+var profileAttributes = []string{"full_name", "email", "addresses", "default_address"}
 
-func (r *Repository) CreateOrder(ctx context.Context, order *Order) error {
-	orderMap, err := attributevalue.MarshalMap(order)
+// replaceAnyVersion replaces a profile whatever its version. It sets or
+// removes every attribute and adds to the version in one update, so the only
+// condition is that the user exists.
+func (r *Repository) replaceAnyVersion(ctx context.Context, user *User) error {
+	userMap, err := attributevalue.MarshalMap(user)
 	if err != nil {
 		return err
 	}
 
-	orderMap["pk"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", order.UserID)}
-	orderMap["sk"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("#ORDER#%s", order.ID)}
-
-	statusDate := fmt.Sprintf("%s#%s", order.Status, order.CreatedAt.Format("2006-01-02"))
-	orderMap["status_date"] = &types.AttributeValueMemberS{Value: statusDate}
+	var set, remove []string
+	names := map[string]string{"#version": "version"}
+	values := map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}}
+	for _, attribute := range profileAttributes {
+		names["#"+attribute] = attribute
+		value, ok := userMap[attribute]
+		if !ok {
+			remove = append(remove, "#"+attribute)
+			continue
+		}
+		set = append(set, fmt.Sprintf("#%s = :%s", attribute, attribute))
+		values[":"+attribute] = value
+	}
 
-	if order.Status == OrderStatusPending || order.Status == OrderStatusConfirmed {
-		orderMap["placed_id"] = &types.AttributeValueMemberS{Value: string(order.Status)}
+	updateExpression := "ADD #version :one"
+	if len(set) > 0 {
+		updateExpression += " SET " + strings.Join(set, ", ")
+	}
+	if len(remove) > 0 {
+		updateExpression += " REMOVE " + strings.Join(remove, ", ")
 	}
 
-	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+	result, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(r.tableName),
-		Item:      orderMap,
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(user.Username)},
+			"sk": &types.AttributeValueMemberS{Value: profileSK},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_exists(pk)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueUpdatedNew,
 	})
-	return err
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, user.Username)
+	}
+	if err != nil {
+		return err
+	}
+	return attributevalue.Unmarshal(result.Attributes["version"], &user.Version)
 }
 
-func (r *Repository) GetOrderByID(ctx context.Context, orderID string) (*Order, error) {
-	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
+// DeleteUser removes a user's profile, orders and order items. Orders that
+// have not been delivered or cancelled are refused with ErrUserHasOpenOrders
+// unless force is set, in which case pending and confirmed orders are
+// cancelled first so their stock goes back to the catalog. The profile is
+// deleted last, so a failed delete can simply be run again.
+func (r *Repository) DeleteUser(ctx context.Context, username string, force bool) error {
+	if _, err := r.GetUser(ctx, username); err != nil {
+		return err
+	}
+
+	var orders []Order
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
 		TableName:              aws.String(r.tableName),
-		IndexName:              aws.String("inverted-index"),
-		KeyConditionExpression: aws.String("sk = :sk"),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("#ORDER#%s", orderID)},
+			":pk":        &types.AttributeValueMemberS{Value: userPK(username)},
+			":sk_prefix": &types.AttributeValueMemberS{Value: orderPrefix},
 		},
-		Limit: aws.Int32(1),
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("order not found")
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, row := range page.Items {
+			var order Order
+			if err := attributevalue.UnmarshalMap(row, &order); err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
 	}
 
-	var order Order
-	if err := attributevalue.UnmarshalMap(result.Items[0], &order); err != nil {
-		return nil, err
+	if err := r.releaseOpenOrders(ctx, username, orders, force); err != nil {
+		return err
 	}
 
-	// Extract username from pk
-	if pkValue, ok := result.Items[0]["pk"]; ok {
-		if pkStr, ok := pkValue.(*types.AttributeValueMemberS); ok {
-			order.UserID = pkStr.Value[6:] // Remove "#USER#" prefix
+	var deletes []types.WriteRequest
+	for _, order := range orders {
+		items := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+			TableName:              aws.String(r.tableName),
+			KeyConditionExpression: aws.String("pk = :pk"),
+			ProjectionExpression:   aws.String("pk, sk"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":pk": &types.AttributeValueMemberS{Value: orderPK(order.ID)},
+			},
+		})
+		for items.HasMorePages() {
+			page, err := items.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, item := range page.Items {
+				deletes = append(deletes, deleteRequest(item))
+			}
 		}
+
+		deletes = append(deletes, deleteRequest(map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(username)},
+			"sk": &types.AttributeValueMemberS{Value: orderSK(order.ID)},
+		}))
 	}
-	order.ID = orderID
-	return &order, nil
+	if err := r.batchWrite(ctx, deletes); err != nil {
+		return err
+	}
+
+	return r.batchWrite(ctx, []types.WriteRequest{deleteRequest(map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: userPK(username)},
+		"sk": &types.AttributeValueMemberS{Value: profileSK},
+	})})
 }
 
-func (r *Repository) GetOrdersByUserID(ctx context.Context, userID string) ([]*Order, error) {
-	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
-		TableName:              aws.String(r.tableName),
-		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pk":        &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", userID)},
-			":sk_prefix": &types.AttributeValueMemberS{Value: "#ORDER#"},
-		},
-		ScanIndexForward: aws.Bool(false),
-	})
-	if err != nil {
-		return nil, err
+// releaseOpenOrders checks the orders of a user being deleted, cancelling
+// the ones still holding stock when force is set
+func (r *Repository) releaseOpenOrders(ctx context.Context, username string, orders []Order, force bool) error {
+	var open int
+	for _, order := range orders {
+		if !order.Status.Terminal() {
+			open++
+		}
+	}
+	if open > 0 && !force {
+		return fmt.Errorf("%w: %s has %d not delivered or cancelled", ErrUserHasOpenOrders, username, open)
 	}
 
-	var orders []*Order
-	for _, item := range result.Items {
-		var order Order
-		if err := attributevalue.UnmarshalMap(item, &order); err != nil {
+	for _, order := range orders {
+		if !order.Status.ItemsEditable() {
 			continue
 		}
-		order.UserID = userID
-		if skValue, ok := item["sk"]; ok {
-			if skStr, ok := skValue.(*types.AttributeValueMemberS); ok {
-				order.ID = skStr.Value[7:] // Remove "#ORDER#" prefix
+		for attempt := 1; ; attempt++ {
+			_, err := r.UpdateOrderStatus(ctx, order.ID, OrderStatusCancelled, anyVersion)
+			// Items changing underneath the cancel are worth another try
+			if errors.Is(err, ErrOrderModified) && attempt < maxPatchAttempts {
+				continue
 			}
+			// An order that shipped in the meantime holds no stock any more
+			if err != nil && !errors.Is(err, ErrInvalidTransition) {
+				return err
+			}
+			break
 		}
-		orders = append(orders, &order)
 	}
-
-	return orders, nil
+	return nil
 }
 
-func (r *Repository) UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus) error {
-	order, err := r.GetOrderByID(ctx, orderID)
+// DeleteAddress removes an address that no open order ships to. The address
+// is removed before the orders are checked, so an order placed at the same
+// time either shows up in the check or fails CreateOrder's check of the
+// address. If an order uses it the address is put back, conditional on the
+// version the removal wrote so no change made in between is overwritten.
+func (r *Repository) DeleteAddress(ctx context.Context, username, addressKey string, version int64) error {
+	current, err := r.GetUser(ctx, username)
 	if err != nil {
 		return err
 	}
+	if version != anyVersion && current.Version != version {
+		return fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+	}
+	if _, ok := current.Addresses[addressKey]; !ok {
+		return fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, username, addressKey)
+	}
 
-	statusDate := fmt.Sprintf("%s#%s", status, time.Now().Format("2006-01-02"))
-
-	updateExpression := "SET #status = :status, #status_date = :status_date, #updated_at = :updated_at"
-	expressionAttributeNames := map[string]string{
-		"#status":      "status",
-		"#status_date": "status_date",
-		"#updated_at":  "updated_at",
+	remove := removeAddress(addressKey)
+	removed, err := remove.apply(*current)
+	if err != nil {
+		return err
 	}
-	expressionAttributeValues := map[string]types.AttributeValue{
-		":status":      &types.AttributeValueMemberS{Value: string(status)},
-		":status_date": &types.AttributeValueMemberS{Value: statusDate},
-		":updated_at":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+	err = r.patchUser(ctx, current, removed, remove)
+	var ccf *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &ccf) && len(ccf.Item) == 0:
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	case errors.As(err, &ccf) && version != anyVersion:
+		return fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+	case errors.As(err, &ccf):
+		return fmt.Errorf("%w: %s", ErrUserModified, username)
+	case err != nil:
+		return err
 	}
+	removed.Version = current.Version + 1
 
-	if status == OrderStatusPending || status == OrderStatusConfirmed {
-		updateExpression += ", #placed_id = :placed_id"
-		expressionAttributeNames["#placed_id"] = "placed_id"
-		expressionAttributeValues[":placed_id"] = &types.AttributeValueMemberS{Value: string(status)}
-	} else {
-		updateExpression += " REMOVE #placed_id"
-		expressionAttributeNames["#placed_id"] = "placed_id"
+	inUse, err := r.addressInUse(ctx, username, addressKey)
+	if err == nil && !inUse {
+		return nil
 	}
+	if err == nil {
+		err = fmt.Errorf("%w: %s", ErrAddressInUse, addressKey)
+	}
+	if restoreErr := r.restoreAddress(ctx, current, &removed, addressKey); restoreErr != nil {
+		err = fmt.Errorf("putting back address %q of user %s: %w", addressKey, username, restoreErr)
+	}
+	return err
+}
 
-	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"pk": &types.AttributeValueMemberS{Value: fmt.Sprintf("#USER#%s", order.UserID)},
-			"sk": &types.AttributeValueMemberS{Value: fmt.Sprintf("#ORDER#%s", orderID)},
-		},
-		UpdateExpression:          aws.String(updateExpression),
-		ExpressionAttributeNames:  expressionAttributeNames,
-		ExpressionAttributeValues: expressionAttributeValues,
-	})
+// restoreAddress puts back an address of before that DeleteAddress removed,
+// starting from the user as the removal left it. When the user changed in
+// between it is read again and the address is added to the changes, as the
+// default only if no other default was chosen meanwhile.
+func (r *Repository) restoreAddress(ctx context.Context, before, current *User, addressKey string) error {
+	for attempt := 1; ; attempt++ {
+		if _, ok := current.Addresses[addressKey]; ok {
+			// Someone added the address again
+			return nil
+		}
 
-	return err
+		restore := UserPatch{
+			Addresses: Patch[map[string]*AddressPatch]{
+				Set:   true,
+				Value: &map[string]*AddressPatch{addressKey: replaceAddress(before.Addresses[addressKey])},
+			},
+		}
+		if before.DefaultAddress == addressKey && current.DefaultAddress == "" {
+			restore.DefaultAddress = patchValue(addressKey)
+		}
+		restored, err := restore.apply(*current)
+		if err != nil {
+			return err
+		}
+
+		err = r.patchUser(ctx, current, restored, restore)
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return err
+		}
+		if len(ccf.Item) == 0 {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, before.Username)
+		}
+		if attempt == maxPatchAttempts {
+			return fmt.Errorf("%w: %s", ErrUserModified, before.Username)
+		}
+		if current, err = r.GetUser(ctx, before.Username); err != nil {
+			return err
+		}
+	}
 }
 
-func (r *Repository) GetPendingOrders(ctx context.Context) ([]*Order, error) {
-	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
+// addressInUse reports whether an order that is not yet delivered or
+// cancelled ships to the address
+func (r *Repository) addressInUse(ctx context.Context, username, addressKey string) (bool, error) {
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
 		TableName:              aws.String(r.tableName),
-		IndexName:              aws.String("placed-index"),
-		KeyConditionExpression: aws.String("placed_id = :placed_id"),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
+		FilterExpression:       aws.String("address_key = :address_key AND NOT (#status IN (:delivered, :cancelled))"),
+		ConsistentRead:         aws.Bool(true),
+		ProjectionExpression:   aws.String("pk, sk"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":placed_id": &types.AttributeValueMemberS{Value: string(OrderStatusPending)},
+			":pk":          &types.AttributeValueMemberS{Value: userPK(username)},
+			":sk_prefix":   &types.AttributeValueMemberS{Value: orderPrefix},
+			":address_key": &types.AttributeValueMemberS{Value: addressKey},
+			":delivered":   &types.AttributeValueMemberS{Value: string(OrderStatusDelivered)},
+			":cancelled":   &types.AttributeValueMemberS{Value: string(OrderStatusCancelled)},
 		},
 	})
-	if err != nil {
-		return nil, err
-	}
 
-	var orders []*Order
-	for _, item := range result.Items {
-		var order Order
-		if err := attributevalue.UnmarshalMap(item, &order); err != nil {
-			continue
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return false, err
+		}
+		if len(page.Items) > 0 {
+			return true, nil
 		}
-		orders = append(orders, &order)
 	}
-
-	return orders, nil
+	return false, nil
 }
 
-// Order Item Operations
+// maxPatchAttempts bounds how often UpdateUser re-reads a user that changed
+// underneath a patch sent without a version
+const maxPatchAttempts = 3
 
-func (r *Repository) CreateOrderItem(ctx context.Context, orderID string, item *OrderItem) error {
-	itemMap, err := attributevalue.MarshalMap(item)
-	if err != nil {
-		return err
-	}
+// UpdateUser merges patch into an existing user's profile. The patch is
+// checked against the profile as read and written as SET/REMOVE actions on
+// the attributes it touches, conditional on the version that was read.
+func (r *Repository) UpdateUser(ctx context.Context, username string, patch UserPatch, version int64) (*User, error) {
+	for attempt := 1; ; attempt++ {
+		current, err := r.GetUser(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if version != anyVersion && current.Version != version {
+			return nil, fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+		}
 
-	itemMap["pk"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("#ORDER#%s", orderID)}
-	itemMap["sk"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("#ITEM#%s", item.ItemID)}
+		updated, err := patch.apply(*current)
+		if err != nil {
+			return nil, err
+		}
 
-	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(r.tableName),
-		Item:      itemMap,
-	})
-	return err
+		err = r.patchUser(ctx, current, updated, patch)
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			if err != nil {
+				return nil, err
+			}
+			updated.Version = current.Version + 1
+			return &updated, nil
+		}
+
+		if len(ccf.Item) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+		}
+		if version != anyVersion {
+			return nil, fmt.Errorf("%w: user %s", ErrVersionMismatch, username)
+		}
+		if attempt == maxPatchAttempts {
+			return nil, fmt.Errorf("%w: %s", ErrUserModified, username)
+		}
+	}
 }
 
-func (r *Repository) GetOrderItems(ctx context.Context, orderID string) ([]OrderItem, error) {
-	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
-		TableName:              aws.String(r.tableName),
+// patchUser writes the attributes that differ between current and updated,
+// addresses as nested map updates of just the keys in patch
+func (r *Repository) patchUser(ctx context.Context, current *User, updated User, patch UserPatch) error {
+	var set, remove []string
+	condition, names, values := versionCondition(current.Version)
+	values[":one"] = &types.AttributeValueMemberN{Value: "1"}
+
+	setOrRemove := func(attribute, currentValue, value string) {
+		if value == currentValue {
+			return
+		}
+		names["#"+attribute] = attribute
+		if value == "" {
+			remove = append(remove, "#"+attribute)
+			return
+		}
+		set = append(set, fmt.Sprintf("#%s = :%s", attribute, attribute))
+		values[":"+attribute] = &types.AttributeValueMemberS{Value: value}
+	}
+	setOrRemove("full_name", current.FullName, updated.FullName)
+	setOrRemove("email", current.Email, updated.Email)
+	setOrRemove("default_address", current.DefaultAddress, updated.DefaultAddress)
+
+	// DynamoDB rejects names the expression does not use, so #addresses is
+	// only added once something is written to it
+	if patch.Addresses.Set {
+		switch {
+		case len(updated.Addresses) == 0:
+			names["#addresses"] = "addresses"
+			remove = append(remove, "#addresses")
+		case len(current.Addresses) == 0:
+			// There is no map to set keys in yet
+			addresses, err := attributevalue.Marshal(updated.Addresses)
+			if err != nil {
+				return err
+			}
+			names["#addresses"] = "addresses"
+			set = append(set, "#addresses = :addresses")
+			values[":addresses"] = addresses
+		default:
+			i := 0
+			for key := range *patch.Addresses.Value {
+				i++
+				name := fmt.Sprintf("#address%d", i)
+				names["#addresses"] = "addresses"
+				names[name] = key
+
+				address, ok := updated.Addresses[key]
+				if !ok {
+					remove = append(remove, "#addresses."+name)
+					continue
+				}
+				value, err := attributevalue.Marshal(address)
+				if err != nil {
+					return err
+				}
+				set = append(set, fmt.Sprintf("#addresses.%s = :address%d", name, i))
+				values[fmt.Sprintf(":address%d", i)] = value
+			}
+		}
+	}
+
+	updateExpression := "ADD #version :one"
+	if len(set) > 0 {
+		updateExpression += " SET " + strings.Join(set, ", ")
+	}
+	if len(remove) > 0 {
+		updateExpression += " REMOVE " + strings.Join(remove, ", ")
+	}
+
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(current.Username)},
+			"sk": &types.AttributeValueMemberS{Value: profileSK},
+		},
+		UpdateExpression:                    aws.String(updateExpression),
+		ConditionExpression:                 aws.String("attribute_exists(pk) AND " + condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	return err
+}
+
+// versionCondition matches a row at version. Rows written before versions
+// existed have no version attribute and count as version 0.
+func versionCondition(version int64) (string, map[string]string, map[string]types.AttributeValue) {
+	condition := "#version = :version"
+	if version == 0 {
+		condition = "(attribute_not_exists(#version) OR #version = :version)"
+	}
+	return condition,
+		map[string]string{"#version": "version"},
+		map[string]types.AttributeValue{":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}}
+}
+
+// Order Operations
+
+// CreateOrder writes a new order with a copy of the user's address as its
+// shipping address
+func (r *Repository) CreateOrder(ctx context.Context, order *Order) error {
+	profileCheck, address, err := r.addressCheck(ctx, order.UserID, order.AddressKey)
+	if err != nil {
+		return err
+	}
+
+	order.ShippingAddress = address
+	order.Version = 1
+	orderMap, err := attributevalue.MarshalMap(order)
+	if err != nil {
+		return err
+	}
+
+	orderMap["pk"] = &types.AttributeValueMemberS{Value: userPK(order.UserID)}
+	orderMap["sk"] = &types.AttributeValueMemberS{Value: orderSK(order.ID)}
+
+	orderMap["status_date"] = &types.AttributeValueMemberS{Value: statusDate(order.Status, order.CreatedAt)}
+
+	if isPlaced(order.Status) {
+		orderMap["placed_id"] = &types.AttributeValueMemberS{Value: string(order.Status)}
+	}
+
+	_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{ConditionCheck: profileCheck},
+			{
+				Put: &types.Put{
+					TableName:           aws.String(r.tableName),
+					Item:                orderMap,
+					ConditionExpression: aws.String("attribute_not_exists(pk)"),
+				},
+			},
+		},
+	})
+
+	if reason, ok := cancellationReason(err, 0); ok {
+		return addressCheckError(reason, order.UserID, order.AddressKey)
+	}
+	return err
+}
+
+// addressCheck reads a user's address for copying onto an order. It returns
+// the address with a ConditionCheck of the profile that fails the transaction
+// if the user or the address has gone or changed since. The profile itself is
+// not written, so placing orders leaves the user's version alone.
+func (r *Repository) addressCheck(ctx context.Context, userID, addressKey string) (*types.ConditionCheck, *Address, error) {
+	user, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	address, ok := user.Addresses[addressKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, userID, addressKey)
+	}
+
+	// The address is compared field by field, with state absent when empty
+	// as omitempty leaves it, and STATE escaped as a reserved word
+	condition := "addresses.#address.street = :street AND addresses.#address.country = :country"
+	values := map[string]types.AttributeValue{
+		":street":  &types.AttributeValueMemberS{Value: address.Street},
+		":country": &types.AttributeValueMemberS{Value: address.Country},
+	}
+	if address.State == "" {
+		condition += " AND attribute_not_exists(addresses.#address.#state)"
+	} else {
+		condition += " AND addresses.#address.#state = :state"
+		values[":state"] = &types.AttributeValueMemberS{Value: address.State}
+	}
+
+	check := &types.ConditionCheck{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(userID)},
+			"sk": &types.AttributeValueMemberS{Value: profileSK},
+		},
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#address": addressKey,
+			"#state":   "state",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+	return check, &address, nil
+}
+
+// addressCheckError explains why an addressCheck failed, using the profile
+// row as it was when the transaction ran
+func addressCheckError(reason types.CancellationReason, userID, addressKey string) error {
+	if len(reason.Item) == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+	}
+
+	var user User
+	if err := attributevalue.UnmarshalMap(reason.Item, &user); err != nil {
+		return err
+	}
+	if _, ok := user.Addresses[addressKey]; !ok {
+		return fmt.Errorf("%w: user %s has no address %q", ErrAddressNotFound, userID, addressKey)
+	}
+	return fmt.Errorf("%w: address %q of user %s changed, retry", ErrConflict, addressKey, userID)
+}
+
+// GetOrderByID reads an order with a strongly consistent read of the table,
+// using the eventually consistent inverted-index only to find its user, so
+// the version it returns is current
+func (r *Repository) GetOrderByID(ctx context.Context, orderID string) (*Order, error) {
+	indexed, err := r.lookupOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(indexed.UserID)},
+			"sk": &types.AttributeValueMemberS{Value: orderSK(orderID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	var order Order
+	if err := attributevalue.UnmarshalMap(result.Item, &order); err != nil {
+		return nil, err
+	}
+	order.UserID = indexed.UserID
+	order.ID = orderID
+	return &order, nil
+}
+
+// lookupOrder reads an order from the eventually consistent inverted-index,
+// which is enough to find its user and the fields that never change
+func (r *Repository) lookupOrder(ctx context.Context, orderID string) (*Order, error) {
+	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		IndexName:              aws.String("inverted-index"),
+		KeyConditionExpression: aws.String("sk = :sk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sk": &types.AttributeValueMemberS{Value: orderSK(orderID)},
+		},
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Items) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	var order Order
+	if err := attributevalue.UnmarshalMap(result.Items[0], &order); err != nil {
+		return nil, err
+	}
+
+	// Extract username from pk
+	if pkValue, ok := result.Items[0]["pk"]; ok {
+		if pkStr, ok := pkValue.(*types.AttributeValueMemberS); ok {
+			order.UserID = strings.TrimPrefix(pkStr.Value, userPrefix)
+		}
+	}
+	order.ID = orderID
+	return &order, nil
+}
+
+func (r *Repository) GetOrdersByUserID(ctx context.Context, userID string, page PageRequest) (Page[*Order], error) {
+	items, next, err := r.queryPage(ctx, "user-orders:"+userID, page, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
 		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pk":        &types.AttributeValueMemberS{Value: fmt.Sprintf("#ORDER#%s", orderID)},
-			":sk_prefix": &types.AttributeValueMemberS{Value: "#ITEM#"},
+			":pk":        &types.AttributeValueMemberS{Value: userPK(userID)},
+			":sk_prefix": &types.AttributeValueMemberS{Value: orderPrefix},
+		},
+		ScanIndexForward: aws.Bool(false),
+	})
+	if err != nil {
+		return Page[*Order]{}, err
+	}
+
+	return Page[*Order]{Items: unmarshalUserOrders(userID, items), NextCursor: next}, nil
+}
+
+// GetUserOrdersByStatus queries the status-date-index LSI for the orders of a
+// user that entered status between from and to, inclusive at day precision.
+// A zero to leaves the range open ended.
+func (r *Repository) GetUserOrdersByStatus(ctx context.Context, userID string, status OrderStatus, from, to time.Time, page PageRequest) (Page[*Order], error) {
+	if !status.Valid() {
+		return Page[*Order]{}, fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+	}
+	if to.IsZero() {
+		to = maxStatusDate
+	}
+
+	// A cursor is only good for the range it was issued for, resuming it in
+	// another one would skip or repeat orders
+	lower, upper := statusDate(status, from), statusDate(status, to)
+	scope := fmt.Sprintf("user-orders:%s:%s:%s", userID, lower, upper)
+	items, next, err := r.queryPage(ctx, scope, page, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		IndexName:              aws.String("status-date-index"),
+		KeyConditionExpression: aws.String("pk = :pk AND status_date BETWEEN :from AND :to"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":   &types.AttributeValueMemberS{Value: userPK(userID)},
+			":from": &types.AttributeValueMemberS{Value: lower},
+			":to":   &types.AttributeValueMemberS{Value: upper},
 		},
 	})
+	if err != nil {
+		return Page[*Order]{}, err
+	}
+
+	return Page[*Order]{Items: unmarshalUserOrders(userID, items), NextCursor: next}, nil
+}
+
+func unmarshalUserOrders(userID string, items []map[string]types.AttributeValue) []*Order {
+	var orders []*Order
+	for _, item := range items {
+		var order Order
+		if err := attributevalue.UnmarshalMap(item, &order); err != nil {
+			continue
+		}
+		order.UserID = userID
+		if skValue, ok := item["sk"]; ok {
+			if skStr, ok := skValue.(*types.AttributeValueMemberS); ok {
+				order.ID = strings.TrimPrefix(skStr.Value, orderPrefix)
+			}
+		}
+		orders = append(orders, &order)
+	}
+	return orders
+}
+
+func (r *Repository) UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus, version int64) (*Order, error) {
+	if !status.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+	}
+
+	order, err := r.GetOrderByID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.Status.CanTransitionTo(status) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, order.Status, status)
+	}
+
+	now := time.Now()
+	updateExpression := "SET #status = :status, #status_date = :status_date, #updated_at = :updated_at"
+	expressionAttributeNames := map[string]string{
+		"#status":      "status",
+		"#status_date": "status_date",
+		"#updated_at":  "updated_at",
+	}
+	expressionAttributeValues := map[string]types.AttributeValue{
+		":status":      &types.AttributeValueMemberS{Value: string(status)},
+		":status_date": &types.AttributeValueMemberS{Value: statusDate(status, now)},
+		":updated_at":  &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+		":current":     &types.AttributeValueMemberS{Value: string(order.Status)},
+		":one":         &types.AttributeValueMemberN{Value: "1"},
+	}
+
+	if isPlaced(status) {
+		updateExpression += ", #placed_id = :placed_id"
+		expressionAttributeNames["#placed_id"] = "placed_id"
+		expressionAttributeValues[":placed_id"] = &types.AttributeValueMemberS{Value: string(status)}
+	} else {
+		updateExpression += " REMOVE #placed_id"
+		expressionAttributeNames["#placed_id"] = "placed_id"
+	}
+	updateExpression += " ADD #version :one"
+
+	// The table decides whether the caller's version is current. Without
+	// one the update holds the version read above, as a cancel releases the
+	// stock of the items read at that version and an item added since would
+	// otherwise never be returned to stock.
+	requested := version
+	if version == anyVersion {
+		version = order.Version
+	}
+	condition, names, values := versionCondition(version)
+	conditionExpression := "#status = :current AND " + condition
+	maps.Copy(expressionAttributeNames, names)
+	maps.Copy(expressionAttributeValues, values)
+
+	update := &types.Update{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(order.UserID)},
+			"sk": &types.AttributeValueMemberS{Value: orderSK(orderID)},
+		},
+		UpdateExpression:                    aws.String(updateExpression),
+		ConditionExpression:                 aws.String(conditionExpression),
+		ExpressionAttributeNames:            expressionAttributeNames,
+		ExpressionAttributeValues:           expressionAttributeValues,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+
+	if status == OrderStatusCancelled {
+		err = r.cancelOrder(ctx, order, update, requested)
+	} else {
+		_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                           update.TableName,
+			Key:                                 update.Key,
+			UpdateExpression:                    update.UpdateExpression,
+			ConditionExpression:                 update.ConditionExpression,
+			ExpressionAttributeNames:            update.ExpressionAttributeNames,
+			ExpressionAttributeValues:           update.ExpressionAttributeValues,
+			ReturnValuesOnConditionCheckFailure: update.ReturnValuesOnConditionCheckFailure,
+		})
+
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			err = statusUpdateError(ccf.Item, order, requested)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	order.Status = status
+	order.Version = version + 1
+	order.UpdatedAt = now
+	return order, nil
+}
+
+// statusUpdateError explains why a status update failed its condition, given
+// the order row as it was when the update ran
+func statusUpdateError(current map[string]types.AttributeValue, order *Order, version int64) error {
+	if len(current) == 0 {
+		return fmt.Errorf("%w: %s", ErrOrderNotFound, order.ID)
+	}
+
+	var latest Order
+	if err := attributevalue.UnmarshalMap(current, &latest); err != nil {
+		return err
+	}
+	if version != anyVersion && latest.Version != version {
+		return fmt.Errorf("%w: order %s is at version %d", ErrVersionMismatch, order.ID, latest.Version)
+	}
+	if latest.Status == order.Status {
+		return fmt.Errorf("%w: order %s changed during the update, retry", ErrOrderModified, order.ID)
+	}
+	return fmt.Errorf("%w: order is no longer %s", ErrInvalidTransition, order.Status)
+}
+
+// cancelOrder applies the status update together with returning the stock
+// reserved by the order's items to the catalog
+func (r *Repository) cancelOrder(ctx context.Context, order *Order, update *types.Update, version int64) error {
+	reserved, err := r.reservedStock(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		transactItems := []types.TransactWriteItem{{Update: update}}
+		for sku, quantity := range reserved {
+			release, err := r.releaseStock(ctx, sku, quantity)
+			if err != nil {
+				return err
+			}
+			if release != nil {
+				transactItems = append(transactItems, types.TransactWriteItem{Update: release})
+			}
+		}
+
+		// Orders written before maxOrderLines was enforced can be over it
+		if len(transactItems) > maxTransactItems {
+			return fmt.Errorf("%w: order %s has more than %d products to return to stock", ErrOrderFull, order.ID, maxOrderLines)
+		}
+
+		_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: transactItems,
+		})
+		if reason, ok := cancellationReason(err, 0); ok {
+			return statusUpdateError(reason.Item, order, version)
+		}
+		if !releaseFailed(err, 1) {
+			return err
+		}
+		if attempt == maxReleaseAttempts {
+			return fmt.Errorf("%w: products of order %s kept being removed, retry", ErrOrderModified, order.ID)
+		}
+	}
+}
+
+// UpdateOrderAddress ships the order to another of its user's addresses,
+// copying it onto the order like CreateOrder. The shipping address is frozen
+// once the order has shipped.
+func (r *Repository) UpdateOrderAddress(ctx context.Context, orderID, addressKey string, version int64) (*Order, error) {
+	order, err := r.GetOrderByID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.Status.ItemsEditable() {
+		return nil, fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+
+	// Without a version from the caller hold the version read above
+	requested := version
+	if version == anyVersion {
+		version = order.Version
+	}
+
+	profileCheck, address, err := r.addressCheck(ctx, order.UserID, addressKey)
+	if err != nil {
+		return nil, err
+	}
+	shippingAddress, err := attributevalue.Marshal(address)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
+	condition, names, values := versionCondition(version)
+	names["#status"] = "status"
+	maps.Copy(values, map[string]types.AttributeValue{
+		":address_key":      &types.AttributeValueMemberS{Value: addressKey},
+		":shipping_address": shippingAddress,
+		":updated_at":       &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+		":one":              &types.AttributeValueMemberN{Value: "1"},
+		":pending":          &types.AttributeValueMemberS{Value: string(OrderStatusPending)},
+		":confirmed":        &types.AttributeValueMemberS{Value: string(OrderStatusConfirmed)},
+	})
+
+	_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{ConditionCheck: profileCheck},
+			{
+				Update: &types.Update{
+					TableName: aws.String(r.tableName),
+					Key: map[string]types.AttributeValue{
+						"pk": &types.AttributeValueMemberS{Value: userPK(order.UserID)},
+						"sk": &types.AttributeValueMemberS{Value: orderSK(orderID)},
+					},
+					UpdateExpression:                    aws.String("SET address_key = :address_key, shipping_address = :shipping_address, updated_at = :updated_at ADD #version :one"),
+					ConditionExpression:                 aws.String("#status IN (:pending, :confirmed) AND " + condition),
+					ExpressionAttributeNames:            names,
+					ExpressionAttributeValues:           values,
+					ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+				},
+			},
+		},
+	})
+
+	if reason, ok := cancellationReason(err, 0); ok {
+		return nil, addressCheckError(reason, order.UserID, addressKey)
+	}
+	if reason, ok := cancellationReason(err, 1); ok {
+		if len(reason.Item) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+		}
+		var latest Order
+		if err := attributevalue.UnmarshalMap(reason.Item, &latest); err != nil {
+			return nil, err
+		}
+		switch {
+		case !latest.Status.ItemsEditable():
+			return nil, fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, latest.Status)
+		case requested != anyVersion:
+			return nil, fmt.Errorf("%w: order %s is at version %d", ErrVersionMismatch, orderID, latest.Version)
+		}
+		return nil, fmt.Errorf("%w: order %s changed during the update, retry", ErrOrderModified, orderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	order.AddressKey = addressKey
+	order.ShippingAddress = address
+	order.UpdatedAt = now
+	order.Version = version + 1
+	return order, nil
+}
+
+func (r *Repository) GetPendingOrders(ctx context.Context, page PageRequest) (Page[*Order], error) {
+	items, next, err := r.queryPage(ctx, "pending-orders", page, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		IndexName:              aws.String("placed-index"),
+		KeyConditionExpression: aws.String("placed_id = :placed_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":placed_id": &types.AttributeValueMemberS{Value: string(OrderStatusPending)},
+		},
+	})
+	if err != nil {
+		return Page[*Order]{}, err
+	}
+
+	var orders []*Order
+	for _, item := range items {
+		var order Order
+		if err := attributevalue.UnmarshalMap(item, &order); err != nil {
+			continue
+		}
+		orders = append(orders, &order)
+	}
+
+	return Page[*Order]{Items: orders, NextCursor: next}, nil
+}
+
+// Product Operations
+
+func (r *Repository) CreateProduct(ctx context.Context, product Product) error {
+	productMap, err := r.productItem(product)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                productMap,
+		ConditionExpression: aws.String("attribute_not_exists(pk)"),
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("%w: %s", ErrProductExists, product.SKU)
+	}
+	return err
+}
+
+func (r *Repository) GetProduct(ctx context.Context, sku string) (*Product, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       productKey(sku),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+
+	var product Product
+	if err := attributevalue.UnmarshalMap(result.Item, &product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// ListProducts queries the inverted-index, where every product shares the
+// same sk and is sorted by pk
+func (r *Repository) ListProducts(ctx context.Context, page PageRequest) (Page[Product], error) {
+	items, next, err := r.queryPage(ctx, "products", page, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		IndexName:              aws.String("inverted-index"),
+		KeyConditionExpression: aws.String("sk = :sk AND begins_with(pk, :pk_prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sk":        &types.AttributeValueMemberS{Value: productSK},
+			":pk_prefix": &types.AttributeValueMemberS{Value: productPrefix},
+		},
+	})
+	if err != nil {
+		return Page[Product]{}, err
+	}
+
+	var products []Product
+	for _, item := range items {
+		var product Product
+		if err := attributevalue.UnmarshalMap(item, &product); err != nil {
+			continue
+		}
+		products = append(products, product)
+	}
+
+	return Page[Product]{Items: products, NextCursor: next}, nil
+}
+
+// UpdateProduct replaces the catalog fields of an existing product and adds
+// the stock adjustment with ADD, so reservations made by orders in the
+// meantime are kept. A negative adjustment fails with InsufficientStockError
+// if it would take the stock below zero.
+func (r *Repository) UpdateProduct(ctx context.Context, sku string, update ProductUpdate) (*Product, error) {
+	unitPrice, err := attributevalue.Marshal(update.UnitPrice)
+	if err != nil {
+		return nil, err
+	}
+
+	updateExpression := "SET #name = :name, unit_price = :unit_price, currency = :currency"
+	conditionExpression := "attribute_exists(pk)"
+	names := map[string]string{"#name": "name", "#description": "description"}
+	values := map[string]types.AttributeValue{
+		":name":       &types.AttributeValueMemberS{Value: update.Name},
+		":unit_price": unitPrice,
+		":currency":   &types.AttributeValueMemberS{Value: update.Currency},
+	}
+	if update.Description != "" {
+		updateExpression += ", #description = :description"
+		values[":description"] = &types.AttributeValueMemberS{Value: update.Description}
+	}
+	if update.StockAdjustment != 0 {
+		updateExpression += " ADD stock :adjustment"
+		values[":adjustment"] = &types.AttributeValueMemberN{Value: strconv.Itoa(update.StockAdjustment)}
+	}
+	if update.StockAdjustment < 0 {
+		conditionExpression += " AND stock >= :taken"
+		values[":taken"] = &types.AttributeValueMemberN{Value: strconv.Itoa(-update.StockAdjustment)}
+	}
+	if update.Description == "" {
+		updateExpression += " REMOVE #description"
+	}
+
+	result, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(r.tableName),
+		Key:                                 productKey(sku),
+		UpdateExpression:                    aws.String(updateExpression),
+		ConditionExpression:                 aws.String(conditionExpression),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil, stockError(types.CancellationReason{Item: ccf.Item}, sku, -update.StockAdjustment)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var product Product
+	if err := attributevalue.UnmarshalMap(result.Attributes, &product); err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+func (r *Repository) DeleteProduct(ctx context.Context, sku string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 productKey(sku),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+	})
+
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+	return err
+}
+
+func (r *Repository) productItem(product Product) (map[string]types.AttributeValue, error) {
+	productMap, err := attributevalue.MarshalMap(product)
+	if err != nil {
+		return nil, err
+	}
+
+	maps.Copy(productMap, productKey(product.SKU))
+	return productMap, nil
+}
+
+func productKey(sku string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: productPK(sku)},
+		"sk": &types.AttributeValueMemberS{Value: productSK},
+	}
+}
+
+// Order Item Operations
+
+// CreateOrderItem adds a line for item.SKU to the order, taking the name and
+// price from the product catalog
+func (r *Repository) CreateOrderItem(ctx context.Context, orderID string, item *OrderItem) error {
+	order, err := r.lookupOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if !order.Status.ItemsEditable() {
+		return fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+
+	product, err := r.GetProduct(ctx, item.SKU)
+	if err != nil {
+		return err
+	}
+	if err := checkCurrency(order, product); err != nil {
+		return err
+	}
+	item.Name = product.Name
+	item.Price = product.UnitPrice
+	item.Currency = currencyOrDefault(product.Currency)
+	if item.Description == "" {
+		item.Description = product.Description
+	}
+
+	itemMap, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+
+	itemMap["pk"] = &types.AttributeValueMemberS{Value: orderPK(orderID)}
+	itemMap["sk"] = &types.AttributeValueMemberS{Value: itemSK(item.ItemID)}
+
+	// Reserve the stock and add to the order totals in the same transaction
+	// that writes the item so two orders can never oversell a product
+	_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: r.orderTotalsUpdate(order, 1, item.Quantity, item.Price.Mul(item.Quantity))},
+			{Update: r.reserveStock(item.SKU, item.Quantity)},
+			{
+				Put: &types.Put{
+					TableName:           aws.String(r.tableName),
+					Item:                itemMap,
+					ConditionExpression: aws.String("attribute_not_exists(pk)"),
+				},
+			},
+		},
+	})
+
+	if reason, ok := cancellationReason(err, 0); ok {
+		return orderError(reason, orderID)
+	}
+	if reason, ok := cancellationReason(err, 1); ok {
+		return stockError(reason, item.SKU, item.Quantity)
+	}
+	return err
+}
+
+// UpdateOrderItem changes the quantity or description of an item while its
+// order is still pending or confirmed. A change in quantity reserves or
+// releases the difference in stock.
+func (r *Repository) UpdateOrderItem(ctx context.Context, orderID, itemID string, update OrderItemUpdate) (*OrderItem, error) {
+	order, item, err := r.editableOrderItem(ctx, orderID, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	previousQuantity := item.Quantity
+	if update.Quantity != nil {
+		item.Quantity = *update.Quantity
+	}
+	if update.Description != nil {
+		item.Description = *update.Description
+	}
+
+	delta := item.Quantity - previousQuantity
+	for attempt := 1; ; attempt++ {
+		transactItems := []types.TransactWriteItem{
+			{Update: r.orderTotalsUpdate(order, 0, delta, item.Price.Mul(delta))},
+			{
+				Update: &types.Update{
+					TableName:        aws.String(r.tableName),
+					Key:              orderItemKey(orderID, itemID),
+					UpdateExpression: aws.String("SET quantity = :qty, description = :description"),
+					// The stock adjustment is only right if nobody else
+					// changed the quantity since we read it
+					ConditionExpression: aws.String("quantity = :previous"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":qty":         &types.AttributeValueMemberN{Value: strconv.Itoa(item.Quantity)},
+						":description": &types.AttributeValueMemberS{Value: item.Description},
+						":previous":    &types.AttributeValueMemberN{Value: strconv.Itoa(previousQuantity)},
+					},
+				},
+			},
+		}
+
+		switch {
+		case delta > 0:
+			transactItems = append(transactItems, types.TransactWriteItem{Update: r.reserveStock(item.SKU, delta)})
+		case delta < 0:
+			release, err := r.releaseStock(ctx, item.SKU, -delta)
+			if err != nil {
+				return nil, err
+			}
+			if release != nil {
+				transactItems = append(transactItems, types.TransactWriteItem{Update: release})
+			}
+		}
+
+		_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: transactItems,
+		})
+		if reason, ok := cancellationReason(err, 0); ok {
+			return nil, orderError(reason, orderID)
+		}
+		if _, ok := cancellationReason(err, 1); ok {
+			return nil, fmt.Errorf("%w: %s", ErrItemModified, itemID)
+		}
+		if reason, ok := cancellationReason(err, 2); ok && delta > 0 {
+			return nil, stockError(reason, item.SKU, delta)
+		}
+		if !releaseFailed(err, 2) {
+			break
+		}
+		if attempt == maxReleaseAttempts {
+			return nil, fmt.Errorf("%w: product %s kept being removed, retry", ErrItemModified, item.SKU)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// DeleteOrderItem removes an item from a pending or confirmed order and
+// returns its quantity to stock
+func (r *Repository) DeleteOrderItem(ctx context.Context, orderID, itemID string) error {
+	order, item, err := r.editableOrderItem(ctx, orderID, itemID)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		transactItems := []types.TransactWriteItem{
+			{Update: r.orderTotalsUpdate(order, -1, -item.Quantity, -item.Price.Mul(item.Quantity))},
+			{
+				Delete: &types.Delete{
+					TableName:           aws.String(r.tableName),
+					Key:                 orderItemKey(orderID, itemID),
+					ConditionExpression: aws.String("quantity = :qty"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":qty": &types.AttributeValueMemberN{Value: strconv.Itoa(item.Quantity)},
+					},
+				},
+			},
+		}
+
+		release, err := r.releaseStock(ctx, item.SKU, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if release != nil {
+			transactItems = append(transactItems, types.TransactWriteItem{Update: release})
+		}
+
+		_, err = r.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: transactItems,
+		})
+		if reason, ok := cancellationReason(err, 0); ok {
+			return orderError(reason, orderID)
+		}
+		if _, ok := cancellationReason(err, 1); ok {
+			return fmt.Errorf("%w: %s", ErrItemModified, itemID)
+		}
+		if !releaseFailed(err, 2) {
+			return err
+		}
+		if attempt == maxReleaseAttempts {
+			return fmt.Errorf("%w: product %s kept being removed, retry", ErrItemModified, item.SKU)
+		}
+	}
+}
+
+// editableOrderItem loads an item along with its order, failing if the order
+// no longer allows item changes
+func (r *Repository) editableOrderItem(ctx context.Context, orderID, itemID string) (*Order, *OrderItem, error) {
+	order, err := r.lookupOrder(ctx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !order.Status.ItemsEditable() {
+		return nil, nil, fmt.Errorf("%w: order %s is %s", ErrOrderLocked, orderID, order.Status)
+	}
+
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       orderItemKey(orderID, itemID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Item == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrItemNotFound, itemID)
+	}
+
+	var item OrderItem
+	if err := attributevalue.UnmarshalMap(result.Item, &item); err != nil {
+		return nil, nil, err
+	}
+	return order, &item, nil
+}
+
+// orderTotalsUpdate adjusts the item count and subtotal kept on the order
+// row, and item_lines, the number of items on it, by lines. It fails the
+// transaction if the order no longer exists, has moved past the statuses that
+// allow item changes or would go over maxOrderLines, see orderError.
+func (r *Repository) orderTotalsUpdate(order *Order, lines, quantity int, amount Amount) *types.Update {
+	conditionExpression := "attribute_exists(pk) AND #status IN (:pending, :confirmed)"
+	values := map[string]types.AttributeValue{
+		":one":        &types.AttributeValueMemberN{Value: "1"},
+		":lines":      &types.AttributeValueMemberN{Value: strconv.Itoa(lines)},
+		":qty":        &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+		":amount":     &types.AttributeValueMemberN{Value: amount.String()},
+		":updated_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		":pending":    &types.AttributeValueMemberS{Value: string(OrderStatusPending)},
+		":confirmed":  &types.AttributeValueMemberS{Value: string(OrderStatusConfirmed)},
+	}
+	if lines > 0 {
+		conditionExpression += " AND (attribute_not_exists(item_lines) OR item_lines <= :max_lines)"
+		values[":max_lines"] = &types.AttributeValueMemberN{Value: strconv.Itoa(maxOrderLines - lines)}
+	}
+
+	return &types.Update{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: userPK(order.UserID)},
+			"sk": &types.AttributeValueMemberS{Value: orderSK(order.ID)},
+		},
+		UpdateExpression:    aws.String("ADD item_lines :lines, item_count :qty, subtotal :amount, #version :one SET updated_at = :updated_at"),
+		ConditionExpression: aws.String(conditionExpression),
+		ExpressionAttributeNames: map[string]string{
+			"#status":  "status",
+			"#version": "version",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+}
+
+// orderError explains why an orderTotalsUpdate failed its condition. An
+// order that still allows item changes can only have failed on the line cap.
+func orderError(reason types.CancellationReason, orderID string) error {
+	if len(reason.Item) == 0 {
+		return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+
+	var latest Order
+	if err := attributevalue.UnmarshalMap(reason.Item, &latest); err != nil {
+		return err
+	}
+	if latest.Status.ItemsEditable() {
+		return fmt.Errorf("%w: order %s already has %d items", ErrOrderFull, orderID, maxOrderLines)
+	}
+	return fmt.Errorf("%w: order %s", ErrOrderLocked, orderID)
+}
+
+// reserveStock takes quantity out of a product's stock, failing the
+// transaction if there is not enough left
+func (r *Repository) reserveStock(sku string, quantity int) *types.Update {
+	return &types.Update{
+		TableName:           aws.String(r.tableName),
+		Key:                 productKey(sku),
+		UpdateExpression:    aws.String("SET stock = stock - :qty"),
+		ConditionExpression: aws.String("attribute_exists(pk) AND stock >= :qty"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":qty": &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}
+}
+
+// releaseStock returns quantity to a product's stock. It returns nil when the
+// product has been removed from the catalog, as there is nothing to return
+// the stock to.
+func (r *Repository) releaseStock(ctx context.Context, sku string, quantity int) (*types.Update, error) {
+	if _, err := r.GetProduct(ctx, sku); errors.Is(err, ErrProductNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &types.Update{
+		TableName:           aws.String(r.tableName),
+		Key:                 productKey(sku),
+		UpdateExpression:    aws.String("ADD stock :qty"),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":qty": &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+		},
+	}, nil
+}
+
+// maxReleaseAttempts bounds how often a transaction that returns stock is
+// built again after one of its products was removed from the catalog
+const maxReleaseAttempts = 3
+
+// releaseFailed reports whether a transaction was cancelled by one of the
+// releaseStock updates from index first on. They only fail once their product
+// is gone, and building the transaction again leaves that product out.
+func releaseFailed(err error, first int) bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return false
+	}
+	for _, reason := range tce.CancellationReasons[min(first, len(tce.CancellationReasons)):] {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
+// stockError explains why a reserveStock update failed its condition
+func stockError(reason types.CancellationReason, sku string, requested int) error {
+	if reason.Item == nil {
+		return fmt.Errorf("%w: %s", ErrProductNotFound, sku)
+	}
+
+	var current Product
+	if err := attributevalue.UnmarshalMap(reason.Item, &current); err != nil {
+		return err
+	}
+	return &InsufficientStockError{SKU: sku, Requested: requested, Available: current.Stock}
+}
+
+func orderItemKey(orderID, itemID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: orderPK(orderID)},
+		"sk": &types.AttributeValueMemberS{Value: itemSK(itemID)},
+	}
+}
+
+// reservedStock totals the quantity of every SKU on an order. The read is
+// consistent so it sees every item written before the order row was read.
+func (r *Repository) reservedStock(ctx context.Context, orderID string) (map[string]int, error) {
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":        &types.AttributeValueMemberS{Value: orderPK(orderID)},
+			":sk_prefix": &types.AttributeValueMemberS{Value: itemPrefix},
+		},
+	})
+
+	reserved := make(map[string]int)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range page.Items {
+			var item OrderItem
+			if err := attributevalue.UnmarshalMap(row, &item); err != nil {
+				return nil, err
+			}
+			if item.SKU != "" {
+				reserved[item.SKU] += item.Quantity
+			}
+		}
+	}
+	return reserved, nil
+}
+
+// cancellationReason returns the reason a transaction was cancelled if the
+// action at index failed its condition check
+func cancellationReason(err error, index int) (types.CancellationReason, bool) {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) || index >= len(tce.CancellationReasons) {
+		return types.CancellationReason{}, false
+	}
+
+	reason := tce.CancellationReasons[index]
+	return reason, aws.ToString(reason.Code) == "ConditionalCheckFailed"
+}
+
+func (r *Repository) GetOrderItems(ctx context.Context, orderID string, page PageRequest) (Page[OrderItem], error) {
+	rows, next, err := r.queryPage(ctx, "order-items:"+orderID, page, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :sk_prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":        &types.AttributeValueMemberS{Value: orderPK(orderID)},
+			":sk_prefix": &types.AttributeValueMemberS{Value: itemPrefix},
+		},
+	})
+	if err != nil {
+		return Page[OrderItem]{}, err
+	}
+
 	var items []OrderItem
-	for _, item := range result.Items {
+	for _, item := range rows {
 		var orderItem OrderItem
 		if err := attributevalue.UnmarshalMap(item, &orderItem); err != nil {
 			continue
@@ -407,5 +1766,5 @@ func (r *Repository) GetOrderItems(ctx context.Context, orderID string) ([]Order
 		items = append(items, orderItem)
 	}
 
-	return items, nil
+	return Page[OrderItem]{Items: items, NextCursor: next}, nil
 }
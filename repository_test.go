@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// newTestOrder stores user john with a home address, product LAPTOP-01 with
+// stock in stock and a pending order of john's
+func newTestOrder(t *testing.T, repo *Repository, stock int) *Order {
+	t.Helper()
+	ctx := context.Background()
+
+	user := &User{Username: "john", Addresses: map[string]Address{"home": {Street: "1 Main St", Country: "US"}}}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	product := Product{SKU: "LAPTOP-01", Name: "Laptop", UnitPrice: 129999, Currency: "USD", Stock: stock}
+	if err := repo.CreateProduct(ctx, product); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+
+	order := &Order{
+		ID:         fmt.Sprintf("order-%d", time.Now().UnixNano()),
+		UserID:     "john",
+		Status:     OrderStatusPending,
+		AddressKey: "home",
+		Currency:   defaultCurrency,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	if err := repo.CreateOrder(ctx, order); err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	return order
+}
+
+// stockOf returns the stock of a product, failing the test if it cannot be
+// read
+func stockOf(t *testing.T, repo *Repository, sku string) int {
+	t.Helper()
+	product, err := repo.GetProduct(context.Background(), sku)
+	if err != nil {
+		t.Fatalf("GetProduct(%s): %v", sku, err)
+	}
+	return product.Stock
+}
+
+func TestRepositoryProducts(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	for i := range 12 {
+		product := Product{SKU: fmt.Sprintf("SKU-%02d", i), Name: "Product", UnitPrice: 999, Currency: "USD", Stock: 5}
+		if err := repo.CreateProduct(ctx, product); err != nil {
+			t.Fatalf("CreateProduct(%s): %v", product.SKU, err)
+		}
+	}
+	if err := repo.CreateProduct(ctx, Product{SKU: "SKU-00", Name: "Again"}); !errors.Is(err, ErrProductExists) {
+		t.Errorf("creating an existing product: %v, want ErrProductExists", err)
+	}
+
+	var listed []string
+	page := PageRequest{Limit: 5}
+	for {
+		products, err := repo.ListProducts(ctx, page)
+		if err != nil {
+			t.Fatalf("ListProducts: %v", err)
+		}
+		for _, product := range products.Items {
+			listed = append(listed, product.SKU)
+		}
+		if products.NextCursor == "" {
+			break
+		}
+		page.Cursor = products.NextCursor
+	}
+	if len(listed) != 12 || listed[0] != "SKU-00" || listed[11] != "SKU-11" {
+		t.Errorf("listed %v, want SKU-00 to SKU-11", listed)
+	}
+
+	product, err := repo.UpdateProduct(ctx, "SKU-00", ProductUpdate{Name: "Renamed", UnitPrice: 1050, Currency: "USD", StockAdjustment: 3})
+	if err != nil {
+		t.Fatalf("UpdateProduct: %v", err)
+	}
+	if product.Name != "Renamed" || product.UnitPrice != 1050 || product.Stock != 8 {
+		t.Errorf("updated product = %+v, want Renamed at 10.50 with 8 in stock", product)
+	}
+
+	_, err = repo.UpdateProduct(ctx, "SKU-00", ProductUpdate{Name: "Renamed", Currency: "USD", StockAdjustment: -9})
+	var stockErr *InsufficientStockError
+	if !errors.As(err, &stockErr) || stockErr.Available != 8 || stockErr.Requested != 9 {
+		t.Errorf("taking more stock than there is: %v, want InsufficientStockError with 8 available", err)
+	}
+	if _, err := repo.UpdateProduct(ctx, "MISSING", ProductUpdate{Name: "Missing", Currency: "USD"}); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("updating a missing product: %v, want ErrProductNotFound", err)
+	}
+
+	if err := repo.DeleteProduct(ctx, "SKU-00"); err != nil {
+		t.Fatalf("DeleteProduct: %v", err)
+	}
+	if _, err := repo.GetProduct(ctx, "SKU-00"); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("getting a deleted product: %v, want ErrProductNotFound", err)
+	}
+	if err := repo.DeleteProduct(ctx, "SKU-00"); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("deleting a deleted product: %v, want ErrProductNotFound", err)
+	}
+}
+
+func TestRepositoryStockReservation(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	order := newTestOrder(t, repo, 5)
+
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-1", SKU: "LAPTOP-01", Quantity: 3}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 2 {
+		t.Errorf("stock after reserving 3 = %d, want 2", stock)
+	}
+
+	err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-2", SKU: "LAPTOP-01", Quantity: 3})
+	var stockErr *InsufficientStockError
+	if !errors.As(err, &stockErr) || stockErr.Available != 2 {
+		t.Fatalf("overselling: %v, want InsufficientStockError with 2 available", err)
+	}
+	if _, _, err := repo.editableOrderItem(ctx, order.ID, "item-2"); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("item of the failed reservation: %v, want ErrItemNotFound", err)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-3", SKU: "MISSING", Quantity: 1}); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("adding a missing product: %v, want ErrProductNotFound", err)
+	}
+
+	if _, err := repo.UpdateOrderStatus(ctx, order.ID, OrderStatusCancelled, anyVersion); err != nil {
+		t.Fatalf("cancelling: %v", err)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 5 {
+		t.Errorf("stock after cancelling = %d, want 5", stock)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-4", SKU: "LAPTOP-01", Quantity: 1}); !errors.Is(err, ErrOrderLocked) {
+		t.Errorf("adding to a cancelled order: %v, want ErrOrderLocked", err)
+	}
+}
+
+// removeProductAt deletes sku from the catalog just before the next op
+// request reaches the fake, after the repository has read the product
+func removeProductAt(t *testing.T, repo *Repository, fake *fakeDynamo, op, sku string) {
+	t.Helper()
+	var removed atomic.Bool
+	fake.intercept = func(name string) *fakeError {
+		if name == op && removed.CompareAndSwap(false, true) {
+			if err := repo.DeleteProduct(context.Background(), sku); err != nil {
+				t.Errorf("DeleteProduct(%s): %v", sku, err)
+			}
+		}
+		return nil
+	}
+}
+
+func TestRepositoryCancelRemovedProduct(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	order := newTestOrder(t, repo, 5)
+	if err := repo.CreateProduct(ctx, Product{SKU: "MOUSE-01", Name: "Mouse", UnitPrice: 1999, Currency: "USD", Stock: 5}); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	for i, sku := range []string{"LAPTOP-01", "MOUSE-01"} {
+		if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: fmt.Sprintf("item-%d", i), SKU: sku, Quantity: 2}); err != nil {
+			t.Fatalf("CreateOrderItem(%s): %v", sku, err)
+		}
+	}
+
+	// The mouse is gone by the time its stock is returned
+	removeProductAt(t, repo, fake, "TransactWriteItems", "MOUSE-01")
+	cancelled, err := repo.UpdateOrderStatus(ctx, order.ID, OrderStatusCancelled, anyVersion)
+	fake.intercept = nil
+	if err != nil {
+		t.Fatalf("cancelling with a product removed: %v", err)
+	}
+	if cancelled.Status != OrderStatusCancelled {
+		t.Errorf("status = %s, want cancelled", cancelled.Status)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 5 {
+		t.Errorf("laptop stock after cancelling = %d, want 5", stock)
+	}
+	if _, err := repo.GetProduct(ctx, "MOUSE-01"); !errors.Is(err, ErrProductNotFound) {
+		t.Errorf("removed mouse: %v, want ErrProductNotFound", err)
+	}
+}
+
+func TestRepositoryOrderLines(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	order := newTestOrder(t, repo, 200)
+
+	for i := range maxOrderLines {
+		if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: fmt.Sprintf("item-%03d", i), SKU: "LAPTOP-01", Quantity: 1}); err != nil {
+			t.Fatalf("adding item %d: %v", i, err)
+		}
+	}
+	err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "one-too-many", SKU: "LAPTOP-01", Quantity: 1})
+	if !errors.Is(err, ErrOrderFull) {
+		t.Fatalf("adding item %d: %v, want ErrOrderFull", maxOrderLines+1, err)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 200-maxOrderLines {
+		t.Errorf("stock = %d, want %d", stock, 200-maxOrderLines)
+	}
+
+	if err := repo.DeleteOrderItem(ctx, order.ID, "item-000"); err != nil {
+		t.Fatalf("DeleteOrderItem: %v", err)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "one-too-many", SKU: "LAPTOP-01", Quantity: 1}); err != nil {
+		t.Errorf("adding an item after removing one: %v", err)
+	}
+}
+
+func TestRepositoryOrderItemChanges(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	order := newTestOrder(t, repo, 5)
+
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-1", SKU: "LAPTOP-01", Quantity: 2}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+
+	quantity, description := 4, "gift wrapped"
+	item, err := repo.UpdateOrderItem(ctx, order.ID, "item-1", OrderItemUpdate{Quantity: &quantity, Description: &description})
+	if err != nil {
+		t.Fatalf("UpdateOrderItem: %v", err)
+	}
+	if item.Quantity != 4 || item.Description != "gift wrapped" {
+		t.Errorf("updated item = %+v, want 4 gift wrapped", item)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 1 {
+		t.Errorf("stock after raising the quantity to 4 = %d, want 1", stock)
+	}
+
+	quantity = 6
+	_, err = repo.UpdateOrderItem(ctx, order.ID, "item-1", OrderItemUpdate{Quantity: &quantity})
+	var stockErr *InsufficientStockError
+	if !errors.As(err, &stockErr) || stockErr.Requested != 2 || stockErr.Available != 1 {
+		t.Errorf("raising the quantity past the stock: %v, want InsufficientStockError for 2 with 1 available", err)
+	}
+
+	quantity = 1
+	if _, err := repo.UpdateOrderItem(ctx, order.ID, "item-1", OrderItemUpdate{Quantity: &quantity}); err != nil {
+		t.Fatalf("lowering the quantity: %v", err)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 4 {
+		t.Errorf("stock after lowering the quantity to 1 = %d, want 4", stock)
+	}
+
+	if err := repo.DeleteOrderItem(ctx, order.ID, "item-1"); err != nil {
+		t.Fatalf("DeleteOrderItem: %v", err)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 5 {
+		t.Errorf("stock after deleting the item = %d, want 5", stock)
+	}
+	if err := repo.DeleteOrderItem(ctx, order.ID, "item-1"); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("deleting a deleted item: %v, want ErrItemNotFound", err)
+	}
+
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "item-2", SKU: "LAPTOP-01", Quantity: 1}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+	for _, status := range []OrderStatus{OrderStatusConfirmed, OrderStatusShipped} {
+		if _, err := repo.UpdateOrderStatus(ctx, order.ID, status, anyVersion); err != nil {
+			t.Fatalf("moving the order to %s: %v", status, err)
+		}
+	}
+	if _, err := repo.UpdateOrderItem(ctx, order.ID, "item-2", OrderItemUpdate{Quantity: &quantity}); !errors.Is(err, ErrOrderLocked) {
+		t.Errorf("updating an item of a shipped order: %v, want ErrOrderLocked", err)
+	}
+	if err := repo.DeleteOrderItem(ctx, order.ID, "item-2"); !errors.Is(err, ErrOrderLocked) {
+		t.Errorf("deleting an item of a shipped order: %v, want ErrOrderLocked", err)
+	}
+}
+
+func TestRepositoryItemRemovedProduct(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	order := newTestOrder(t, repo, 5)
+	if err := repo.CreateProduct(ctx, Product{SKU: "MOUSE-01", Name: "Mouse", UnitPrice: 1999, Currency: "USD", Stock: 5}); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "laptop", SKU: "LAPTOP-01", Quantity: 3}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "mouse", SKU: "MOUSE-01", Quantity: 2}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+
+	// Each product is gone by the time its stock is returned
+	quantity := 1
+	removeProductAt(t, repo, fake, "TransactWriteItems", "LAPTOP-01")
+	item, err := repo.UpdateOrderItem(ctx, order.ID, "laptop", OrderItemUpdate{Quantity: &quantity})
+	fake.intercept = nil
+	if err != nil {
+		t.Fatalf("lowering the quantity of a removed product: %v", err)
+	}
+	if item.Quantity != 1 {
+		t.Errorf("quantity = %d, want 1", item.Quantity)
+	}
+
+	removeProductAt(t, repo, fake, "TransactWriteItems", "MOUSE-01")
+	err = repo.DeleteOrderItem(ctx, order.ID, "mouse")
+	fake.intercept = nil
+	if err != nil {
+		t.Fatalf("deleting the item of a removed product: %v", err)
+	}
+
+	got, err := repo.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	if got.ItemCount != 1 || got.Subtotal != 129999 {
+		t.Errorf("totals = %d items, %s; want 1 item, 1299.99", got.ItemCount, got.Subtotal)
+	}
+}
+
+func TestRepositoryOrderTotals(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	order := newTestOrder(t, repo, 10)
+	if err := repo.CreateProduct(ctx, Product{SKU: "MOUSE-01", Name: "Mouse", UnitPrice: 1999, Currency: "USD", Stock: 10}); err != nil {
+		t.Fatalf("CreateProduct: %v", err)
+	}
+
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "laptops", SKU: "LAPTOP-01", Quantity: 3}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+	if err := repo.CreateOrderItem(ctx, order.ID, &OrderItem{ItemID: "mice", SKU: "MOUSE-01", Quantity: 2}); err != nil {
+		t.Fatalf("CreateOrderItem: %v", err)
+	}
+	quantity := 1
+	if _, err := repo.UpdateOrderItem(ctx, order.ID, "laptops", OrderItemUpdate{Quantity: &quantity}); err != nil {
+		t.Fatalf("UpdateOrderItem: %v", err)
+	}
+
+	got, err := repo.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	if got.ItemCount != 3 || got.Subtotal.String() != "1339.97" || got.Version != 4 {
+		t.Errorf("totals = %d items, %s at version %d; want 3 items, 1339.97 at version 4", got.ItemCount, got.Subtotal, got.Version)
+	}
+
+	if err := repo.DeleteOrderItem(ctx, order.ID, "mice"); err != nil {
+		t.Fatalf("DeleteOrderItem: %v", err)
+	}
+	got, err = repo.GetOrderByID(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("GetOrderByID: %v", err)
+	}
+	if got.ItemCount != 1 || got.Subtotal.String() != "1299.99" {
+		t.Errorf("totals after deleting the mice = %d items, %s; want 1 item, 1299.99", got.ItemCount, got.Subtotal)
+	}
+}
+
+func TestRepositoryOrderAddress(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	order := newTestOrder(t, repo, 5)
+
+	patch := UserPatch{Addresses: Patch[map[string]*AddressPatch]{
+		Set:   true,
+		Value: &map[string]*AddressPatch{"work": replaceAddress(Address{Street: "2 Side St", Country: "US"})},
+	}}
+	user, err := repo.UpdateUser(ctx, "john", patch, anyVersion)
+	if err != nil {
+		t.Fatalf("adding work address: %v", err)
+	}
+
+	moved, err := repo.UpdateOrderAddress(ctx, order.ID, "work", order.Version)
+	if err != nil {
+		t.Fatalf("UpdateOrderAddress: %v", err)
+	}
+	if moved.ShippingAddress == nil || moved.ShippingAddress.Street != "2 Side St" {
+		t.Errorf("shipping address = %+v, want 2 Side St", moved.ShippingAddress)
+	}
+	another := &Order{ID: "order-2", UserID: "john", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency, CreatedAt: time.Now()}
+	if err := repo.CreateOrder(ctx, another); err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if current, err := repo.GetUser(ctx, "john"); err != nil || current.Version != user.Version {
+		t.Errorf("user after placing and moving orders = %+v, %v; want version %d still", current, err, user.Version)
+	}
+
+	if _, err := repo.UpdateOrderAddress(ctx, order.ID, "office", anyVersion); !errors.Is(err, ErrAddressNotFound) {
+		t.Errorf("moving to a missing address: %v, want ErrAddressNotFound", err)
+	}
+	missing := &Order{ID: "order-3", UserID: "jane", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency, CreatedAt: time.Now()}
+	if err := repo.CreateOrder(ctx, missing); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ordering for a missing user: %v, want ErrUserNotFound", err)
+	}
+
+	// The address changes between being read and the order being written,
+	// either in a field it has or by gaining a state it lacked
+	changes := []struct {
+		key, field, value string
+	}{
+		{"home", "street", "3 New St"},
+		{"work", "state", "WA"},
+	}
+	for i, change := range changes {
+		fake.intercept = func(op string) *fakeError {
+			if op == "TransactWriteItems" {
+				profile := fake.item(userPK("john"), profileSK)
+				address := profile["addresses"].(*types.AttributeValueMemberM).Value[change.key].(*types.AttributeValueMemberM)
+				address.Value[change.field] = &types.AttributeValueMemberS{Value: change.value}
+				fake.putItem(profile)
+			}
+			return nil
+		}
+		changed := &Order{ID: fmt.Sprintf("order-%d", 4+i), UserID: "john", Status: OrderStatusPending, AddressKey: change.key, Currency: defaultCurrency, CreatedAt: time.Now()}
+		err = repo.CreateOrder(ctx, changed)
+		fake.intercept = nil
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("ordering while the %s %s changes: %v, want ErrConflict", change.key, change.field, err)
+		}
+	}
+
+	for _, status := range []OrderStatus{OrderStatusConfirmed, OrderStatusShipped} {
+		if _, err := repo.UpdateOrderStatus(ctx, order.ID, status, anyVersion); err != nil {
+			t.Fatalf("moving the order to %s: %v", status, err)
+		}
+	}
+	if _, err := repo.UpdateOrderAddress(ctx, order.ID, "home", anyVersion); !errors.Is(err, ErrOrderLocked) {
+		t.Errorf("moving a shipped order: %v, want ErrOrderLocked", err)
+	}
+}
+
+func TestRepositoryReplaceUserAnyVersion(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	if err := repo.CreateUser(ctx, &User{Username: "john", Email: "john@example.com"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	// Another write lands after the caller last read the user
+	var bumped atomic.Bool
+	fake.intercept = func(op string) *fakeError {
+		if op == "UpdateItem" && bumped.CompareAndSwap(false, true) {
+			profile := fake.item(userPK("john"), profileSK)
+			profile["version"] = &types.AttributeValueMemberN{Value: "7"}
+			fake.putItem(profile)
+		}
+		return nil
+	}
+	user := &User{Username: "john", FullName: "John Smith"}
+	err := repo.ReplaceUser(ctx, user, anyVersion)
+	fake.intercept = nil
+	if err != nil {
+		t.Fatalf("ReplaceUser: %v", err)
+	}
+	if user.Version != 8 {
+		t.Errorf("version = %d, want 8", user.Version)
+	}
+
+	got, err := repo.GetUser(ctx, "john")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if got.FullName != "John Smith" || got.Email != "" || got.Version != 8 {
+		t.Errorf("replaced user = %+v, want John Smith without an email at version 8", got)
+	}
+
+	if err := repo.ReplaceUser(ctx, &User{Username: "jane"}, anyVersion); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("replacing a missing user: %v, want ErrUserNotFound", err)
+	}
+	if err := repo.ReplaceUser(ctx, &User{Username: "john"}, 3); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("replacing an old version: %v, want ErrVersionMismatch", err)
+	}
+}
+
+func TestRepositoryPatchAddresses(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	user := &User{
+		Username:       "john",
+		Addresses:      map[string]Address{"home": {Street: "1 Main St", Country: "US"}},
+		DefaultAddress: "home",
+	}
+	if err := repo.CreateUser(ctx, user); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	tests := []struct {
+		patch string
+		want  []string
+	}{
+		{`{"addresses": {}}`, []string{"home"}},
+		{`{"addresses": {}, "full_name": "John Smith"}`, []string{"home"}},
+		{`{"addresses": {"work": {"street": "2 High St", "country": "US"}}}`, []string{"home", "work"}},
+		{`{"addresses": {"work": null}}`, []string{"home"}},
+		{`{"addresses": null, "default_address": null}`, nil},
+		{`{"addresses": {"home": {"street": "3 Low St", "country": "US"}}}`, []string{"home"}},
+	}
+	for i, tt := range tests {
+		var patch UserPatch
+		if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+			t.Fatalf("decoding %s: %v", tt.patch, err)
+		}
+		updated, err := repo.UpdateUser(ctx, "john", patch, anyVersion)
+		if err != nil {
+			t.Fatalf("UpdateUser(%s): %v", tt.patch, err)
+		}
+		got := slices.Sorted(maps.Keys(updated.Addresses))
+		if !slices.Equal(got, tt.want) || updated.Version != int64(i+2) {
+			t.Errorf("UpdateUser(%s) = addresses %v at version %d, want %v at version %d",
+				tt.patch, got, updated.Version, tt.want, i+2)
+		}
+	}
+}
+
+func TestRepositoryShippingAddress(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t)
+	order := newTestOrder(t, repo, 5)
+
+	setHome := func(street string) {
+		t.Helper()
+		patch := UserPatch{Addresses: Patch[map[string]*AddressPatch]{
+			Set:   true,
+			Value: &map[string]*AddressPatch{"home": replaceAddress(Address{Street: street, Country: "US"})},
+		}}
+		if _, err := repo.UpdateUser(ctx, "john", patch, anyVersion); err != nil {
+			t.Fatalf("moving home to %s: %v", street, err)
+		}
+	}
+	shipsTo := func(want string) {
+		t.Helper()
+		got, err := repo.GetOrderByID(ctx, order.ID)
+		if err != nil {
+			t.Fatalf("GetOrderByID: %v", err)
+		}
+		if got.ShippingAddress == nil || got.ShippingAddress.Street != want {
+			t.Errorf("order ships to %+v, want %s", got.ShippingAddress, want)
+		}
+		page, err := repo.GetOrdersByUserID(ctx, "john", PageRequest{})
+		if err != nil {
+			t.Fatalf("GetOrdersByUserID: %v", err)
+		}
+		for _, listed := range page.Items {
+			if listed.ID == order.ID && (listed.ShippingAddress == nil || listed.ShippingAddress.Street != want) {
+				t.Errorf("listed order ships to %+v, want %s", listed.ShippingAddress, want)
+			}
+		}
+	}
+
+	shipsTo("1 Main St")
+	setHome("9 Elm St")
+	shipsTo("1 Main St")
+
+	// Choosing the address again takes a new copy while the order is open
+	if _, err := repo.UpdateOrderAddress(ctx, order.ID, "home", anyVersion); err != nil {
+		t.Fatalf("UpdateOrderAddress: %v", err)
+	}
+	shipsTo("9 Elm St")
+
+	for _, status := range []OrderStatus{OrderStatusConfirmed, OrderStatusShipped} {
+		if _, err := repo.UpdateOrderStatus(ctx, order.ID, status, anyVersion); err != nil {
+			t.Fatalf("moving the order to %s: %v", status, err)
+		}
+	}
+	setHome("4 Oak St")
+	if _, err := repo.UpdateOrderAddress(ctx, order.ID, "home", anyVersion); !errors.Is(err, ErrOrderLocked) {
+		t.Errorf("moving a shipped order: %v, want ErrOrderLocked", err)
+	}
+	shipsTo("9 Elm St")
+}
+
+func TestRepositoryDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	first := newTestOrder(t, repo, 20)
+	if err := repo.CreateUser(ctx, &User{Username: "jane"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	// Enough rows that the deletes take more than one batch
+	orderIDs := []string{first.ID}
+	for i := range 12 {
+		order := &Order{ID: fmt.Sprintf("order-%d", i), UserID: "john", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency, CreatedAt: time.Now()}
+		if err := repo.CreateOrder(ctx, order); err != nil {
+			t.Fatalf("CreateOrder: %v", err)
+		}
+		orderIDs = append(orderIDs, order.ID)
+	}
+	for _, id := range orderIDs {
+		if err := repo.CreateOrderItem(ctx, id, &OrderItem{ItemID: "item-" + id, SKU: "LAPTOP-01", Quantity: 1}); err != nil {
+			t.Fatalf("CreateOrderItem: %v", err)
+		}
+	}
+	if _, err := repo.UpdateOrderStatus(ctx, first.ID, OrderStatusCancelled, anyVersion); err != nil {
+		t.Fatalf("cancelling an order: %v", err)
+	}
+	before := fake.keys()
+
+	if err := repo.DeleteUser(ctx, "john", false); !errors.Is(err, ErrUserHasOpenOrders) {
+		t.Fatalf("deleting a user with open orders: %v, want ErrUserHasOpenOrders", err)
+	}
+	if after := fake.keys(); !slices.Equal(after, before) {
+		t.Errorf("a refused delete changed the table from\n%v\nto\n%v", before, after)
+	}
+
+	fake.throttled = 2
+	if err := repo.DeleteUser(ctx, "john", true); err != nil {
+		t.Fatalf("DeleteUser with force: %v", err)
+	}
+	if fake.throttled != 0 {
+		t.Fatalf("%d throttled batches left, want every batch retried", fake.throttled)
+	}
+	want := []string{metaPK + " " + schemaSK, productPK("LAPTOP-01") + " " + productSK, userPK("jane") + " " + profileSK}
+	if got := fake.keys(); !slices.Equal(got, want) {
+		t.Errorf("rows left =\n%v\nwant\n%v", got, want)
+	}
+	if stock := stockOf(t, repo, "LAPTOP-01"); stock != 20 {
+		t.Errorf("stock after deleting = %d, want every reservation released to 20", stock)
+	}
+
+	if err := repo.DeleteUser(ctx, "john", true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("deleting the user again: %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestRepositoryEmptyTable(t *testing.T) {
+	ctx := context.Background()
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			repo, fake := newFakeRepository(t)
+			newTestOrder(t, repo, 5)
+			for i := range 60 {
+				product := Product{SKU: fmt.Sprintf("SKU-%02d", i), Name: "Thing", UnitPrice: 100, Currency: "USD"}
+				if err := repo.CreateProduct(ctx, product); err != nil {
+					t.Fatalf("CreateProduct: %v", err)
+				}
+			}
+			rows := len(fake.keys()) - 1
+
+			fake.throttled = 3
+			var deleted atomic.Int64
+			if err := repo.EmptyTable(ctx, workers, func(n int) { deleted.Add(int64(n)) }); err != nil {
+				t.Fatalf("EmptyTable: %v", err)
+			}
+			// The schema version outlives the rows
+			if left, want := fake.keys(), []string{metaPK + " " + schemaSK}; !slices.Equal(left, want) {
+				t.Errorf("rows left = %v, want %v", left, want)
+			}
+			if deleted.Load() != int64(rows) {
+				t.Errorf("reported %d deleted, want %d", deleted.Load(), rows)
+			}
+			if fake.throttled != 0 {
+				t.Errorf("%d throttled batches left, want every batch retried", fake.throttled)
+			}
+		})
+	}
+
+	// A failed batch stops every worker and is reported
+	repo, fake := newFakeRepository(t)
+	newTestOrder(t, repo, 5)
+	fake.intercept = func(op string) *fakeError {
+		if op == "BatchWriteItem" {
+			return validationException("batch failed")
+		}
+		return nil
+	}
+	if err := repo.EmptyTable(ctx, 4, nil); err == nil || !strings.Contains(err.Error(), "batch failed") {
+		t.Errorf("EmptyTable with failing batches: %v, want the batch error", err)
+	}
+}
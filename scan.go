@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// parallelScan scans the table in the given number of segments at once,
+// calling fn with every page. fn is called from several goroutines. The
+// first error cancels the other segments and is returned.
+func (r *Repository) parallelScan(ctx context.Context, segments int, input dynamodb.ScanInput, fn func(items []map[string]types.AttributeValue) error) error {
+	segments = max(segments, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for segment := range segments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.scanSegment(ctx, segment, segments, input, fn); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// scanSegment scans one segment of a parallel scan
+func (r *Repository) scanSegment(ctx context.Context, segment, segments int, input dynamodb.ScanInput, fn func(items []map[string]types.AttributeValue) error) error {
+	input.TableName = aws.String(r.tableName)
+	input.Segment = aws.Int32(int32(segment))
+	input.TotalSegments = aws.Int32(int32(segments))
+
+	paginator := dynamodb.NewScanPaginator(r.client, &input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the persistence layer used by the API handlers. Repository is
+// the DynamoDB implementation, MemoryStore keeps everything in process.
+// Lookups of rows that do not exist return errors matching ErrNotFound, any
+// other error means the store itself failed.
+//
+// Writes that take a version only apply to the row at that version and fail
+// with ErrVersionMismatch otherwise. They set the new version on the value
+// passed in or returned.
+type Store interface {
+	// User operations
+	CreateUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, username string) (*User, error)
+	ReplaceUser(ctx context.Context, user *User, version int64) error
+	UpdateUser(ctx context.Context, username string, patch UserPatch, version int64) (*User, error)
+	DeleteAddress(ctx context.Context, username, addressKey string, version int64) error
+	DeleteUser(ctx context.Context, username string, force bool) error
+
+	// Order operations
+	CreateOrder(ctx context.Context, order *Order) error
+	GetOrderByID(ctx context.Context, orderID string) (*Order, error)
+	GetOrdersByUserID(ctx context.Context, userID string, page PageRequest) (Page[*Order], error)
+	GetUserOrdersByStatus(ctx context.Context, userID string, status OrderStatus, from, to time.Time, page PageRequest) (Page[*Order], error)
+	UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus, version int64) (*Order, error)
+	UpdateOrderAddress(ctx context.Context, orderID, addressKey string, version int64) (*Order, error)
+	GetPendingOrders(ctx context.Context, page PageRequest) (Page[*Order], error)
+
+	// Product operations
+	CreateProduct(ctx context.Context, product Product) error
+	GetProduct(ctx context.Context, sku string) (*Product, error)
+	ListProducts(ctx context.Context, page PageRequest) (Page[Product], error)
+	UpdateProduct(ctx context.Context, sku string, update ProductUpdate) (*Product, error)
+	DeleteProduct(ctx context.Context, sku string) error
+
+	// Order item operations
+	CreateOrderItem(ctx context.Context, orderID string, item *OrderItem) error
+	GetOrderItems(ctx context.Context, orderID string, page PageRequest) (Page[OrderItem], error)
+	UpdateOrderItem(ctx context.Context, orderID, itemID string, update OrderItemUpdate) (*OrderItem, error)
+	DeleteOrderItem(ctx context.Context, orderID, itemID string) error
+}
+
+// anyVersion is passed as the version of a write that should apply to
+// whatever version is current, as with If-Match: *
+const anyVersion int64 = -1
+
+var (
+	_ Store = (*Repository)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStores returns a new store of each kind, so a test can check they
+// behave the same
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	repo := newTestRepository(t)
+	return map[string]Store{"memory": NewMemoryStore(), "dynamodb": repo}
+}
+
+// runStores runs test against each kind of store, holding user john with a
+// home address, product LAPTOP-01 with 5 in stock and no orders
+func runStores(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Username: "john", Addresses: map[string]Address{"home": {Street: "1 Main St", Country: "US"}}}
+			if err := store.CreateUser(ctx, user); err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if err := store.CreateProduct(ctx, Product{SKU: "LAPTOP-01", Name: "Laptop", UnitPrice: 129999, Currency: "USD", Stock: 5}); err != nil {
+				t.Fatalf("CreateProduct: %v", err)
+			}
+			test(t, store)
+		})
+	}
+}
+
+// newStoreOrder creates a pending order of john's shipping home
+func newStoreOrder(t *testing.T, store Store, id string) *Order {
+	t.Helper()
+	order := &Order{ID: id, UserID: "john", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := store.CreateOrder(context.Background(), order); err != nil {
+		t.Fatalf("CreateOrder(%s): %v", id, err)
+	}
+	return order
+}
+
+func TestStoreUsers(t *testing.T) {
+	runStores(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		if err := store.CreateUser(ctx, &User{Username: "john"}); !errors.Is(err, ErrUserExists) {
+			t.Errorf("creating john again: %v, want ErrUserExists", err)
+		}
+		if _, err := store.GetUser(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) || !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUser(nobody): %v, want ErrUserNotFound", err)
+		}
+		if _, err := store.UpdateUser(ctx, "nobody", UserPatch{FullName: patchValue("Nobody")}, anyVersion); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("UpdateUser(nobody): %v, want ErrUserNotFound", err)
+		}
+		if err := store.DeleteUser(ctx, "nobody", false); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("DeleteUser(nobody): %v, want ErrUserNotFound", err)
+		}
+
+		user, err := store.GetUser(ctx, "john")
+		if err != nil || user.Version != 1 {
+			t.Fatalf("GetUser(john) = %+v, %v; want version 1", user, err)
+		}
+
+		// Each write bumps the version and only applies to the version given
+		replacement := &User{Username: "john", FullName: "John Doe", Addresses: user.Addresses}
+		if err := store.ReplaceUser(ctx, replacement, 2); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("ReplaceUser at a stale version: %v, want ErrVersionMismatch", err)
+		}
+		if err := store.ReplaceUser(ctx, replacement, 1); err != nil || replacement.Version != 2 {
+			t.Errorf("ReplaceUser = version %d, %v; want version 2", replacement.Version, err)
+		}
+		if _, err := store.UpdateUser(ctx, "john", UserPatch{Email: patchValue("john@example.com")}, 1); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("UpdateUser at a stale version: %v, want ErrVersionMismatch", err)
+		}
+		updated, err := store.UpdateUser(ctx, "john", UserPatch{Email: patchValue("john@example.com")}, 2)
+		if err != nil || updated.Version != 3 || updated.FullName != "John Doe" || updated.Email != "john@example.com" {
+			t.Errorf("UpdateUser = %+v, %v; want the email added at version 3", updated, err)
+		}
+		if err := store.ReplaceUser(ctx, &User{Username: "nobody"}, anyVersion); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("ReplaceUser(nobody): %v, want ErrUserNotFound", err)
+		}
+
+		if err := store.DeleteAddress(ctx, "john", "cabin", anyVersion); !errors.Is(err, ErrAddressNotFound) {
+			t.Errorf("deleting a missing address: %v, want ErrAddressNotFound", err)
+		}
+		if err := store.DeleteAddress(ctx, "john", "home", 1); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("DeleteAddress at a stale version: %v, want ErrVersionMismatch", err)
+		}
+		if err := store.DeleteAddress(ctx, "john", "home", 3); err != nil {
+			t.Fatalf("DeleteAddress: %v", err)
+		}
+		if user, err := store.GetUser(ctx, "john"); err != nil || len(user.Addresses) != 0 || user.Version != 4 {
+			t.Errorf("after deleting the address GetUser = %+v, %v; want no addresses at version 4", user, err)
+		}
+	})
+}
+
+func TestStoreOrders(t *testing.T) {
+	runStores(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		missingUser := &Order{ID: "order-x", UserID: "nobody", Status: OrderStatusPending, AddressKey: "home", Currency: defaultCurrency}
+		if err := store.CreateOrder(ctx, missingUser); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("order of a missing user: %v, want ErrUserNotFound", err)
+		}
+		missingAddress := &Order{ID: "order-y", UserID: "john", Status: OrderStatusPending, AddressKey: "cabin", Currency: defaultCurrency}
+		if err := store.CreateOrder(ctx, missingAddress); !errors.Is(err, ErrAddressNotFound) {
+			t.Errorf("order to a missing address: %v, want ErrAddressNotFound", err)
+		}
+		if _, err := store.GetOrderByID(ctx, "order-x"); !errors.Is(err, ErrOrderNotFound) || !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetOrderByID of a missing order: %v, want ErrOrderNotFound", err)
+		}
+
+		order := newStoreOrder(t, store, "order-1")
+		if order.Version != 1 || order.ShippingAddress.Street != "1 Main St" {
+			t.Errorf("created order = %+v, want version 1 shipping to 1 Main St", order)
+		}
+
+		if _, err := store.UpdateOrderStatus(ctx, order.ID, "lost", anyVersion); !errors.Is(err, ErrUnknownStatus) {
+			t.Errorf("unknown status: %v, want ErrUnknownStatus", err)
+		}
+		if _, err := store.UpdateOrderStatus(ctx, order.ID, OrderStatusDelivered, anyVersion); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("pending to delivered: %v, want ErrInvalidTransition", err)
+		}
+		if _, err := store.UpdateOrderStatus(ctx, order.ID, OrderStatusConfirmed, 2); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("status change at a stale version: %v, want ErrVersionMismatch", err)
+		}
+		if _, err := store.UpdateOrderStatus(ctx, "order-x", OrderStatusConfirmed, anyVersion); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("status change of a missing order: %v, want ErrOrderNotFound", err)
+		}
+		confirmed, err := store.UpdateOrderStatus(ctx, order.ID, OrderStatusConfirmed, 1)
+		if err != nil || confirmed.Status != OrderStatusConfirmed || confirmed.Version != 2 {
+			t.Fatalf("UpdateOrderStatus = %+v, %v; want confirmed at version 2", confirmed, err)
+		}
+
+		if _, err := store.UpdateOrderAddress(ctx, order.ID, "cabin", anyVersion); !errors.Is(err, ErrAddressNotFound) {
+			t.Errorf("shipping to a missing address: %v, want ErrAddressNotFound", err)
+		}
+		if _, err := store.UpdateOrderAddress(ctx, order.ID, "home", 1); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("address change at a stale version: %v, want ErrVersionMismatch", err)
+		}
+		readdressed, err := store.UpdateOrderAddress(ctx, order.ID, "home", 2)
+		if err != nil || readdressed.Version != 3 {
+			t.Errorf("UpdateOrderAddress = %+v, %v; want version 3", readdressed, err)
+		}
+
+		if _, err := store.UpdateOrderStatus(ctx, order.ID, OrderStatusShipped, anyVersion); err != nil {
+			t.Fatalf("shipping: %v", err)
+		}
+		if _, err := store.UpdateOrderAddress(ctx, order.ID, "home", anyVersion); !errors.Is(err, ErrOrderLocked) {
+			t.Errorf("address change of a shipped order: %v, want ErrOrderLocked", err)
+		}
+		if err := store.DeleteUser(ctx, "john", false); !errors.Is(err, ErrUserHasOpenOrders) {
+			t.Errorf("deleting a user with a shipped order: %v, want ErrUserHasOpenOrders", err)
+		}
+		if got, err := store.GetOrderByID(ctx, order.ID); err != nil || got.Status != OrderStatusShipped || got.Version != 4 {
+			t.Errorf("GetOrderByID = %+v, %v; want shipped at version 4", got, err)
+		}
+	})
+}
+
+func TestStoreItems(t *testing.T) {
+	runStores(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		order := newStoreOrder(t, store, "order-1")
+		if err := store.CreateProduct(ctx, Product{SKU: "LAPTOP-01", Name: "Again"}); !errors.Is(err, ErrProductExists) {
+			t.Errorf("creating a product again: %v, want ErrProductExists", err)
+		}
+		if err := store.CreateProduct(ctx, Product{SKU: "BOOK-01", Name: "Book", UnitPrice: 2450, Currency: "EUR", Stock: 5}); err != nil {
+			t.Fatalf("CreateProduct: %v", err)
+		}
+
+		tests := []struct {
+			name    string
+			orderID string
+			item    OrderItem
+			want    error
+		}{
+			{"missing order", "order-x", OrderItem{SKU: "LAPTOP-01", Quantity: 1}, ErrOrderNotFound},
+			{"missing product", order.ID, OrderItem{SKU: "NOPE", Quantity: 1}, ErrProductNotFound},
+			{"other currency", order.ID, OrderItem{SKU: "BOOK-01", Quantity: 1}, ErrCurrencyMismatch},
+			{"too many", order.ID, OrderItem{SKU: "LAPTOP-01", Quantity: 6}, ErrInsufficientStock},
+		}
+		for i, tt := range tests {
+			tt.item.ItemID = fmt.Sprintf("bad-%d", i)
+			if err := store.CreateOrderItem(ctx, tt.orderID, &tt.item); !errors.Is(err, tt.want) {
+				t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+			}
+		}
+
+		item := &OrderItem{ItemID: "item-1", SKU: "LAPTOP-01", Quantity: 2}
+		if err := store.CreateOrderItem(ctx, order.ID, item); err != nil {
+			t.Fatalf("CreateOrderItem: %v", err)
+		}
+		if item.Price != 129999 || item.Currency != "USD" || item.Name != "Laptop" {
+			t.Errorf("item = %+v, want the laptop's name and price copied", item)
+		}
+
+		quantity := 4
+		if _, err := store.UpdateOrderItem(ctx, order.ID, "item-x", OrderItemUpdate{Quantity: &quantity}); !errors.Is(err, ErrItemNotFound) {
+			t.Errorf("updating a missing item: %v, want ErrItemNotFound", err)
+		}
+		if updated, err := store.UpdateOrderItem(ctx, order.ID, "item-1", OrderItemUpdate{Quantity: &quantity}); err != nil || updated.Quantity != 4 {
+			t.Errorf("UpdateOrderItem = %+v, %v; want quantity 4", updated, err)
+		}
+		quantity = 6
+		var stockErr *InsufficientStockError
+		if _, err := store.UpdateOrderItem(ctx, order.ID, "item-1", OrderItemUpdate{Quantity: &quantity}); !errors.As(err, &stockErr) || stockErr.Available != 1 {
+			t.Errorf("raising the quantity past the stock: %v, want 1 available", err)
+		}
+
+		got, err := store.GetOrderByID(ctx, order.ID)
+		if err != nil || got.ItemCount != 4 || got.Subtotal != 4*129999 || got.Version != 3 {
+			t.Errorf("order = %+v, %v; want 4 laptops at version 3", got, err)
+		}
+		if product, err := store.GetProduct(ctx, "LAPTOP-01"); err != nil || product.Stock != 1 {
+			t.Errorf("laptop = %+v, %v; want 1 left in stock", product, err)
+		}
+
+		if err := store.DeleteOrderItem(ctx, order.ID, "item-x"); !errors.Is(err, ErrItemNotFound) {
+			t.Errorf("deleting a missing item: %v, want ErrItemNotFound", err)
+		}
+		if err := store.DeleteOrderItem(ctx, order.ID, "item-1"); err != nil {
+			t.Fatalf("DeleteOrderItem: %v", err)
+		}
+		if product, err := store.GetProduct(ctx, "LAPTOP-01"); err != nil || product.Stock != 5 {
+			t.Errorf("laptop = %+v, %v; want all 5 back in stock", product, err)
+		}
+
+		if _, err := store.UpdateOrderStatus(ctx, order.ID, OrderStatusCancelled, anyVersion); err != nil {
+			t.Fatalf("cancelling: %v", err)
+		}
+		item = &OrderItem{ItemID: "item-2", SKU: "LAPTOP-01", Quantity: 1}
+		if err := store.CreateOrderItem(ctx, order.ID, item); !errors.Is(err, ErrOrderLocked) {
+			t.Errorf("adding to a cancelled order: %v, want ErrOrderLocked", err)
+		}
+
+		if err := store.DeleteProduct(ctx, "NOPE"); !errors.Is(err, ErrProductNotFound) {
+			t.Errorf("deleting a missing product: %v, want ErrProductNotFound", err)
+		}
+		if _, err := store.GetProduct(ctx, "NOPE"); !errors.Is(err, ErrProductNotFound) || !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetProduct(NOPE): %v, want ErrProductNotFound", err)
+		}
+	})
+}
+
+func TestStorePaging(t *testing.T) {
+	runStores(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		var want []string
+		for i := range 7 {
+			want = append(want, newStoreOrder(t, store, fmt.Sprintf("order-%d", i)).ID)
+		}
+
+		var got []string
+		page := PageRequest{Limit: 3}
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("still paging after 10 pages")
+			}
+			orders, err := store.GetOrdersByUserID(ctx, "john", page)
+			if err != nil {
+				t.Fatalf("GetOrdersByUserID: %v", err)
+			}
+			if len(orders.Items) > 3 {
+				t.Errorf("page of %d orders, want at most 3", len(orders.Items))
+			}
+			for _, order := range orders.Items {
+				got = append(got, order.ID)
+			}
+			if orders.NextCursor == "" {
+				break
+			}
+			page.Cursor = orders.NextCursor
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("listed %v, want %v", got, want)
+		}
+
+		// A cursor only continues the list it came from
+		orders, err := store.GetOrdersByUserID(ctx, "john", PageRequest{Limit: 1})
+		if err != nil || orders.NextCursor == "" {
+			t.Fatalf("GetOrdersByUserID = %+v, %v; want a next page", orders, err)
+		}
+		if _, err := store.GetPendingOrders(ctx, PageRequest{Cursor: orders.NextCursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("user orders cursor for pending orders: %v, want ErrInvalidCursor", err)
+		}
+		if _, err := store.GetOrdersByUserID(ctx, "john", PageRequest{Cursor: "not-a-cursor"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("malformed cursor: %v, want ErrInvalidCursor", err)
+		}
+		if _, err := store.GetOrdersByUserID(ctx, "john", PageRequest{Cursor: orders.NextCursor[1:]}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("edited cursor: %v, want ErrInvalidCursor", err)
+		}
+	})
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Billing modes accepted by -billing and the table config file
+const (
+	billingOnDemand    = "on-demand"
+	billingProvisioned = "provisioned"
+)
+
+// Tags recording the auto scaling targets of a provisioned table, for the
+// scaling policies set up outside this tool
+const (
+	tagScalingTarget = "autoscaling:target-utilization"
+	tagScalingMin    = "autoscaling:min-capacity"
+	tagScalingMax    = "autoscaling:max-capacity"
+)
+
+// Capacity is the provisioned read and write capacity of the table or a GSI
+type Capacity struct {
+	Read  int64 `json:"read"`
+	Write int64 `json:"write"`
+}
+
+// AutoScaling holds the target settings for auto scaling a provisioned table
+type AutoScaling struct {
+	// TargetUtilization is the percentage of capacity to scale towards
+	TargetUtilization float64 `json:"target_utilization"`
+	MinCapacity       int64   `json:"min_capacity"`
+	MaxCapacity       int64   `json:"max_capacity"`
+}
+
+// TableConfig is how CreateTable provisions the table. It can be read from
+// a JSON file such as
+//
+//	{
+//	  "billing": "provisioned",
+//	  "table": {"read": 20, "write": 10},
+//	  "indexes": {"inverted-index": {"read": 10, "write": 10}},
+//	  "auto_scaling": {"target_utilization": 70, "min_capacity": 5, "max_capacity": 200}
+//	}
+//
+// GSIs without their own capacity get the capacity of the table.
+type TableConfig struct {
+	Billing     string              `json:"billing"`
+	Table       Capacity            `json:"table"`
+	Indexes     map[string]Capacity `json:"indexes,omitempty"`
+	AutoScaling *AutoScaling        `json:"auto_scaling,omitempty"`
+}
+
+// DefaultTableConfig provisions 5 read and write units on the table and
+// every GSI
+func DefaultTableConfig() TableConfig {
+	return TableConfig{
+		Billing: billingProvisioned,
+		Table:   Capacity{Read: 5, Write: 5},
+	}
+}
+
+// LoadTableConfig reads a table config file. Settings missing from the file
+// keep their defaults.
+func LoadTableConfig(path string) (TableConfig, error) {
+	config := DefaultTableConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseIndexCapacity parses the -index-capacity flag, e.g.
+// "inverted-index=10/5,placed-index=2/2"
+func ParseIndexCapacity(s string) (map[string]Capacity, error) {
+	indexes := make(map[string]Capacity)
+	for _, entry := range strings.Split(s, ",") {
+		name, capacity, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		read, write, ok2 := strings.Cut(capacity, "/")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("index capacity %q is not name=read/write", entry)
+		}
+
+		var c Capacity
+		var err error
+		if c.Read, err = strconv.ParseInt(read, 10, 64); err != nil {
+			return nil, fmt.Errorf("index capacity %q: %w", entry, err)
+		}
+		if c.Write, err = strconv.ParseInt(write, 10, 64); err != nil {
+			return nil, fmt.Errorf("index capacity %q: %w", entry, err)
+		}
+		indexes[name] = c
+	}
+	return indexes, nil
+}
+
+// tableDefinition is the key schema and indexes of the single table, without
+// billing settings
+func tableDefinition(tableName string) *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("sk"), KeyType: types.KeyTypeRange},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("pk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("sk"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("status_date"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("placed_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("inverted-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("sk"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("pk"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+			{
+				IndexName: aws.String("placed-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("placed_id"), KeyType: types.KeyTypeHash},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		LocalSecondaryIndexes: []types.LocalSecondaryIndex{
+			{
+				IndexName: aws.String("status-date-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("status_date"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+	}
+}
+
+// apply sets the billing mode, capacity and auto scaling tags of input
+func (c TableConfig) apply(input *dynamodb.CreateTableInput) error {
+	var gsiNames []string
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		gsiNames = append(gsiNames, aws.ToString(gsi.IndexName))
+	}
+	for name := range c.Indexes {
+		if !slices.Contains(gsiNames, name) {
+			return fmt.Errorf("unknown index %q, the GSIs are %s", name, strings.Join(gsiNames, ", "))
+		}
+	}
+
+	switch c.Billing {
+	case billingOnDemand:
+		if len(c.Indexes) > 0 || c.AutoScaling != nil {
+			return fmt.Errorf("index capacity and auto scaling only apply to provisioned billing")
+		}
+		input.BillingMode = types.BillingModePayPerRequest
+		return nil
+
+	case billingProvisioned:
+		input.BillingMode = types.BillingModeProvisioned
+
+	default:
+		return fmt.Errorf("billing must be %s or %s, not %q", billingOnDemand, billingProvisioned, c.Billing)
+	}
+
+	throughput, err := c.Table.throughput("table")
+	if err != nil {
+		return err
+	}
+	input.ProvisionedThroughput = throughput
+
+	for i := range input.GlobalSecondaryIndexes {
+		gsi := &input.GlobalSecondaryIndexes[i]
+		capacity, ok := c.Indexes[aws.ToString(gsi.IndexName)]
+		if !ok {
+			capacity = c.Table
+		}
+		if gsi.ProvisionedThroughput, err = capacity.throughput(aws.ToString(gsi.IndexName)); err != nil {
+			return err
+		}
+	}
+
+	if c.AutoScaling != nil {
+		tags, err := c.AutoScaling.tags()
+		if err != nil {
+			return err
+		}
+		input.Tags = append(input.Tags, tags...)
+	}
+	return nil
+}
+
+func (c Capacity) throughput(name string) (*types.ProvisionedThroughput, error) {
+	if c.Read < 1 || c.Write < 1 {
+		return nil, fmt.Errorf("%s needs at least 1 read and write capacity unit, got %d/%d", name, c.Read, c.Write)
+	}
+	return &types.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(c.Read),
+		WriteCapacityUnits: aws.Int64(c.Write),
+	}, nil
+}
+
+func (a AutoScaling) tags() ([]types.Tag, error) {
+	if a.TargetUtilization < 20 || a.TargetUtilization > 90 {
+		return nil, fmt.Errorf("auto scaling target utilization must be between 20 and 90 percent, got %g", a.TargetUtilization)
+	}
+	if a.MinCapacity < 1 || a.MaxCapacity < a.MinCapacity {
+		return nil, fmt.Errorf("auto scaling capacity must be at least 1 with max no less than min, got %d-%d", a.MinCapacity, a.MaxCapacity)
+	}
+
+	return []types.Tag{
+		{Key: aws.String(tagScalingTarget), Value: aws.String(strconv.FormatFloat(a.TargetUtilization, 'f', -1, 64))},
+		{Key: aws.String(tagScalingMin), Value: aws.String(strconv.FormatInt(a.MinCapacity, 10))},
+		{Key: aws.String(tagScalingMax), Value: aws.String(strconv.FormatInt(a.MaxCapacity, 10))},
+	}, nil
+}
+
+// tableWaitTimeout bounds how long table commands wait for the table to
+// become ACTIVE
+const tableWaitTimeout = 10 * time.Minute
+
+// waitForTable waits until the table exists and is ACTIVE
+func (r *Repository) waitForTable(ctx context.Context) error {
+	waiter := dynamodb.NewTableExistsWaiter(r.client, func(o *dynamodb.TableExistsWaiterOptions) {
+		o.MinDelay = 2 * time.Second
+		o.MaxDelay = 20 * time.Second
+	})
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(r.tableName),
+	}, tableWaitTimeout)
+}
+
+// waitForIndex waits until a GSI added by UpdateTable is ACTIVE. The table
+// is ACTIVE again long before a new index has finished backfilling.
+func (r *Repository) waitForIndex(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, tableWaitTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		if err := backoff(ctx, attempt); err != nil {
+			return fmt.Errorf("waiting for GSI %s to become ACTIVE: %w", name, err)
+		}
+
+		described, err := r.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(r.tableName),
+		})
+		if err != nil {
+			return err
+		}
+		for _, gsi := range described.Table.GlobalSecondaryIndexes {
+			if aws.ToString(gsi.IndexName) == name && gsi.IndexStatus == types.IndexStatusActive {
+				return nil
+			}
+		}
+	}
+}
+
+// TableReport is what EnsureTable changed and found
+type TableReport struct {
+	Created bool
+
+	// AddedIndexes are the GSIs that were missing and have been created
+	AddedIndexes []string
+
+	// Unfixable are differences from the expected definition that
+	// EnsureTable cannot change, such as a missing LSI
+	Unfixable []string
+
+	// Notes are differences that do no harm, such as extra indexes
+	Notes []string
+}
+
+// EnsureTable makes an existing table match the expected definition as far
+// as it can: the table is created at the latest schema version if it does
+// not exist and missing GSIs are added one at a time. Differences that need
+// the table to be recreated are reported rather than changed.
+func (r *Repository) EnsureTable(ctx context.Context, config TableConfig) (TableReport, error) {
+	var report TableReport
+
+	expected := tableDefinition(r.tableName)
+	if err := config.apply(expected); err != nil {
+		return report, err
+	}
+
+	described, err := r.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(r.tableName),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		if _, err := r.client.CreateTable(ctx, expected); err != nil {
+			return report, err
+		}
+		report.Created = true
+		if err := r.waitForTable(ctx); err != nil {
+			return report, err
+		}
+		return report, r.markSchemaCurrent(ctx)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	// A table that is still being created or changed, say by another
+	// -ensure-table, refuses UpdateTable and may not show all its GSIs yet
+	if status := described.Table.TableStatus; status == types.TableStatusCreating || status == types.TableStatusUpdating {
+		if err := r.waitForTable(ctx); err != nil {
+			return report, err
+		}
+		described, err = r.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(r.tableName),
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	diff := diffTable(expected, described.Table)
+	report.Unfixable = diff.unfixable
+	report.Notes = diff.notes
+
+	for _, gsi := range diff.missingGSIs {
+		name := aws.ToString(gsi.IndexName)
+		if described.Table.BillingModeSummary != nil && described.Table.BillingModeSummary.BillingMode == types.BillingModePayPerRequest {
+			gsi.ProvisionedThroughput = nil
+		} else if gsi.ProvisionedThroughput == nil {
+			report.Unfixable = append(report.Unfixable, fmt.Sprintf("GSI %s is missing and the table is provisioned; run again with -billing provisioned to give the index capacity", name))
+			continue
+		}
+
+		// Only one GSI can be created per UpdateTable, and the table and
+		// the index have to be ACTIVE before the next one
+		_, err := r.client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName:            aws.String(r.tableName),
+			AttributeDefinitions: keyAttributes(expected.AttributeDefinitions, gsi.KeySchema),
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+				{Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:             gsi.IndexName,
+					KeySchema:             gsi.KeySchema,
+					Projection:            gsi.Projection,
+					ProvisionedThroughput: gsi.ProvisionedThroughput,
+				}},
+			},
+		})
+		if err != nil {
+			return report, fmt.Errorf("adding GSI %s: %w", name, err)
+		}
+		if err := r.waitForTable(ctx); err != nil {
+			return report, err
+		}
+		if err := r.waitForIndex(ctx, name); err != nil {
+			return report, err
+		}
+		report.AddedIndexes = append(report.AddedIndexes, name)
+	}
+	return report, nil
+}
+
+type tableDiff struct {
+	missingGSIs []types.GlobalSecondaryIndex
+	unfixable   []string
+	notes       []string
+}
+
+// diffTable compares the key schema and indexes of a table with the
+// expected definition
+func diffTable(expected *dynamodb.CreateTableInput, actual *types.TableDescription) tableDiff {
+	var diff tableDiff
+
+	expectedKey := describeKey(expected.KeySchema, expected.AttributeDefinitions)
+	if actualKey := describeKey(actual.KeySchema, actual.AttributeDefinitions); actualKey != expectedKey {
+		diff.unfixable = append(diff.unfixable, fmt.Sprintf("table key is %s, expected %s", actualKey, expectedKey))
+	}
+
+	if actual.BillingModeSummary != nil && actual.BillingModeSummary.BillingMode != expected.BillingMode {
+		diff.notes = append(diff.notes, fmt.Sprintf("billing mode is %s, expected %s; not changed", actual.BillingModeSummary.BillingMode, expected.BillingMode))
+	}
+
+	actualGSIs := make(map[string]types.GlobalSecondaryIndexDescription)
+	for _, gsi := range actual.GlobalSecondaryIndexes {
+		actualGSIs[aws.ToString(gsi.IndexName)] = gsi
+	}
+	for _, gsi := range expected.GlobalSecondaryIndexes {
+		name := aws.ToString(gsi.IndexName)
+		found, ok := actualGSIs[name]
+		if !ok {
+			diff.missingGSIs = append(diff.missingGSIs, gsi)
+			continue
+		}
+		delete(actualGSIs, name)
+
+		want := describeIndex(gsi.KeySchema, gsi.Projection, expected.AttributeDefinitions)
+		if got := describeIndex(found.KeySchema, found.Projection, actual.AttributeDefinitions); got != want {
+			diff.unfixable = append(diff.unfixable, fmt.Sprintf("GSI %s is %s, expected %s; delete it and run -ensure-table again to recreate it", name, got, want))
+		}
+	}
+	for name := range actualGSIs {
+		diff.notes = append(diff.notes, fmt.Sprintf("GSI %s is not part of the definition; not removed", name))
+	}
+
+	actualLSIs := make(map[string]types.LocalSecondaryIndexDescription)
+	for _, lsi := range actual.LocalSecondaryIndexes {
+		actualLSIs[aws.ToString(lsi.IndexName)] = lsi
+	}
+	for _, lsi := range expected.LocalSecondaryIndexes {
+		name := aws.ToString(lsi.IndexName)
+		found, ok := actualLSIs[name]
+		if !ok {
+			diff.unfixable = append(diff.unfixable, fmt.Sprintf("LSI %s is missing; LSIs can only be created with the table, so export, recreate and import it", name))
+			continue
+		}
+		delete(actualLSIs, name)
+
+		want := describeIndex(lsi.KeySchema, lsi.Projection, expected.AttributeDefinitions)
+		if got := describeIndex(found.KeySchema, found.Projection, actual.AttributeDefinitions); got != want {
+			diff.unfixable = append(diff.unfixable, fmt.Sprintf("LSI %s is %s, expected %s; LSIs cannot be changed, so export, recreate and import the table", name, got, want))
+		}
+	}
+	for name := range actualLSIs {
+		diff.notes = append(diff.notes, fmt.Sprintf("LSI %s is not part of the definition", name))
+	}
+
+	slices.Sort(diff.notes)
+	return diff
+}
+
+// describeKey formats a key schema with its attribute types, e.g.
+// "pk (S) HASH, sk (S) RANGE"
+func describeKey(key []types.KeySchemaElement, attributes []types.AttributeDefinition) string {
+	parts := make([]string, len(key))
+	for i, element := range key {
+		name := aws.ToString(element.AttributeName)
+		attributeType := "?"
+		for _, attribute := range attributes {
+			if aws.ToString(attribute.AttributeName) == name {
+				attributeType = string(attribute.AttributeType)
+			}
+		}
+		parts[i] = fmt.Sprintf("%s (%s) %s", name, attributeType, element.KeyType)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// describeIndex formats the key schema and projection of an index
+func describeIndex(key []types.KeySchemaElement, projection *types.Projection, attributes []types.AttributeDefinition) string {
+	description := describeKey(key, attributes)
+	if projection == nil {
+		return description
+	}
+
+	description += " projecting " + string(projection.ProjectionType)
+	if len(projection.NonKeyAttributes) > 0 {
+		nonKey := slices.Sorted(slices.Values(projection.NonKeyAttributes))
+		description += " " + strings.Join(nonKey, ", ")
+	}
+	return description
+}
+
+// keyAttributes returns the attribute definitions used by a key schema
+func keyAttributes(attributes []types.AttributeDefinition, key []types.KeySchemaElement) []types.AttributeDefinition {
+	var used []types.AttributeDefinition
+	for _, attribute := range attributes {
+		for _, element := range key {
+			if aws.ToString(element.AttributeName) == aws.ToString(attribute.AttributeName) {
+				used = append(used, attribute)
+			}
+		}
+	}
+	return used
+}
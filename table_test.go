@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestTableConfigApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TableConfig
+		want    types.BillingMode
+		table   *Capacity
+		indexes map[string]Capacity
+		tags    map[string]string
+		err     string
+	}{
+		{
+			name:    "default",
+			config:  DefaultTableConfig(),
+			want:    types.BillingModeProvisioned,
+			table:   &Capacity{5, 5},
+			indexes: map[string]Capacity{"inverted-index": {5, 5}, "placed-index": {5, 5}},
+		},
+		{
+			name:   "on demand",
+			config: TableConfig{Billing: billingOnDemand},
+			want:   types.BillingModePayPerRequest,
+		},
+		{
+			name: "index capacity and auto scaling",
+			config: TableConfig{
+				Billing:     billingProvisioned,
+				Table:       Capacity{20, 10},
+				Indexes:     map[string]Capacity{"placed-index": {2, 1}},
+				AutoScaling: &AutoScaling{TargetUtilization: 70, MinCapacity: 5, MaxCapacity: 200},
+			},
+			want:    types.BillingModeProvisioned,
+			table:   &Capacity{20, 10},
+			indexes: map[string]Capacity{"inverted-index": {20, 10}, "placed-index": {2, 1}},
+			tags:    map[string]string{tagScalingTarget: "70", tagScalingMin: "5", tagScalingMax: "200"},
+		},
+		{
+			name:   "on demand with index capacity",
+			config: TableConfig{Billing: billingOnDemand, Indexes: map[string]Capacity{"placed-index": {2, 1}}},
+			err:    "only apply to provisioned billing",
+		},
+		{
+			name:   "unknown billing",
+			config: TableConfig{Billing: "free", Table: Capacity{5, 5}},
+			err:    `not "free"`,
+		},
+		{
+			name:   "unknown index",
+			config: TableConfig{Billing: billingProvisioned, Table: Capacity{5, 5}, Indexes: map[string]Capacity{"status-date-index": {1, 1}}},
+			err:    `unknown index "status-date-index"`,
+		},
+		{
+			name:   "no table capacity",
+			config: TableConfig{Billing: billingProvisioned, Table: Capacity{0, 5}},
+			err:    "table needs at least 1",
+		},
+		{
+			name:   "no index capacity",
+			config: TableConfig{Billing: billingProvisioned, Table: Capacity{5, 5}, Indexes: map[string]Capacity{"inverted-index": {5, 0}}},
+			err:    "inverted-index needs at least 1",
+		},
+		{
+			name:   "target utilization out of range",
+			config: TableConfig{Billing: billingProvisioned, Table: Capacity{5, 5}, AutoScaling: &AutoScaling{TargetUtilization: 95, MinCapacity: 1, MaxCapacity: 10}},
+			err:    "between 20 and 90 percent",
+		},
+		{
+			name:   "max capacity below min",
+			config: TableConfig{Billing: billingProvisioned, Table: Capacity{5, 5}, AutoScaling: &AutoScaling{TargetUtilization: 70, MinCapacity: 10, MaxCapacity: 5}},
+			err:    "got 10-5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tableDefinition("simple-inventory")
+			err := tt.config.apply(input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("apply = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			if input.BillingMode != tt.want {
+				t.Errorf("billing mode = %s, want %s", input.BillingMode, tt.want)
+			}
+			if got := capacityOf(input.ProvisionedThroughput); !reflect.DeepEqual(got, tt.table) {
+				t.Errorf("table capacity = %v, want %v", got, tt.table)
+			}
+			for _, gsi := range input.GlobalSecondaryIndexes {
+				name := aws.ToString(gsi.IndexName)
+				var want *Capacity
+				if c, ok := tt.indexes[name]; ok {
+					want = &c
+				}
+				if got := capacityOf(gsi.ProvisionedThroughput); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s capacity = %v, want %v", name, got, want)
+				}
+			}
+			tags := make(map[string]string)
+			for _, tag := range input.Tags {
+				tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+			if len(tags) > 0 || tt.tags != nil {
+				if !reflect.DeepEqual(tags, tt.tags) {
+					t.Errorf("tags = %v, want %v", tags, tt.tags)
+				}
+			}
+		})
+	}
+}
+
+// capacityOf returns the capacity of throughput, or nil for none
+func capacityOf(throughput *types.ProvisionedThroughput) *Capacity {
+	if throughput == nil {
+		return nil
+	}
+	return &Capacity{Read: aws.ToInt64(throughput.ReadCapacityUnits), Write: aws.ToInt64(throughput.WriteCapacityUnits)}
+}
+
+func TestParseIndexCapacity(t *testing.T) {
+	got, err := ParseIndexCapacity("inverted-index=10/5, placed-index=2/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]Capacity{"inverted-index": {10, 5}, "placed-index": {2, 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseIndexCapacity = %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"", "inverted-index", "inverted-index=10", "=10/5", "inverted-index=ten/5", "inverted-index=10/5,"} {
+		if got, err := ParseIndexCapacity(s); err == nil {
+			t.Errorf("ParseIndexCapacity(%q) = %v, want an error", s, got)
+		}
+	}
+}
+
+func TestLoadTableConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.json")
+	file := `{"table": {"read": 20, "write": 10}, "indexes": {"inverted-index": {"read": 8, "write": 4}}, "auto_scaling": {"target_utilization": 70, "min_capacity": 5, "max_capacity": 200}}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings missing from the file keep their defaults
+	got, err := LoadTableConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TableConfig{
+		Billing:     billingProvisioned,
+		Table:       Capacity{20, 10},
+		Indexes:     map[string]Capacity{"inverted-index": {8, 4}},
+		AutoScaling: &AutoScaling{TargetUtilization: 70, MinCapacity: 5, MaxCapacity: 200},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadTableConfig = %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"table": {"read": "lots"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTableConfig(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("LoadTableConfig of a malformed file = %v, want an error naming the file", err)
+	}
+	if _, err := LoadTableConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadTableConfig of a missing file succeeded")
+	}
+}
+
+func TestCreateTableConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.json")
+	file := `{"table": {"read": 20, "write": 10}, "indexes": {"inverted-index": {"read": 8, "write": 4}}, "auto_scaling": {"target_utilization": 70, "min_capacity": 5, "max_capacity": 200}}`
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags that are set win over the file, the rest keep its values
+	flags := tableFlags{
+		rcu:           40,
+		wcu:           99,
+		indexCapacity: "placed-index=2/1",
+		scaleMax:      400,
+		scaleMin:      99,
+		set:           map[string]bool{"rcu": true, "index-capacity": true, "autoscale-max": true},
+	}
+	got, err := createTableConfig(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TableConfig{
+		Billing:     billingProvisioned,
+		Table:       Capacity{40, 10},
+		Indexes:     map[string]Capacity{"inverted-index": {8, 4}, "placed-index": {2, 1}},
+		AutoScaling: &AutoScaling{TargetUtilization: 70, MinCapacity: 5, MaxCapacity: 400},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("createTableConfig = %+v, want %+v", got, want)
+	}
+
+	got, err = createTableConfig("", tableFlags{billing: billingOnDemand, set: map[string]bool{"billing": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TableConfig{Billing: billingOnDemand, Table: Capacity{5, 5}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("createTableConfig without a file = %+v, want %+v", got, want)
+	}
+
+	if _, err := createTableConfig("", tableFlags{indexCapacity: "placed", set: map[string]bool{"index-capacity": true}}); err == nil {
+		t.Error("createTableConfig with a malformed -index-capacity succeeded")
+	}
+	if _, err := createTableConfig(filepath.Join(t.TempDir(), "missing.json"), tableFlags{}); err == nil {
+		t.Error("createTableConfig with a missing file succeeded")
+	}
+}
+
+func TestCreateTableOnDemand(t *testing.T) {
+	ctx := context.Background()
+	repo, fake := newFakeRepository(t)
+	if err := repo.DeleteTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.CreateTable(ctx, TableConfig{Billing: billingOnDemand}); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	definition := fake.table.definition
+	if definition.BillingMode != string(types.BillingModePayPerRequest) || definition.ProvisionedThroughput != nil {
+		t.Errorf("table billing = %s with %v, want PAY_PER_REQUEST without capacity", definition.BillingMode, definition.ProvisionedThroughput)
+	}
+	for _, gsi := range definition.GlobalSecondaryIndexes {
+		if gsi.ProvisionedThroughput != nil {
+			t.Errorf("GSI %s has capacity %v on an on-demand table", gsi.IndexName, gsi.ProvisionedThroughput)
+		}
+	}
+}
+
+// expectedTable is the definition EnsureTable compares against
+func expectedTable(t *testing.T) *dynamodb.CreateTableInput {
+	t.Helper()
+	expected := tableDefinition("simple-inventory")
+	if err := DefaultTableConfig().apply(expected); err != nil {
+		t.Fatal(err)
+	}
+	return expected
+}
+
+// describedTable is how DescribeTable reports a table created from input
+func describedTable(input *dynamodb.CreateTableInput) *types.TableDescription {
+	table := &types.TableDescription{
+		TableName:            input.TableName,
+		KeySchema:            slices.Clone(input.KeySchema),
+		AttributeDefinitions: slices.Clone(input.AttributeDefinitions),
+		BillingModeSummary:   &types.BillingModeSummary{BillingMode: input.BillingMode},
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		table.GlobalSecondaryIndexes = append(table.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	for _, lsi := range input.LocalSecondaryIndexes {
+		table.LocalSecondaryIndexes = append(table.LocalSecondaryIndexes, types.LocalSecondaryIndexDescription{
+			IndexName:  lsi.IndexName,
+			KeySchema:  lsi.KeySchema,
+			Projection: lsi.Projection,
+		})
+	}
+	return table
+}
+
+func TestDiffTableMatches(t *testing.T) {
+	expected := expectedTable(t)
+	diff := diffTable(expected, describedTable(expected))
+	if len(diff.missingGSIs) > 0 || len(diff.unfixable) > 0 || len(diff.notes) > 0 {
+		t.Errorf("diff of the table against itself = %+v, want none", diff)
+	}
+}
+
+func TestDiffTable(t *testing.T) {
+	tests := []struct {
+		name          string
+		change        func(table *types.TableDescription)
+		wantMissing   []string
+		wantUnfixable []string
+		wantNotes     []string
+	}{
+		{
+			name: "missing GSI",
+			change: func(table *types.TableDescription) {
+				table.GlobalSecondaryIndexes = table.GlobalSecondaryIndexes[:1]
+			},
+			wantMissing: []string{"placed-index"},
+		},
+		{
+			name: "extra GSI",
+			change: func(table *types.TableDescription) {
+				table.GlobalSecondaryIndexes = append(table.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+					IndexName: aws.String("email-index"),
+				})
+			},
+			wantNotes: []string{"GSI email-index is not part of the definition"},
+		},
+		{
+			name: "GSI with another projection",
+			change: func(table *types.TableDescription) {
+				table.GlobalSecondaryIndexes[1].Projection = &types.Projection{
+					ProjectionType:   types.ProjectionTypeInclude,
+					NonKeyAttributes: []string{"status", "created_at"},
+				}
+			},
+			wantUnfixable: []string{"GSI placed-index is placed_id (S) HASH projecting INCLUDE created_at, status, expected placed_id (S) HASH projecting ALL"},
+		},
+		{
+			name: "missing LSI",
+			change: func(table *types.TableDescription) {
+				table.LocalSecondaryIndexes = nil
+			},
+			wantUnfixable: []string{"LSI status-date-index is missing"},
+		},
+		{
+			name: "LSI with another sort key",
+			change: func(table *types.TableDescription) {
+				table.LocalSecondaryIndexes[0].KeySchema = []types.KeySchemaElement{
+					{AttributeName: aws.String("pk"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("created_at"), KeyType: types.KeyTypeRange},
+				}
+			},
+			wantUnfixable: []string{"LSI status-date-index is pk (S) HASH, created_at (?) RANGE"},
+		},
+		{
+			name: "table key of another type",
+			change: func(table *types.TableDescription) {
+				table.AttributeDefinitions = slices.Clone(table.AttributeDefinitions)
+				table.AttributeDefinitions[1].AttributeType = types.ScalarAttributeTypeN
+			},
+			// The inverted-index is keyed on the same attributes
+			wantUnfixable: []string{
+				"table key is pk (S) HASH, sk (N) RANGE, expected pk (S) HASH, sk (S) RANGE",
+				"GSI inverted-index is sk (N) HASH, pk (S) RANGE projecting ALL, expected sk (S) HASH, pk (S) RANGE projecting ALL",
+			},
+		},
+		{
+			name: "on-demand billing",
+			change: func(table *types.TableDescription) {
+				table.BillingModeSummary.BillingMode = types.BillingModePayPerRequest
+			},
+			wantNotes: []string{"billing mode is PAY_PER_REQUEST, expected PROVISIONED"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := expectedTable(t)
+			actual := describedTable(expected)
+			tt.change(actual)
+			diff := diffTable(expected, actual)
+
+			var missing []string
+			for _, gsi := range diff.missingGSIs {
+				missing = append(missing, aws.ToString(gsi.IndexName))
+			}
+			if !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("missing GSIs = %v, want %v", missing, tt.wantMissing)
+			}
+			checkPrefixes(t, "unfixable", diff.unfixable, tt.wantUnfixable)
+			checkPrefixes(t, "notes", diff.notes, tt.wantNotes)
+		})
+	}
+}
+
+// checkPrefixes checks that each message starts with the wanted text, which
+// leaves out the advice on how to fix it
+func checkPrefixes(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %q, want %q", what, got, want)
+		return
+	}
+	for i := range got {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("%s[%d] = %q, want it to start with %q", what, i, got[i], want[i])
+		}
+	}
+}
+
+func TestDiffTableMissingGSIKeepsCapacity(t *testing.T) {
+	expected := expectedTable(t)
+	actual := describedTable(expected)
+	actual.GlobalSecondaryIndexes = nil
+
+	diff := diffTable(expected, actual)
+	if len(diff.missingGSIs) != 2 {
+		t.Fatalf("missing GSIs = %d, want 2", len(diff.missingGSIs))
+	}
+	for _, gsi := range diff.missingGSIs {
+		if gsi.ProvisionedThroughput == nil || aws.ToInt64(gsi.ProvisionedThroughput.ReadCapacityUnits) != 5 {
+			t.Errorf("GSI %s throughput = %+v, want the configured 5/5", aws.ToString(gsi.IndexName), gsi.ProvisionedThroughput)
+		}
+	}
+}
+
+// recreateWithoutGSIs replaces the table with the expected one minus its
+// GSIs, the way a table from before they were added looks
+func recreateWithoutGSIs(t *testing.T, repo *Repository) []string {
+	t.Helper()
+	ctx := context.Background()
+	if err := repo.DeleteTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	input := expectedTable(t)
+	var names []string
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		names = append(names, aws.ToString(gsi.IndexName))
+	}
+	keys := slices.Clone(input.KeySchema)
+	for _, lsi := range input.LocalSecondaryIndexes {
+		keys = append(keys, lsi.KeySchema...)
+	}
+	input.AttributeDefinitions = keyAttributes(input.AttributeDefinitions, keys)
+	input.GlobalSecondaryIndexes = nil
+	if _, err := repo.client.CreateTable(ctx, input); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	return names
+}
+
+func TestEnsureTableAddsGSIs(t *testing.T) {
+	repo, fake := newFakeRepository(t)
+	names := recreateWithoutGSIs(t, repo)
+
+	// Each new GSI backfills for a while, and the next cannot be added
+	// before it is ACTIVE
+	fake.backfillDescribes = 3
+	report, err := repo.EnsureTable(context.Background(), DefaultTableConfig())
+	if err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+	if report.Created || !slices.Equal(report.AddedIndexes, names) || len(report.Unfixable) > 0 {
+		t.Errorf("report = %+v, want %v added", report, names)
+	}
+	for name, left := range fake.table.backfilling {
+		if left > 0 {
+			t.Errorf("EnsureTable returned with GSI %s still CREATING", name)
+		}
+	}
+}
+
+func TestEnsureTableWaitsForBusyTable(t *testing.T) {
+	repo, fake := newFakeRepository(t)
+	names := recreateWithoutGSIs(t, repo)
+
+	// Another -ensure-table is still working on the table
+	fake.busyStatus = string(types.TableStatusUpdating)
+	fake.busyDescribes = 2
+	report, err := repo.EnsureTable(context.Background(), DefaultTableConfig())
+	if err != nil {
+		t.Fatalf("EnsureTable on an UPDATING table: %v", err)
+	}
+	if !slices.Equal(report.AddedIndexes, names) {
+		t.Errorf("added GSIs = %v, want %v", report.AddedIndexes, names)
+	}
+}
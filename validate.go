@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Request bodies implement validator, listing their invalid fields by json
+// name with at most one problem per field. Nested fields are named by their
+// path, so an address street is reported as addresses.home.street.
+
+// FieldError is one invalid field of a request body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError holds every invalid field of a request body
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+type validator interface {
+	Validate() []FieldError
+}
+
+// validate returns a *ValidationError listing every invalid field of v
+func validate(v validator) error {
+	if fields := v.Validate(); len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// fieldErrors collects the fields that fail their checks. The checks below
+// return "" when the value is fine; all but required pass empty values, so
+// optional fields are only checked when they are set.
+type fieldErrors []FieldError
+
+// check records the first message that is not "" for field
+func (e *fieldErrors) check(field string, messages ...string) {
+	for _, message := range messages {
+		if message != "" {
+			*e = append(*e, FieldError{Field: field, Message: message})
+			return
+		}
+	}
+}
+
+// nested adds the invalid fields of v under prefix
+func (e *fieldErrors) nested(prefix string, v validator) {
+	for _, field := range v.Validate() {
+		*e = append(*e, FieldError{Field: prefix + "." + field.Field, Message: field.Message})
+	}
+}
+
+func required(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "is required"
+	}
+	return ""
+}
+
+// maxLength limits s to n characters, not bytes
+func maxLength(s string, n int) string {
+	if utf8.RuneCountInString(s) > n {
+		return fmt.Sprintf("must be at most %d characters", n)
+	}
+	return ""
+}
+
+func atLeast(n, min int) string {
+	if n < min {
+		return fmt.Sprintf("must be at least %d", min)
+	}
+	return ""
+}
+
+func notNegative(a Amount) string {
+	if a < 0 {
+		return "must be at least " + Amount(0).String()
+	}
+	return ""
+}
+
+// email takes a bare address such as john@example.com
+func email(s string) string {
+	if s == "" {
+		return ""
+	}
+	if address, err := mail.ParseAddress(s); err != nil || address.Address != s {
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+func currency(s string) string {
+	if s != "" && !validCurrency(s) {
+		return "must be a currency with two decimal places such as USD"
+	}
+	return ""
+}
+
+// typeErrors finds the members of a JSON object that do not decode into v,
+// such as an amount with three decimal places, by decoding each member on its
+// own. Fields are named as they were sent. A document that is not an object
+// gives no errors.
+func typeErrors(body []byte, v any) []FieldError {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(body, &members) != nil {
+		return nil
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	var errs []FieldError
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		member, err := json.Marshal(map[string]json.RawMessage{name: members[name]})
+		if err != nil {
+			continue
+		}
+
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal(member, reflect.New(t).Interface()); errors.As(err, &typeErr) {
+			message := "has the wrong type"
+			// Members nested deeper are reported whole
+			if typeErr.Field == "" || strings.EqualFold(typeErr.Field, name) {
+				message = typeMessage(typeErr.Type)
+			}
+			errs = append(errs, FieldError{Field: name, Message: message})
+		}
+	}
+	return errs
+}
+
+// typeMessage describes the JSON a field of type t takes
+func typeMessage(t reflect.Type) string {
+	if t == reflect.TypeFor[Amount]() {
+		return "must be an amount with at most two decimal places"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "must be a string"
+	case reflect.Bool:
+		return "must be true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "must be a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "must be a number"
+	case reflect.Slice, reflect.Array:
+		return "must be a list"
+	case reflect.Struct, reflect.Map:
+		return "must be an object"
+	}
+	return "has the wrong type"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	zero, long := 0, "Maximilian"
+
+	tests := []struct {
+		name string
+		in   validator
+		want []FieldError
+	}{
+		{
+			name: "valid user",
+			in: User{
+				Username:       "ann",
+				Email:          "ann@example.com",
+				Addresses:      map[string]Address{"home": {Street: "1 Main St", Country: "US"}},
+				DefaultAddress: "home",
+			},
+		},
+		{
+			name: "empty optional fields",
+			in:   User{Username: "ann"},
+		},
+		{
+			name: "every user field broken",
+			in: User{
+				Username:       " ",
+				FullName:       strings.Repeat("a", 201),
+				Email:          "Ann <ann@example.com>",
+				Addresses:      map[string]Address{"work": {}, "home": {Street: "1 Main St", State: strings.Repeat("a", 101), Country: "US"}},
+				DefaultAddress: "office",
+			},
+			want: []FieldError{
+				{"username", "is required"},
+				{"full_name", "must be at most 200 characters"},
+				{"email", "must be a valid email address"},
+				{"addresses.home.state", "must be at most 100 characters"},
+				{"addresses.work.street", "is required"},
+				{"addresses.work.country", "is required"},
+				{"default_address", "is not one of the user's addresses"},
+			},
+		},
+		{
+			name: "characters not bytes",
+			in:   User{Username: "Zoë", FullName: strings.Repeat("ë", 200)},
+		},
+		{
+			name: "every product field broken",
+			in:   Product{Name: strings.Repeat("a", 201), UnitPrice: -1, Currency: "usd", Stock: -1},
+			want: []FieldError{
+				{"sku", "is required"},
+				{"name", "must be at most 200 characters"},
+				{"unit_price", "must be at least 0.00"},
+				{"currency", "must be a currency with two decimal places such as USD"},
+				{"stock", "must be at least 0"},
+			},
+		},
+		{
+			name: "item update",
+			in:   OrderItemUpdate{Quantity: &zero, Description: &long},
+			want: []FieldError{{"quantity", "must be at least 1"}},
+		},
+		{
+			name: "empty item update",
+			in:   OrderItemUpdate{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(tt.in)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("validate = %v, want no error", err)
+				}
+				return
+			}
+
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("validate = %v, want a *ValidationError", err)
+			}
+			if !errors.Is(err, ErrValidation) {
+				t.Error("error does not match ErrValidation")
+			}
+			if !reflect.DeepEqual(invalid.Fields, tt.want) {
+				t.Errorf("fields =\n%v\nwant\n%v", invalid.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		into any
+		in   string
+		want []FieldError
+	}{
+		{
+			name: "amount with three decimals",
+			into: &Product{},
+			in:   `{"sku": "A-1", "unit_price": "12.345", "stock": 3}`,
+			want: []FieldError{{"unit_price", "must be an amount with at most two decimal places"}},
+		},
+		{
+			name: "several fields",
+			into: &Product{},
+			in:   `{"sku": 7, "stock": "many", "unit_price": 1.5}`,
+			want: []FieldError{
+				{"sku", "must be a string"},
+				{"stock", "must be a whole number"},
+			},
+		},
+		{
+			name: "named as sent",
+			into: &Product{},
+			in:   `{"SKU": 7}`,
+			want: []FieldError{{"SKU", "must be a string"}},
+		},
+		{
+			name: "nested members are reported whole",
+			into: &User{},
+			in:   `{"addresses": {"home": {"street": 1, "country": "US"}}}`,
+			want: []FieldError{{"addresses", "has the wrong type"}},
+		},
+		{
+			name: "patches",
+			into: &UserPatch{},
+			in:   `{"email": 5, "full_name": null}`,
+			want: []FieldError{{"email", "must be a string"}},
+		},
+		{
+			name: "unknown members are left alone",
+			into: &Product{},
+			in:   `{"colour": 7}`,
+		},
+		{
+			name: "not an object",
+			into: &Product{},
+			in:   `[1, 2]`,
+		},
+		{
+			name: "malformed",
+			into: &Product{},
+			in:   `{"sku": `,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errs := typeErrors([]byte(tt.in), tt.into); !reflect.DeepEqual(errs, tt.want) {
+				t.Errorf("errors = %v, want %v", errs, tt.want)
+			}
+		})
+	}
+}